@@ -2,14 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"time"
 
@@ -25,12 +29,30 @@ var Version string = "development"
 
 func main() {
 	usage := `
-Usage: wrfda-run [-p WPS|DA|WPSDA] [-i GFS|IFS] [-outargs <argsfile>] <workdir> [startdate enddate]
+Usage: wrfda-run [-p WPS|DA|WPSDA] [-i <dataset>] [-outargs <argsfile>] [-resume] [-plan [-planformat text|json]] [-batch write|submit] [-job <name>] [-cfg <file>] <workdir> [startdate enddate]
 format for dates: YYYYMMDDHH
 Note: if you omit startdate and enddate, they are read from an arguments.txt
 files that should be put in a subdirectory of workdir named "inputs"
 default for -p is WPSDA
 default for -i is GFS (you can omit this argument if you're using an arguments.txt file.)
+datasets GFS and IFS are built-in, others can be defined in the [Datasets] section of configuration.
+-resume skips the steps already completed by a previous run of the same dates,
+and restarts from the first incomplete one.
+-plan prints every action the run would perform, without executing it.
+default for -planformat is text
+-batch write writes a batch job script for each group of steps, -batch submit
+also submits them to the scheduler configured in the [Batch] section.
+-job runs only the steps of a batch job, and it's used by job scripts.
+-cfg reads the configuration from the given file, instead of the one
+named in arguments.txt or wrfda-runner.cfg in workdir.
+
+Check configuration: wrfda-run [-p WPS|DA|WPSDA] [-i <dataset>] [-cfg <file>] check <workdir>
+Check namelists consistency: wrfda-run [-p WPS|DA|WPSDA] [-cfg <file>] check-namelists <workdir>
+Remove cached geogrid output: wrfda-run [-cfg <file>] invalidate-geogrid-cache <workdir>
+Suggest process counts: wrfda-run [-corespernode <n>] [-write] [-cfg <file>] suggest-procs <workdir>
+-write writes the suggested counts in the [Procs] section of configuration.
+These commands read the configuration like runs: from -cfg, or from the
+file named in inputs/arguments.txt, or from wrfda-runner.cfg in workdir.
 
 Show version: wrfda-run -v
 `
@@ -40,9 +62,24 @@ Show version: wrfda-run -v
 	stepF := flag.String("s", "", "")
 	inputF := flag.String("i", "GFS", "")
 	outArgsFileF := flag.String("outargs", "", "")
+	resumeF := flag.Bool("resume", false, "")
+	planF := flag.Bool("plan", false, "")
+	planFormatF := flag.String("planformat", "text", "")
+	coresPerNodeF := flag.Int("corespernode", 0, "")
+	writeF := flag.Bool("write", false, "")
+	batchF := flag.String("batch", "", "")
+	jobF := flag.String("job", "", "")
+	cfgF := flag.String("cfg", "", "")
 
 	flag.Parse()
 
+	inputSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "i" {
+			inputSet = true
+		}
+	})
+
 	if showver != nil && *showver {
 		fmt.Printf("wrfda-run ver. %s\n", Version)
 		return
@@ -61,19 +98,48 @@ Show version: wrfda-run -v
 		log.Fatalf("%s\nUnknown phase `%s`", usage, *phaseF)
 	}
 
-	if *inputF == "GFS" {
-		input = conf.GFS
-	} else if *inputF == "IFS" {
-		input = conf.IFS
-	} else if outArgsFileF == nil || *outArgsFileF == "" {
-		log.Fatalf("%s\nUnknown input dataset `%s`", usage, *phaseF)
-	}
+	// input datasets are defined in configuration,
+	// so the name is validated after reading it.
+	input = conf.InputDataset(strings.ToUpper(*inputF))
 
 	args := flag.Args()
 	if len(args) < 1 {
 		log.Fatal(usage)
 	}
 
+	if args[0] == "check" {
+		if len(args) < 2 {
+			log.Fatal(usage)
+		}
+		os.Exit(check(args[1], *cfgF, phase, input))
+	}
+
+	if args[0] == "check-namelists" {
+		if len(args) < 2 {
+			log.Fatal(usage)
+		}
+		os.Exit(checkNamelists(args[1], *cfgF, phase))
+	}
+
+	if args[0] == "invalidate-geogrid-cache" {
+		if len(args) < 2 {
+			log.Fatal(usage)
+		}
+		wd, cfgFile := workdirConfig(args[1], *cfgF)
+		err := runner.InvalidateGeogridCache(cfgFile, wd, os.Stdout, io.Discard)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	}
+
+	if args[0] == "suggest-procs" {
+		if len(args) < 2 {
+			log.Fatal(usage)
+		}
+		os.Exit(suggestProcs(args[1], *cfgF, *coresPerNodeF, *writeF))
+	}
+
 	var err error
 	var dates *fileargs.FileArguments
 	var cfgFile vpath.VirtualPath
@@ -91,18 +157,15 @@ Show version: wrfda-run -v
 			log.Fatal(err.Error() + "\n")
 		}
 
-		if inputF == nil {
-			if strings.HasSuffix(dates.CfgPath, ".gfs.cfg") {
-				input = conf.GFS
-			}
-
-			if strings.HasSuffix(dates.CfgPath, ".ifs.cfg") {
-				input = conf.IFS
+		if !inputSet {
+			// the dataset name is the extension
+			// before .cfg, e.g. italy-config.gfs.cfg
+			parts := strings.Split(dates.CfgPath, ".")
+			if len(parts) < 3 || parts[len(parts)-1] != "cfg" {
+				log.Fatalf("%s\nUnknown input dataset `%s` must end in .<dataset>.cfg", usage, dates.CfgPath)
 			}
-
-			log.Fatalf("%s\nUnknown input dataset `%s` must end in .gfs.cfg or .ifs.cfg", usage, dates.CfgPath)
+			input = conf.InputDataset(strings.ToUpper(parts[len(parts)-2]))
 		}
-		dates.CfgPath = wd.Join(dates.CfgPath).Path
 	} else {
 		dates = &fileargs.FileArguments{
 			Periods: []*fileargs.Period{},
@@ -130,10 +193,8 @@ Show version: wrfda-run -v
 				})
 			}
 		*/
-
-		dates.CfgPath = wd.Join("wrfda-runner.cfg").Path
 	}
-	cfgFile = vpath.Local(dates.CfgPath)
+	cfgFile = configFile(wd, *cfgF, dates)
 
 	if outArgsFileF != nil && *outArgsFileF != "" {
 		outargs := *outArgsFileF
@@ -146,7 +207,7 @@ Show version: wrfda-run -v
 			if input == conf.GFS {
 				buf.AddLine("italy-config.gfs.cfg")
 			} else {
-				buf.AddLine("france-config.ifs.cfg")
+				buf.AddLine(fmt.Sprintf("france-config.%s.cfg", strings.ToLower(string(input))))
 			}
 		}
 
@@ -165,14 +226,76 @@ Show version: wrfda-run -v
 		}
 	}
 
-	err = runner.Init(cfgFile, wd)
+	err = runner.Init(cfgFile, wd, phase)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
+	if phase == conf.WPSPhase || phase == conf.WPSThenDAPhase {
+		if _, err := conf.Dataset(input); err != nil {
+			log.Fatalf("%s\n%s", usage, err.Error())
+		}
+	}
+
+	if *batchF != "" {
+		if *batchF != "write" && *batchF != "submit" {
+			log.Fatalf("%s\nUnknown batch mode `%s`", usage, *batchF)
+		}
+		err = runner.SubmitBatch(dates.Periods,
+			cfgFile, wd, phase, input, *batchF == "submit", os.Stdout, os.Stderr,
+		)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	}
+
+	if *jobF != "" {
+		if len(dates.Periods) != 1 {
+			log.Fatalf("%s\n-job needs a single date", usage)
+		}
+		period := dates.Periods[0]
+		ctx, stop := interruptible()
+		defer stop()
+		err = runner.RunJob(ctx, period.Start, period.Start.Add(period.Duration),
+			wd, phase, input, *jobF, os.Stdout, os.Stderr,
+		)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	}
+
+	if *planF {
+		if *planFormatF != "text" && *planFormatF != "json" {
+			log.Fatalf("%s\nUnknown plan format `%s`", usage, *planFormatF)
+		}
+
+		plan, err := runner.Plan(dates.Periods,
+			wd, phase, input, *resumeF, os.Stderr, os.Stderr,
+		)
+
+		var writeErr error
+		if *planFormatF == "json" {
+			writeErr = plan.WriteJSON(os.Stdout)
+		} else {
+			writeErr = plan.WriteText(os.Stdout)
+		}
+
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		if writeErr != nil {
+			log.Fatal(writeErr.Error())
+		}
+		return
+	}
+
 	if *stepF == "" {
-		err = runner.Run(dates.Periods,
-			wd, phase, input, os.Stdout, os.Stderr,
+		ctx, stop := interruptible()
+		defer stop()
+		err = runner.Run(ctx, dates.Periods,
+			wd, phase, input, *resumeF, os.Stdout, os.Stderr,
 		)
 		if err != nil {
 			log.Fatal(err.Error())
@@ -204,6 +327,116 @@ Show version: wrfda-run -v
 
 }
 
+// interruptible returns a context cancelled when the command
+// receives SIGINT or SIGTERM, e.g. the signal sent by batch
+// schedulers before killing a job. Once the context is
+// cancelled, a second signal terminates the command at once.
+func interruptible() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
+// configFile returns the configuration file used in `wd`:
+// `cfgFlag` when it's set, or else the file named in `dates`,
+// read from an arguments.txt file, or else wrfda-runner.cfg.
+func configFile(wd vpath.VirtualPath, cfgFlag string, dates *fileargs.FileArguments) vpath.VirtualPath {
+	if cfgFlag != "" {
+		cfgPath, err := filepath.Abs(cfgFlag)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		return vpath.Local(cfgPath)
+	}
+	if dates != nil && dates.CfgPath != "" {
+		return wd.Join(dates.CfgPath)
+	}
+	return wd.Join("wrfda-runner.cfg")
+}
+
+// workdirConfig returns the absolute path of `workdir`, and
+// the configuration file used in it, resolved as for runs
+// without dates on the command line: the file named in
+// inputs/arguments.txt, when it exists, is used.
+func workdirConfig(workdir string, cfgFlag string) (vpath.VirtualPath, vpath.VirtualPath) {
+	wd := absWorkdir(workdir)
+	var dates *fileargs.FileArguments
+	if _, err := os.Stat("inputs/arguments.txt"); err == nil {
+		dates, err = runner.ReadTimes("inputs/arguments.txt")
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+	return wd, configFile(wd, cfgFlag, dates)
+}
+
+// check verifies the configuration of `workdir`,
+// printing all problems found, and returns
+// the exit code for the command.
+func check(workdir string, cfgFlag string, phase conf.RunPhase, input conf.InputDataset) int {
+	wd, cfgFile := workdirConfig(workdir, cfgFlag)
+	problems := runner.Check(cfgFile, wd, phase, input, io.Discard, io.Discard)
+	return reportProblems(wd, problems, "configuration OK")
+}
+
+// checkNamelists verifies the consistency of namelist
+// templates of `workdir`, printing all problems found,
+// and returns the exit code for the command.
+func checkNamelists(workdir string, cfgFlag string, phase conf.RunPhase) int {
+	wd, cfgFile := workdirConfig(workdir, cfgFlag)
+	problems := runner.CheckNamelists(cfgFile, wd, phase, io.Discard, io.Discard)
+	return reportProblems(wd, problems, "namelists OK")
+}
+
+// suggestProcs prints the process counts suggested for
+// the domains of `workdir`, and writes them in its
+// configuration if `write` is true. It returns the
+// exit code for the command.
+func suggestProcs(workdir string, cfgFlag string, coresPerNode int, write bool) int {
+	wd, cfgFile := workdirConfig(workdir, cfgFlag)
+	suggestion, err := runner.SuggestProcs(cfgFile, wd, coresPerNode, io.Discard, io.Discard)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	if err := suggestion.WriteText(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	if write {
+		if err := suggestion.WriteProcs(cfgFile); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		fmt.Printf("[Procs] section of %s updated\n", cfgFile.Path)
+	}
+	return 0
+}
+
+func absWorkdir(workdir string) vpath.VirtualPath {
+	absWd, err := filepath.Abs(workdir)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	return vpath.Local(absWd)
+}
+
+func reportProblems(wd vpath.VirtualPath, problems []string, okMsg string) int {
+	if len(problems) == 0 {
+		fmt.Printf("%s: %s\n", wd.Path, okMsg)
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "%s: %d problems found:\n", wd.Path, len(problems))
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stderr, "  - %s\n", problem)
+	}
+	return 1
+}
+
 type lineBuf struct {
 	buf bytes.Buffer
 }
@@ -0,0 +1,79 @@
+package conf
+
+import (
+	"fmt"
+)
+
+// Scheduler is a batch system
+// to which runs can be submitted.
+type Scheduler string
+
+const (
+	// SLURM - submit jobs with sbatch
+	SLURM Scheduler = "slurm"
+	// PBS - submit jobs with qsub
+	PBS Scheduler = "pbs"
+)
+
+// DefaultWallTime is the wall time of jobs
+// when Batch.WallTime is not configured.
+const DefaultWallTime = "06:00:00"
+
+// BatchConf configures the batch jobs
+// submitted to run each date.
+type BatchConf struct {
+	// Scheduler is the batch system used.
+	Scheduler Scheduler
+
+	// Queue is the partition (SLURM) or
+	// queue (PBS) where jobs are submitted.
+	Queue string
+
+	// Account is the account charged for jobs.
+	Account string
+
+	// WallTime is the wall time of jobs, in
+	// the form HH:MM:SS (default DefaultWallTime).
+	WallTime string
+
+	// WallTimes contains the wall time of some kind of
+	// jobs, used instead of WallTime. Keys are WPS, Real,
+	// DA and WRF.
+	WallTimes map[string]string
+
+	// Directives are added verbatim after the
+	// other directives in every job script.
+	Directives []string
+
+	// Command is the path of wrfda-run on the nodes
+	// where jobs run. Default is the path of the
+	// running executable.
+	Command string
+}
+
+func (batch *BatchConf) init() error {
+	if batch.WallTime == "" {
+		batch.WallTime = DefaultWallTime
+	}
+	switch batch.Scheduler {
+	case "", SLURM, PBS:
+	default:
+		return fmt.Errorf("unknown batch scheduler `%s`, must be one of %s, %s", batch.Scheduler, SLURM, PBS)
+	}
+	for kind := range batch.WallTimes {
+		switch kind {
+		case "WPS", "Real", "DA", "WRF":
+		default:
+			return fmt.Errorf("unknown kind of job `%s` in WallTimes, must be one of WPS, Real, DA, WRF", kind)
+		}
+	}
+	return nil
+}
+
+// JobWallTime returns the wall time of jobs of `kind`.
+func (batch BatchConf) JobWallTime(kind string) string {
+	if wallTime, ok := batch.WallTimes[kind]; ok {
+		return wallTime
+	}
+	return batch.WallTime
+}
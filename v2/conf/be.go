@@ -0,0 +1,146 @@
+package conf
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultBEFile is the template of the background error
+// files used when BackgroundError.File is not configured.
+const DefaultBEFile = "{{.Season}}/be_d{{.Domain}}"
+
+// DefaultSeasons is the season to months mapping used
+// when BackgroundError.Seasons is not configured.
+var DefaultSeasons = map[string][]int{
+	"winter": {12, 1, 2},
+	"spring": {3, 4, 5},
+	"summer": {6, 7, 8},
+	"fall":   {9, 10, 11},
+}
+
+// domainKey matches the keys of BackgroundError.Domains.
+var domainKey = regexp.MustCompile(`^d[0-9]{2}$`)
+
+// BEFileArgs are the variables available
+// in background error file templates.
+type BEFileArgs struct {
+	// Month is the month of the start date of
+	// the run, from 01 to 12
+	Month string
+	// Season is the season of Month
+	Season string
+	// Domain is the domain number, from 01
+	Domain string
+	// CycleHour is the hour of the cycle date, from 00 to 23
+	CycleHour string
+}
+
+// BackgroundErrorConf configures the background error file
+// linked as be.dat in WRFDA directories. File and Domains
+// are go templates of paths relative to CovarMatrixesDir,
+// executed with a BEFileArgs.
+type BackgroundErrorConf struct {
+	// File is the template used for all domains
+	// (default DefaultBEFile).
+	File string
+
+	// Domains contains, for some domains, a template
+	// used instead of File. Keys are in the form "d01".
+	// Other keys are rejected.
+	Domains map[string]string
+
+	// Seasons maps season names to the months
+	// they contain (default DefaultSeasons).
+	Seasons map[string][]int
+
+	templates map[string]*template.Template
+	seasonOf  map[time.Month]string
+}
+
+func (be *BackgroundErrorConf) init() error {
+	if be.File == "" {
+		be.File = DefaultBEFile
+	}
+	if len(be.Seasons) == 0 {
+		be.Seasons = DefaultSeasons
+	}
+
+	be.seasonOf = map[time.Month]string{}
+	for _, season := range be.SeasonNames() {
+		for _, month := range be.Seasons[season] {
+			if month < 1 || month > 12 {
+				return fmt.Errorf("invalid month %d in season `%s`", month, season)
+			}
+			if other, ok := be.seasonOf[time.Month(month)]; ok {
+				return fmt.Errorf("month %d is in both seasons `%s` and `%s`", month, other, season)
+			}
+			be.seasonOf[time.Month(month)] = season
+		}
+	}
+	for month := time.January; month <= time.December; month++ {
+		if _, ok := be.seasonOf[month]; !ok {
+			return fmt.Errorf("month %d is not in any season", month)
+		}
+	}
+
+	be.templates = map[string]*template.Template{}
+	sources := map[string]string{"": be.File}
+	for domain, source := range be.Domains {
+		key := strings.ToLower(domain)
+		if !domainKey.MatchString(key) {
+			return fmt.Errorf("invalid domain `%s` in Domains, must be in the form d01", domain)
+		}
+		sources[key] = source
+	}
+	for name, source := range sources {
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(source)
+		if err != nil {
+			return fmt.Errorf("invalid template `%s`: %w", source, err)
+		}
+		be.templates[name] = tmpl
+	}
+	return nil
+}
+
+// SeasonNames returns the sorted names of all seasons.
+func (be *BackgroundErrorConf) SeasonNames() []string {
+	names := make([]string, 0, len(be.Seasons))
+	for name := range be.Seasons {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Season returns the season containing `month`.
+func (be *BackgroundErrorConf) Season(month time.Month) string {
+	return be.seasonOf[month]
+}
+
+// BEFile returns the path, relative to CovarMatrixesDir, of
+// the background error file for `domain` in the cycle
+// assimilating at `assimDate` of the run starting at `start`.
+// The month and season are the ones of `start`, so all
+// cycles of a run use the same season.
+func (be *BackgroundErrorConf) BEFile(domain int, start, assimDate time.Time) (string, error) {
+	tmpl, ok := be.templates[fmt.Sprintf("d%02d", domain)]
+	if !ok {
+		tmpl = be.templates[""]
+	}
+
+	var buf strings.Builder
+	err := tmpl.Execute(&buf, BEFileArgs{
+		Month:     start.Format("01"),
+		Season:    be.Season(start.Month()),
+		Domain:    fmt.Sprintf("%02d", domain),
+		CycleHour: assimDate.Format("15"),
+	})
+	if err != nil {
+		return "", fmt.Errorf("cannot execute background error file template: %w", err)
+	}
+	return buf.String(), nil
+}
@@ -8,11 +8,13 @@ import (
 	"fmt"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/meteocima/namelist-prepare/namelist"
-	"github.com/meteocima/virtual-server/ctx"
 	"github.com/meteocima/virtual-server/vpath"
+	"github.com/meteocima/wrfda-runner/v2/nml"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
 )
 
 // FoldersConf contains path of all
@@ -27,6 +29,14 @@ type FoldersConf struct {
 	GFSArchive          vpath.VirtualPath
 	ObservationsArchive vpath.VirtualPath
 	NamelistsDir        vpath.VirtualPath
+
+	// GeogridCacheDir, if set, is the directory where
+	// geogrid output is cached and reused across dates.
+	GeogridCacheDir vpath.VirtualPath
+
+	// UngribCacheDir, if set, is the directory where ungrib
+	// intermediate files are cached and shared between runs.
+	UngribCacheDir vpath.VirtualPath
 }
 
 // ProcsConf ...
@@ -45,6 +55,118 @@ type ProcsConf struct {
 
 	// RealProcCount ...
 	RealProcCount string
+
+	// ParallelDA enables running WRFDA on all domains
+	// of a cycle concurrently. Domains without a count in
+	// WrfdaDomainProcCount share WrfdaProcCount processes.
+	ParallelDA bool
+
+	// CoresPerNode is the number of cores of the nodes
+	// used to run, used to suggest process counts.
+	CoresPerNode int
+
+	// WrfdaDomainProcCount contains, for each domain
+	// starting from d01, the number of WRFDA processes.
+	// Domains without an entry, or with an empty
+	// one, use WrfdaProcCount.
+	WrfdaDomainProcCount []string
+
+	// WrfCycleProcCount contains, for each cycle
+	// starting from the first, the number of WRF
+	// processes. Cycles without an entry, or with an
+	// empty one, use WrfstepProcCount.
+	WrfCycleProcCount []string
+}
+
+// Wrfda returns the number of WRFDA
+// processes to use for `domain`.
+func (procs ProcsConf) Wrfda(domain int) string {
+	if domain >= 1 && domain <= len(procs.WrfdaDomainProcCount) && procs.WrfdaDomainProcCount[domain-1] != "" {
+		return procs.WrfdaDomainProcCount[domain-1]
+	}
+	return procs.WrfdaProcCount
+}
+
+// Wrf returns the number of WRF
+// processes to use for `cycle`.
+func (procs ProcsConf) Wrf(cycle int) string {
+	if cycle >= 1 && cycle <= len(procs.WrfCycleProcCount) && procs.WrfCycleProcCount[cycle-1] != "" {
+		return procs.WrfCycleProcCount[cycle-1]
+	}
+	return procs.WrfstepProcCount
+}
+
+// CyclesConf contains the number of
+// assimilation cycles to run for each date
+// and the interval in hours between them.
+// The last cycle always assimilates at the start
+// date of the forecast.
+type CyclesConf struct {
+	// Count is the number of assimilation cycles
+	Count int
+
+	// Interval is the number of hours between
+	// two consecutive cycles
+	Interval int
+
+	// PassThrough enables the degraded mode: when
+	// WRFDA fails, or there are no observations, the
+	// cycle passes its first guess through unchanged
+	// instead of failing the run.
+	PassThrough bool
+
+	// PreviousRun is the number of hours between the
+	// start of a run and the start of the previous
+	// one, that it continues (default 24).
+	PreviousRun int
+
+	// CarryVARBC enables copying the VARBC coefficients
+	// of the last cycle of the previous run to the first
+	// cycle of the run.
+	CarryVARBC bool
+
+	// WarmStart enables taking the first guess of the
+	// first cycle from the forecast of the previous run,
+	// when available, instead of the output of real.
+	WarmStart bool
+}
+
+// IntervalDuration returns the interval between
+// two consecutive cycles as a time.Duration
+func (cycles CyclesConf) IntervalDuration() time.Duration {
+	return time.Duration(cycles.Interval) * time.Hour
+}
+
+// PreviousRunDuration returns the time elapsed between the
+// start of the previous run and the start of a run.
+func (cycles CyclesConf) PreviousRunDuration() time.Duration {
+	return time.Duration(cycles.PreviousRun) * time.Hour
+}
+
+// AssimDate returns the date on which `cycle`
+// assimilates observations, for a forecast
+// starting at `start`. Cycles are numbered from 1.
+func (cycles CyclesConf) AssimDate(start time.Time, cycle int) time.Time {
+	return start.Add(time.Duration(cycle-cycles.Count) * cycles.IntervalDuration())
+}
+
+// FirstAssimDate returns the date of the
+// first assimilation cycle for a forecast
+// starting at `start`.
+func (cycles CyclesConf) FirstAssimDate(start time.Time) time.Time {
+	return cycles.AssimDate(start, 1)
+}
+
+// IsLast returns true if `cycle` is the
+// last one, which runs the main forecast.
+func (cycles CyclesConf) IsLast(cycle int) bool {
+	return cycle == cycles.Count
+}
+
+// Span returns the time elapsed from first
+// to last assimilation cycle.
+func (cycles CyclesConf) Span() time.Duration {
+	return time.Duration(cycles.Count-1) * cycles.IntervalDuration()
 }
 
 // EnvVars is a set of environment variables
@@ -66,9 +188,26 @@ func (vars EnvVars) ToSlice() []string {
 // Configuration contains all configuration
 // sub structures
 type Configuration struct {
-	Folders FoldersConf
-	Procs   ProcsConf
-	Env     EnvVars
+	Folders         FoldersConf
+	Procs           ProcsConf
+	Cycles          CyclesConf
+	Datasets        DatasetsConf
+	Observations    ObservationsConf
+	BackgroundError BackgroundErrorConf
+	Launcher        LauncherConf
+	Batch           BatchConf
+	Timeouts        TimeoutsConf
+	Retries         RetriesConf
+	Env             EnvVars
+}
+
+// DefaultCycles is the cycles configuration used
+// when the [Cycles] section is missing: three cycles
+// spaced 3 hours apart.
+var DefaultCycles = CyclesConf{
+	Count:       3,
+	Interval:    3,
+	PreviousRun: 24,
 }
 
 // Config is the runtime configuration readed from file.
@@ -78,8 +217,37 @@ var Config Configuration
 // from `confPath` file.
 func Init(confFile vpath.VirtualPath) error {
 
+	Config = Configuration{}
 	_, err := toml.DecodeFile(confFile.Path, &Config)
+	if err != nil {
+		return err
+	}
 	confDir := confFile.Dir()
+	gfsArchive := Config.Folders.GFSArchive
+
+	if Config.Cycles.Count == 0 {
+		Config.Cycles.Count = DefaultCycles.Count
+	}
+
+	if Config.Cycles.Interval == 0 {
+		Config.Cycles.Interval = DefaultCycles.Interval
+	}
+
+	if Config.Cycles.PreviousRun == 0 {
+		Config.Cycles.PreviousRun = DefaultCycles.PreviousRun
+	}
+
+	if Config.Cycles.PreviousRun < 0 {
+		return fmt.Errorf("invalid Cycles.PreviousRun %d in `%s`: must be greater than 0", Config.Cycles.PreviousRun, confFile.String())
+	}
+
+	if Config.Cycles.Count < 0 {
+		return fmt.Errorf("invalid Cycles.Count %d in `%s`: must be greater than 0", Config.Cycles.Count, confFile.String())
+	}
+
+	if Config.Cycles.Interval < 0 {
+		return fmt.Errorf("invalid Cycles.Interval %d in `%s`: must be greater than 0", Config.Cycles.Interval, confFile.String())
+	}
 
 	if !path.IsAbs(Config.Folders.GeodataDir.Path) {
 		Config.Folders.GeodataDir = confDir.JoinP(Config.Folders.GeodataDir)
@@ -116,8 +284,49 @@ func Init(confFile vpath.VirtualPath) error {
 	if !path.IsAbs(Config.Folders.NamelistsDir.Path) {
 		Config.Folders.NamelistsDir = confDir.JoinP(Config.Folders.NamelistsDir)
 	}
+	if Config.Folders.GeogridCacheDir.Path != "" && !path.IsAbs(Config.Folders.GeogridCacheDir.Path) {
+		Config.Folders.GeogridCacheDir = confDir.JoinP(Config.Folders.GeogridCacheDir)
+	}
+	if Config.Folders.UngribCacheDir.Path != "" && !path.IsAbs(Config.Folders.UngribCacheDir.Path) {
+		Config.Folders.UngribCacheDir = confDir.JoinP(Config.Folders.UngribCacheDir)
+	}
 	//fmt.Println(Config.Folders)
-	return err
+
+	if len(Config.Procs.WrfCycleProcCount) > Config.Cycles.Count {
+		return fmt.Errorf("invalid Procs.WrfCycleProcCount in `%s`: %d values for %d cycles", confFile.String(), len(Config.Procs.WrfCycleProcCount), Config.Cycles.Count)
+	}
+
+	if err := Config.Observations.init(); err != nil {
+		return fmt.Errorf("invalid Observations in `%s`: %w", confFile.String(), err)
+	}
+
+	if err := Config.BackgroundError.init(); err != nil {
+		return fmt.Errorf("invalid BackgroundError in `%s`: %w", confFile.String(), err)
+	}
+
+	if err := Config.Launcher.init(); err != nil {
+		return fmt.Errorf("invalid Launcher in `%s`: %w", confFile.String(), err)
+	}
+	if Config.Procs.ParallelDA && (len(Config.Launcher.Hosts) > 0 || Config.Launcher.HostFile != "") {
+		return fmt.Errorf("invalid Launcher in `%s`: Hosts and HostFile cannot be used with Procs.ParallelDA, hosts are not split among domains", confFile.String())
+	}
+
+	if err := Config.Batch.init(); err != nil {
+		return fmt.Errorf("invalid Batch in `%s`: %w", confFile.String(), err)
+	}
+
+	if err := Config.Timeouts.init(); err != nil {
+		return fmt.Errorf("invalid Timeouts in `%s`: %w", confFile.String(), err)
+	}
+
+	if err := Config.Retries.init(); err != nil {
+		return fmt.Errorf("invalid Retries in `%s`: %w", confFile.String(), err)
+	}
+
+	if err := initDatasets(confDir, gfsArchive); err != nil {
+		return fmt.Errorf("invalid dataset in `%s`: %w", confFile.String(), err)
+	}
+	return nil
 }
 
 // NamelistFile ...
@@ -125,10 +334,11 @@ func NamelistFile(source string) vpath.VirtualPath {
 	return Config.Folders.NamelistsDir.Join(source)
 }
 
-// RenderNameList ...
-func RenderNameList(vs *ctx.Context, source string, target vpath.VirtualPath, args namelist.Args) {
+// RenderNameListString returns the content of namelist
+// template `source` rendered using `args`.
+func RenderNameListString(vs *runctx.Context, source string, args namelist.Args) string {
 	if vs.Err != nil {
-		return
+		return ""
 	}
 
 	tmplFile := vs.ReadString(NamelistFile(source))
@@ -140,5 +350,30 @@ func RenderNameList(vs *ctx.Context, source string, target vpath.VirtualPath, ar
 
 	var renderedNamelist strings.Builder
 	tmpl.RenderTo(args, &renderedNamelist)
-	vs.WriteString(target, renderedNamelist.String())
+	return renderedNamelist.String()
+}
+
+// RenderNameList ...
+func RenderNameList(vs *runctx.Context, source string, target vpath.VirtualPath, args namelist.Args) {
+	content := RenderNameListString(vs, source, args)
+	if vs.Err != nil {
+		return
+	}
+	vs.WriteRendered(NamelistFile(source), target, content)
+}
+
+// ReadNamelist renders namelist template `source` using
+// `args` and parses the result.
+func ReadNamelist(vs *runctx.Context, source string, args namelist.Args) *nml.Namelist {
+	content := RenderNameListString(vs, source, args)
+	if vs.Err != nil {
+		return nil
+	}
+
+	nl, err := nml.ParseString(content)
+	if err != nil {
+		vs.Err = fmt.Errorf("cannot parse namelist `%s`: %w", NamelistFile(source).String(), err)
+		return nil
+	}
+	return nl
 }
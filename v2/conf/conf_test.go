@@ -0,0 +1,275 @@
+package conf
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meteocima/virtual-server/vpath"
+	"github.com/meteocima/wrfda-runner/v2/internal/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInitDefaultCycles(t *testing.T) {
+	err := Init(vpath.Local(testutil.Fixture("testrun/wrfda-runner.cfg")))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, DefaultCycles, Config.Cycles)
+	assert.Equal(t, testutil.Fixture("testrun/NamelistsDir"), Config.Folders.NamelistsDir.Path)
+}
+
+func TestCyclesAssimDate(t *testing.T) {
+	start := time.Date(2020, 12, 25, 0, 0, 0, 0, time.UTC)
+
+	cycles := CyclesConf{Count: 3, Interval: 3}
+	assert.Equal(t, "2020122418", cycles.FirstAssimDate(start).Format("2006010215"))
+	assert.Equal(t, "2020122421", cycles.AssimDate(start, 2).Format("2006010215"))
+	assert.Equal(t, "2020122500", cycles.AssimDate(start, 3).Format("2006010215"))
+	assert.True(t, cycles.IsLast(3))
+	assert.Equal(t, 6*time.Hour, cycles.Span())
+
+	cycles = CyclesConf{Count: 6, Interval: 1}
+	assert.Equal(t, "2020122419", cycles.FirstAssimDate(start).Format("2006010215"))
+	assert.Equal(t, "2020122423", cycles.AssimDate(start, 5).Format("2006010215"))
+	assert.False(t, cycles.IsLast(5))
+}
+
+func TestInitDatasets(t *testing.T) {
+	cfg, err := os.ReadFile(testutil.Fixture("testrun/wrfda-runner.cfg"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	cfgFile := path.Join(t.TempDir(), "wrfda-runner.cfg")
+	err = os.WriteFile(cfgFile, append(cfg, []byte(`
+[Datasets.era5]
+    Vtable = "ungrib/Variable_Tables/Vtable.ERA-interim.pl"
+    Archive = "./reanalysis/2006/01/02"
+    Glob = "era5-*.grb"
+    StepHours = 1
+
+[Datasets.IFS]
+    Vtable = "/opt/vtables/Vtable.IFS"
+    AvgTsfc = true
+
+[Datasets.MIXED]
+    Fallback = 2
+[[Datasets.MIXED.Sources]]
+    Prefix = "ATM"
+    Vtable = "Vtable.ATM"
+[[Datasets.MIXED.Sources]]
+    Prefix = "SST"
+    Vtable = "Vtable.SST"
+    Fallback = -1
+`)...), 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	err = Init(vpath.Local(cfgFile))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, []string{"ERA5", "GFS", "IFS", "MIXED"}, DatasetNames())
+
+	mixed, err := Dataset("MIXED")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2, mixed.Sources[0].Fallback)
+		assert.Equal(t, 0, mixed.Sources[1].Fallback)
+	}
+
+	era5, err := Dataset("Era5")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "ERA5", era5.Name)
+	assert.Equal(t, 1, era5.StepHours)
+	assert.False(t, era5.AvgTsfc)
+	assert.Equal(t, path.Join(path.Dir(cfgFile), "WPSPrg/ungrib/Variable_Tables/Vtable.ERA-interim.pl"), era5.VtableFile().Path)
+	start := time.Date(2020, 12, 24, 18, 0, 0, 0, time.UTC)
+	assert.Equal(t, path.Join(path.Dir(cfgFile), "reanalysis/2020/12/24"), era5.ArchiveDir(start).Path)
+
+	ifs, err := Dataset(IFS)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "/opt/vtables/Vtable.IFS", ifs.VtableFile().Path)
+	assert.Equal(t, 3, ifs.StepHours)
+	assert.Equal(t, Config.Folders.GFSArchive, ifs.ArchiveDir(start))
+
+	gfs, err := Dataset(GFS)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, gfs.AvgTsfc)
+	assert.Equal(t, path.Join(path.Dir(cfgFile), "WPSPrg/ungrib/Variable_Tables/Vtable.GFS"), gfs.VtableFile().Path)
+
+	_, err = Dataset("ICON")
+	assert.EqualError(t, err, "unknown input dataset `ICON`, available datasets are: ERA5, GFS, IFS, MIXED")
+}
+
+func TestBackgroundErrorFile(t *testing.T) {
+	be := BackgroundErrorConf{}
+	if !assert.NoError(t, be.init()) {
+		return
+	}
+	start := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	dt := time.Date(2021, 2, 28, 18, 0, 0, 0, time.UTC)
+	file, err := be.BEFile(2, start, dt)
+	assert.NoError(t, err)
+	assert.Equal(t, "spring/be_d02", file, "the season is the one of the start date")
+
+	be = BackgroundErrorConf{
+		File:    "{{.Month}}/{{.CycleHour}}/be_d{{.Domain}}",
+		Domains: map[string]string{"D03": "climatology/be_d03"},
+		Seasons: map[string][]int{"cold": {10, 11, 12, 1, 2, 3}, "warm": {4, 5, 6, 7, 8, 9}},
+	}
+	if !assert.NoError(t, be.init()) {
+		return
+	}
+	file, err = be.BEFile(2, start, dt)
+	assert.NoError(t, err)
+	assert.Equal(t, "03/18/be_d02", file)
+	file, err = be.BEFile(3, start, dt)
+	assert.NoError(t, err)
+	assert.Equal(t, "climatology/be_d03", file)
+	assert.Equal(t, "warm", be.Season(time.June))
+
+	be = BackgroundErrorConf{Seasons: map[string][]int{"all": {1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}}}
+	assert.EqualError(t, be.init(), "month 12 is not in any season")
+
+	be = BackgroundErrorConf{Seasons: map[string][]int{"a": {1, 2, 3, 4, 5, 6}, "b": {6, 7, 8, 9, 10, 11, 12}}}
+	assert.EqualError(t, be.init(), "month 6 is in both seasons `a` and `b`")
+
+	be = BackgroundErrorConf{File: "{{.Year}}/be_d{{.Domain}}"}
+	assert.NoError(t, be.init())
+	_, err = be.BEFile(1, start, dt)
+	assert.Error(t, err)
+
+	be = BackgroundErrorConf{Domains: map[string]string{"domain3": "climatology/be_d03"}}
+	assert.EqualError(t, be.init(), "invalid domain `domain3` in Domains, must be in the form d01")
+}
+
+func TestProcsPerDomainAndCycle(t *testing.T) {
+	procs := ProcsConf{
+		WrfdaProcCount:       "36",
+		WrfstepProcCount:     "48",
+		WrfdaDomainProcCount: []string{"72", "24"},
+		WrfCycleProcCount:    []string{"", "", "96"},
+	}
+	assert.Equal(t, "72", procs.Wrfda(1))
+	assert.Equal(t, "24", procs.Wrfda(2))
+	assert.Equal(t, "36", procs.Wrfda(3))
+	assert.Equal(t, "48", procs.Wrf(1))
+	assert.Equal(t, "96", procs.Wrf(3))
+	assert.Equal(t, "48", procs.Wrf(4))
+}
+
+func TestLauncher(t *testing.T) {
+	launcher := LauncherConf{}
+	if !assert.NoError(t, launcher.init()) {
+		return
+	}
+	cmd, args, err := launcher.Args(LaunchArgs{Procs: "36", Exe: "./wrf.exe", Cwd: "/run/wrf18"})
+	assert.NoError(t, err)
+	assert.Equal(t, "mpirun", cmd)
+	assert.Equal(t, []string{"-n", "36", "./wrf.exe"}, args)
+
+	os.Setenv("WRFDA_RUNNER_TEST_SIF", "/images/wrf.sif")
+	defer os.Unsetenv("WRFDA_RUNNER_TEST_SIF")
+	launcher = LauncherConf{
+		Command:  "mpiexec -f {{.HostFile}} -hosts {{.Hosts}} -n {{.Procs}} apptainer exec --pwd {{.Cwd}} {{env \"WRFDA_RUNNER_TEST_SIF\"}} {{.Exe}}",
+		Hosts:    []string{"node1", "node2"},
+		HostFile: "/etc/hosts.mpi",
+	}
+	if !assert.NoError(t, launcher.init()) {
+		return
+	}
+	cmd, args, err = launcher.Args(LaunchArgs{Procs: "72", Exe: "./da_wrfvar.exe", Cwd: "/run/da18_d01"})
+	assert.NoError(t, err)
+	assert.Equal(t, "mpiexec", cmd)
+	assert.Equal(t, []string{
+		"-f", "/etc/hosts.mpi", "-hosts", "node1,node2", "-n", "72",
+		"apptainer", "exec", "--pwd", "/run/da18_d01", "/images/wrf.sif", "./da_wrfvar.exe",
+	}, args)
+
+	launcher = LauncherConf{Command: "srun --ntasks {{.Tasks}} {{.Exe}}"}
+	assert.Error(t, launcher.init())
+
+	launcher = LauncherConf{Command: "{{if false}}srun{{end}}"}
+	assert.EqualError(t, launcher.init(), "launcher command `{{if false}}srun{{end}}` is empty")
+}
+
+func TestParallelDAWithHosts(t *testing.T) {
+	cfg, err := os.ReadFile(testutil.Fixture("testrun/wrfda-runner.cfg"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	cfgFile := path.Join(t.TempDir(), "wrfda-runner.cfg")
+	err = os.WriteFile(cfgFile, append(cfg, []byte(`
+[Procs]
+    ParallelDA = true
+[Launcher]
+    Command = "mpirun -hosts {{.Hosts}} -n {{.Procs}} {{.Exe}}"
+    Hosts = ["node1", "node2"]
+`)...), 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	err = Init(vpath.Local(cfgFile))
+	assert.EqualError(t, err, "invalid Launcher in `localhost:"+cfgFile+"`: Hosts and HostFile cannot be used with Procs.ParallelDA, hosts are not split among domains")
+}
+
+func TestRetriesPolicy(t *testing.T) {
+	retries := RetriesConf{
+		Backoff: "30s",
+		Steps: map[string]RetryPolicy{
+			"RunDAStep": {MaxAttempts: 3},
+			"RunWPS":    {MaxAttempts: 2, Backoff: "1m", On: []ErrorClass{RetryAny}},
+		},
+	}
+	if !assert.NoError(t, retries.init()) {
+		return
+	}
+
+	policy := retries.Policy("RunReal")
+	assert.Equal(t, 1, policy.MaxAttempts)
+
+	policy = retries.Policy("RunDAStep")
+	assert.Equal(t, 3, policy.MaxAttempts)
+	assert.Equal(t, 30*time.Second, policy.BackoffBefore(2))
+	assert.Equal(t, 60*time.Second, policy.BackoffBefore(3))
+	assert.True(t, policy.Retries(RetryExit))
+	assert.False(t, policy.Retries(RetryAny))
+
+	policy = retries.Policy("RunWPS")
+	assert.Equal(t, time.Duration(0), policy.BackoffBefore(1))
+	assert.Equal(t, time.Minute, policy.BackoffBefore(2))
+	assert.True(t, policy.Retries(RetryIO))
+
+	retries = RetriesConf{Steps: map[string]RetryPolicy{"RunReal": {On: []ErrorClass{"mpi"}}}}
+	assert.EqualError(t, retries.init(), "invalid policy of step RunReal: unknown error class `mpi`, must be one of exit, io, any")
+
+	retries = RetriesConf{Steps: map[string]RetryPolicy{"RunDaStep": {MaxAttempts: 2}}}
+	assert.EqualError(t, retries.init(), "unknown step `RunDaStep`, must be one of "+strings.Join(StepNames, ", "))
+}
+
+func TestTimeoutsSteps(t *testing.T) {
+	timeouts := TimeoutsConf{Date: "6h", Steps: map[string]string{"RunDAStep": "90m"}}
+	if !assert.NoError(t, timeouts.init()) {
+		return
+	}
+	assert.Equal(t, 6*time.Hour, timeouts.DateLimit())
+	assert.Equal(t, 90*time.Minute, timeouts.StepLimit("RunDAStep"))
+	assert.Equal(t, time.Duration(0), timeouts.StepLimit("RunReal"))
+
+	timeouts = TimeoutsConf{Steps: map[string]string{"RunDaStep": "90m"}}
+	assert.EqualError(t, timeouts.init(), "unknown step `RunDaStep`, must be one of "+strings.Join(StepNames, ", "))
+}
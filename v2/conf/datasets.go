@@ -0,0 +1,297 @@
+package conf
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/meteocima/virtual-server/vpath"
+)
+
+// UngribSource describes a set of files of a
+// dataset that are ungribbed together, using the
+// same Vtable, to intermediate files named `Prefix`.
+type UngribSource struct {
+	// Prefix is the prefix of intermediate files
+	// written by ungrib, and listed in metgrid fg_name.
+	Prefix string
+
+	// Vtable is the path of the Vtable used
+	// to ungrib the files. Relative paths
+	// are resolved from the WPSPrg directory.
+	Vtable string
+
+	// Archive is the path of the directory containing
+	// the files. It's formatted as a go time layout
+	// using the date of the first assimilation cycle.
+	// Defaults to Folders.GFSArchive.
+	Archive vpath.VirtualPath
+
+	// Glob, if set, is the pattern of the files
+	// in Archive directory. When empty, the
+	// directory itself is passed to link_grib.csh.
+	Glob string
+
+	// StepHours is the number of hours between two
+	// consecutive fields in the files. For sources of
+	// a dataset, it defaults to the one of the dataset.
+	StepHours int
+
+	// Fallback is the number of previous guiding
+	// runs tried, using longer lead times, when
+	// the latest one is missing or incomplete. For
+	// sources of a dataset, it defaults to the one
+	// of the dataset, and -1 disables it.
+	Fallback int
+
+	// RunInterval is the number of hours between
+	// two consecutive guiding runs (default 6).
+	RunInterval int
+
+	// baseDir is the directory relative
+	// Archive paths are resolved from.
+	baseDir vpath.VirtualPath
+}
+
+// DatasetConf describes a dataset of guiding
+// forecasts used as initial and boundary conditions.
+//
+// The embedded UngribSource describes the files of
+// the dataset, unless Sources is set: in that case,
+// ungrib runs once for each of them, in order.
+type DatasetConf struct {
+	UngribSource
+
+	// Name is the name used to select the
+	// dataset with the `-i` command line flag
+	Name string
+
+	// Sources, if set, are the ordered sets of
+	// files ungribbed separately, e.g. atmospheric
+	// fields and SST from different datasets.
+	Sources []*UngribSource
+
+	// AvgTsfc is true if avg_tsfc.exe should
+	// run on the ungribbed files of the dataset.
+	AvgTsfc bool
+}
+
+// NoFallback is the Fallback of sources of a dataset
+// that don't use the Fallback of the dataset, and
+// don't try previous guiding runs.
+const NoFallback = -1
+
+// DefaultPrefix is the ungrib prefix of
+// datasets with a single source.
+const DefaultPrefix = "FILE"
+
+// BuiltinDatasets are the datasets available without
+// any configuration. They can be overridden by entries
+// with the same name in the [Datasets] section.
+var BuiltinDatasets = map[InputDataset]DatasetConf{
+	GFS: {
+		UngribSource: UngribSource{
+			Vtable:    "ungrib/Variable_Tables/Vtable.GFS",
+			StepHours: 3,
+		},
+		AvgTsfc: true,
+	},
+	IFS: {
+		UngribSource: UngribSource{
+			Vtable:    "ungrib/Variable_Tables/Vtable.ECMWF",
+			StepHours: 3,
+		},
+		AvgTsfc: true,
+	},
+}
+
+// DatasetsConf contains the datasets defined
+// in configuration, indexed by name.
+type DatasetsConf map[string]*DatasetConf
+
+// initDatasets adds built-in datasets to the ones
+// read from configuration, and fill defaults values.
+// `gfsArchive` is the GFSArchive folder as configured,
+// used as default archive of all datasets.
+func initDatasets(confDir, gfsArchive vpath.VirtualPath) error {
+	configured := Config.Datasets
+	Config.Datasets = DatasetsConf{}
+
+	for name, ds := range BuiltinDatasets {
+		ds := ds
+		Config.Datasets[string(name)] = &ds
+	}
+
+	for name, ds := range configured {
+		if ds.Vtable == "" && len(ds.Sources) == 0 {
+			return fmt.Errorf("missing Vtable for dataset `%s`", name)
+		}
+		prefixes := map[string]bool{}
+		for idx, src := range ds.Sources {
+			if src.Vtable == "" {
+				return fmt.Errorf("missing Vtable for source %d of dataset `%s`", idx+1, name)
+			}
+			if src.Prefix == "" {
+				return fmt.Errorf("missing Prefix for source %d of dataset `%s`", idx+1, name)
+			}
+			if prefixes[src.Prefix] {
+				return fmt.Errorf("duplicated Prefix `%s` in sources of dataset `%s`", src.Prefix, name)
+			}
+			prefixes[src.Prefix] = true
+			if err := src.validate(); err != nil {
+				return fmt.Errorf("source %d of dataset `%s`: %w", idx+1, name, err)
+			}
+		}
+		if err := ds.validate(); err != nil {
+			return fmt.Errorf("dataset `%s`: %w", name, err)
+		}
+		Config.Datasets[strings.ToUpper(name)] = ds
+	}
+
+	for name, ds := range Config.Datasets {
+		ds.Name = name
+		if ds.StepHours == 0 {
+			ds.StepHours = 3
+		}
+		if ds.RunInterval == 0 {
+			ds.RunInterval = 6
+		}
+		if ds.Fallback == NoFallback {
+			ds.Fallback = 0
+		}
+		if ds.Prefix == "" {
+			ds.Prefix = DefaultPrefix
+		}
+		ds.initArchive(confDir, gfsArchive)
+		for _, src := range ds.Sources {
+			if src.StepHours == 0 {
+				src.StepHours = ds.StepHours
+			}
+			switch src.Fallback {
+			case 0:
+				src.Fallback = ds.Fallback
+			case NoFallback:
+				src.Fallback = 0
+			}
+			if src.RunInterval == 0 {
+				src.RunInterval = ds.RunInterval
+			}
+			src.initArchive(confDir, gfsArchive)
+		}
+	}
+	return nil
+}
+
+// Dataset returns the configuration of dataset
+// `ds`. Dataset names are case insensitive.
+func Dataset(ds InputDataset) (*DatasetConf, error) {
+	res, ok := Config.Datasets[strings.ToUpper(string(ds))]
+	if !ok {
+		return nil, fmt.Errorf("unknown input dataset `%s`, available datasets are: %s", ds, strings.Join(DatasetNames(), ", "))
+	}
+	return res, nil
+}
+
+// DatasetNames returns the sorted
+// names of all available datasets.
+func DatasetNames() []string {
+	names := make([]string, 0, len(Config.Datasets))
+	for name := range Config.Datasets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// UngribSources returns the ordered list of
+// sources to ungrib for the dataset.
+func (ds *DatasetConf) UngribSources() []*UngribSource {
+	if len(ds.Sources) == 0 {
+		return []*UngribSource{&ds.UngribSource}
+	}
+	return ds.Sources
+}
+
+// Prefixes returns the prefixes of all
+// sources, to use as metgrid fg_name.
+func (ds *DatasetConf) Prefixes() []string {
+	res := []string{}
+	for _, src := range ds.UngribSources() {
+		res = append(res, src.Prefix)
+	}
+	return res
+}
+
+func (src *UngribSource) validate() error {
+	if src.StepHours < 0 {
+		return fmt.Errorf("invalid StepHours %d: must be greater than 0", src.StepHours)
+	}
+	if src.Fallback < NoFallback {
+		return fmt.Errorf("invalid Fallback %d: must be greater than or equal to %d", src.Fallback, NoFallback)
+	}
+	if src.RunInterval < 0 {
+		return fmt.Errorf("invalid RunInterval %d: must be greater than 0", src.RunInterval)
+	}
+	return nil
+}
+
+func (src *UngribSource) initArchive(confDir, gfsArchive vpath.VirtualPath) {
+	if src.Archive.Path == "" {
+		src.Archive = gfsArchive
+	}
+	if !path.IsAbs(src.Archive.Path) {
+		// the pattern is joined after formatting, so
+		// that confDir is not formatted as a time layout
+		src.baseDir = confDir
+	}
+}
+
+// VtableFile returns the path of the Vtable of the source.
+func (src *UngribSource) VtableFile() vpath.VirtualPath {
+	if !path.IsAbs(src.Vtable) {
+		return Config.Folders.WPSPrg.Join(src.Vtable)
+	}
+	res := Config.Folders.WPSPrg
+	res.Path = src.Vtable
+	return res
+}
+
+// ArchiveDir returns the directory containing the source
+// files for a run whose first assimilation cycle is at `dt`.
+func (src *UngribSource) ArchiveDir(dt time.Time) vpath.VirtualPath {
+	res := src.Archive
+	res.Path = dt.Format(src.Archive.Path)
+	return src.resolve(res)
+}
+
+// ArchiveRoot returns the leading directories of
+// the source archive that don't depend on dates.
+func (src *UngribSource) ArchiveRoot() vpath.VirtualPath {
+	res := src.Archive
+	res.Path = staticPrefix(src.Archive.Path)
+	return src.resolve(res)
+}
+
+func (src *UngribSource) resolve(archive vpath.VirtualPath) vpath.VirtualPath {
+	if src.baseDir.Path == "" {
+		return archive
+	}
+	return src.baseDir.JoinP(archive)
+}
+
+// staticPrefix returns the leading directories of a
+// path `pattern` that don't contain date format placeholders.
+func staticPrefix(pattern string) string {
+	d1 := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	d2 := time.Date(2012, 11, 22, 13, 15, 16, 0, time.UTC)
+
+	parts := strings.Split(pattern, "/")
+	for idx, part := range parts {
+		if d1.Format(part) != part || d2.Format(part) != part {
+			return strings.Join(parts[:idx], "/")
+		}
+	}
+	return pattern
+}
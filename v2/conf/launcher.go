@@ -0,0 +1,85 @@
+package conf
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// DefaultLauncher is the template of the MPI launcher
+// command used when Launcher.Command is not configured.
+const DefaultLauncher = "mpirun -n {{.Procs}} {{.Exe}}"
+
+// LaunchArgs are the variables available
+// in launcher command templates.
+type LaunchArgs struct {
+	// Procs is the number of processes to run
+	Procs string
+	// Hosts is the comma separated list of Launcher.Hosts
+	Hosts string
+	// HostFile is Launcher.HostFile
+	HostFile string
+	// CoresPerNode is Procs.CoresPerNode
+	CoresPerNode string
+	// Exe is the program to run, relative to Cwd, e.g. ./wrf.exe
+	Exe string
+	// Cwd is the directory where the program runs
+	Cwd string
+}
+
+// LauncherConf configures the command used to run MPI
+// programs. Command is a go template executed with a
+// LaunchArgs, that can also read environment variables
+// of the runner with the `env` function. The result is
+// split in words on spaces, without any shell processing.
+type LauncherConf struct {
+	// Command is the template of the launcher
+	// command (default DefaultLauncher).
+	Command string
+
+	// Hosts is the list of hosts where
+	// processes can run.
+	Hosts []string
+
+	// HostFile is the path of a file listing
+	// the hosts where processes can run.
+	HostFile string
+
+	tmpl *template.Template
+}
+
+func (launcher *LauncherConf) init() error {
+	if launcher.Command == "" {
+		launcher.Command = DefaultLauncher
+	}
+
+	tmpl, err := template.New("launcher").Funcs(template.FuncMap{"env": os.Getenv}).Parse(launcher.Command)
+	if err != nil {
+		return err
+	}
+	launcher.tmpl = tmpl
+
+	_, _, err = launcher.Args(LaunchArgs{Procs: "1", Exe: "./wrf.exe", Cwd: "/"})
+	return err
+}
+
+// Args returns the launcher command that runs `args.Exe`,
+// and its arguments. Hosts, HostFile and CoresPerNode
+// of `args` are filled from the configuration.
+func (launcher LauncherConf) Args(args LaunchArgs) (string, []string, error) {
+	args.Hosts = strings.Join(launcher.Hosts, ",")
+	args.HostFile = launcher.HostFile
+	args.CoresPerNode = strconv.Itoa(Config.Procs.CoresPerNode)
+
+	var buf strings.Builder
+	if err := launcher.tmpl.Execute(&buf, args); err != nil {
+		return "", nil, err
+	}
+	words := strings.Fields(buf.String())
+	if len(words) == 0 {
+		return "", nil, fmt.Errorf("launcher command `%s` is empty", launcher.Command)
+	}
+	return words[0], words[1:], nil
+}
@@ -0,0 +1,74 @@
+package conf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ObsType is a type of observations assimilated.
+type ObsType string
+
+const (
+	// Radar - radar reflectivity and radial winds (ob.radar)
+	Radar ObsType = "radar"
+	// Stations - weather stations in little_r format (ob.ascii)
+	Stations ObsType = "stations"
+)
+
+// ObsTypes are all the types of observations
+// assimilated, in the order they are copied.
+var ObsTypes = []ObsType{Radar, Stations}
+
+// MissingObsPolicy is the action taken when the
+// observations of a type are missing for a cycle.
+type MissingObsPolicy string
+
+const (
+	// Required - the run for the date fails
+	Required MissingObsPolicy = "required"
+	// Optional - the other observations are assimilated
+	Optional MissingObsPolicy = "optional"
+	// SkipDA - the cycle doesn't assimilate anything, and
+	// the first guess is passed through unchanged.
+	SkipDA MissingObsPolicy = "skip-da"
+)
+
+// ObservationsConf contains the policy applied
+// when each type of observations is missing.
+type ObservationsConf struct {
+	// Radar is the policy for radar
+	// observations (default required)
+	Radar MissingObsPolicy
+
+	// Stations is the policy for weather
+	// stations observations (default optional)
+	Stations MissingObsPolicy
+}
+
+// Policy returns the policy applied
+// when observations of `obs` type are missing.
+func (observations ObservationsConf) Policy(obs ObsType) MissingObsPolicy {
+	if obs == Radar {
+		return observations.Radar
+	}
+	return observations.Stations
+}
+
+func (observations *ObservationsConf) init() error {
+	if observations.Radar == "" {
+		observations.Radar = Required
+	}
+	if observations.Stations == "" {
+		observations.Stations = Optional
+	}
+
+	for _, policy := range []*MissingObsPolicy{&observations.Radar, &observations.Stations} {
+		*policy = MissingObsPolicy(strings.ToLower(string(*policy)))
+		switch *policy {
+		case Required, Optional, SkipDA:
+		default:
+			return fmt.Errorf("unknown missing observations policy `%s`, must be one of %s, %s, %s", *policy, Required, Optional, SkipDA)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package conf
+
+import (
+	"fmt"
+	"time"
+)
+
+// ErrorClass is a class of failures
+// that a retry policy can retry.
+type ErrorClass string
+
+const (
+	// RetryExit - a process executed by the step
+	// exited with a non-zero code
+	RetryExit ErrorClass = "exit"
+	// RetryIO - an operation on files failed
+	RetryIO ErrorClass = "io"
+	// RetryAny - any failure
+	RetryAny ErrorClass = "any"
+)
+
+// DefaultRetryOn are the error classes
+// retried when a policy doesn't set On.
+var DefaultRetryOn = []ErrorClass{RetryExit, RetryIO}
+
+// RetryPolicy configures how the
+// failures of a step are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of
+	// executions of the step (default 1, no retries).
+	MaxAttempts int
+
+	// Backoff is the wait before the second attempt,
+	// doubled before each following one, in the format
+	// accepted by time.ParseDuration (default no wait).
+	Backoff string
+
+	// On are the classes of failures retried
+	// (default DefaultRetryOn).
+	On []ErrorClass
+
+	backoff time.Duration
+}
+
+func (policy *RetryPolicy) init() error {
+	if policy.MaxAttempts < 0 {
+		return fmt.Errorf("MaxAttempts must not be negative")
+	}
+	if policy.Backoff != "" {
+		d, err := time.ParseDuration(policy.Backoff)
+		if err != nil {
+			return fmt.Errorf("invalid Backoff `%s`: %w", policy.Backoff, err)
+		}
+		if d < 0 {
+			return fmt.Errorf("invalid Backoff `%s`: must not be negative", policy.Backoff)
+		}
+		policy.backoff = d
+	}
+	for _, class := range policy.On {
+		switch class {
+		case RetryExit, RetryIO, RetryAny:
+		default:
+			return fmt.Errorf("unknown error class `%s`, must be one of %s, %s, %s", class, RetryExit, RetryIO, RetryAny)
+		}
+	}
+	return nil
+}
+
+// BackoffBefore returns the wait before `attempt`.
+func (policy RetryPolicy) BackoffBefore(attempt int) time.Duration {
+	if attempt < 2 {
+		return 0
+	}
+	return policy.backoff << (attempt - 2)
+}
+
+// Retries returns whether failures
+// of `class` are retried.
+func (policy RetryPolicy) Retries(class ErrorClass) bool {
+	for _, retried := range policy.On {
+		if retried == class || retried == RetryAny {
+			return true
+		}
+	}
+	return false
+}
+
+// RetriesConf configures the retry policy of steps.
+// MaxAttempts, Backoff and On are the policy of every
+// step, and Steps contains the policy of some type of
+// steps, keyed by step name without the cycle, e.g.
+// RunDAStep. Variables not set in the policy of a step
+// are taken from the default one.
+type RetriesConf struct {
+	MaxAttempts int
+	Backoff     string
+	On          []ErrorClass
+
+	Steps map[string]RetryPolicy
+
+	policies map[string]RetryPolicy
+	defaults RetryPolicy
+}
+
+func (retries *RetriesConf) init() error {
+	retries.defaults = RetryPolicy{
+		MaxAttempts: retries.MaxAttempts,
+		Backoff:     retries.Backoff,
+		On:          retries.On,
+	}
+	if retries.defaults.MaxAttempts == 0 {
+		retries.defaults.MaxAttempts = 1
+	}
+	if retries.defaults.On == nil {
+		retries.defaults.On = DefaultRetryOn
+	}
+	if err := retries.defaults.init(); err != nil {
+		return err
+	}
+
+	retries.policies = map[string]RetryPolicy{}
+	for name, policy := range retries.Steps {
+		if err := checkStepName(name); err != nil {
+			return err
+		}
+		if policy.MaxAttempts == 0 {
+			policy.MaxAttempts = retries.defaults.MaxAttempts
+		}
+		if policy.Backoff == "" {
+			policy.Backoff = retries.defaults.Backoff
+		}
+		if policy.On == nil {
+			policy.On = retries.defaults.On
+		}
+		if err := policy.init(); err != nil {
+			return fmt.Errorf("invalid policy of step %s: %w", name, err)
+		}
+		retries.policies[name] = policy
+	}
+	return nil
+}
+
+// Policy returns the retry policy
+// of steps named `name`.
+func (retries RetriesConf) Policy(name string) RetryPolicy {
+	if policy, ok := retries.policies[name]; ok {
+		return policy
+	}
+	if retries.defaults.MaxAttempts == 0 {
+		return RetryPolicy{MaxAttempts: 1}
+	}
+	return retries.defaults
+}
@@ -0,0 +1,93 @@
+package conf
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// StepNames are the names of the steps of a run,
+// used as keys in the configuration of steps.
+var StepNames = []string{
+	"BuildWorkdir",
+	"BuildWPSDir",
+	"RunWPS",
+	"RunReal",
+	"BuildDAStepDir",
+	"RunDAStep",
+	"BuildWRFDir",
+	"RunWRFStep",
+}
+
+// checkStepName returns an error if
+// `name` is not one of StepNames.
+func checkStepName(name string) error {
+	for _, known := range StepNames {
+		if name == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown step `%s`, must be one of %s", name, strings.Join(StepNames, ", "))
+}
+
+// TimeoutsConf configures the wall-clock time limits of
+// runs. Limits are durations in the format accepted by
+// time.ParseDuration, e.g. "90m" or "2h". Runs without
+// a limit never time out.
+type TimeoutsConf struct {
+	// Date is the limit of the whole run for a date.
+	Date string
+
+	// Steps contains the limit of each type of step.
+	// Keys are step names without the cycle, e.g. RunDAStep.
+	Steps map[string]string
+
+	date  time.Duration
+	steps map[string]time.Duration
+}
+
+func parseLimit(limit string) (time.Duration, error) {
+	d, err := time.ParseDuration(limit)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("must be greater than 0")
+	}
+	return d, nil
+}
+
+func (timeouts *TimeoutsConf) init() error {
+	if timeouts.Date != "" {
+		d, err := parseLimit(timeouts.Date)
+		if err != nil {
+			return fmt.Errorf("invalid Date limit `%s`: %w", timeouts.Date, err)
+		}
+		timeouts.date = d
+	}
+
+	timeouts.steps = map[string]time.Duration{}
+	for name, limit := range timeouts.Steps {
+		if err := checkStepName(name); err != nil {
+			return err
+		}
+		d, err := parseLimit(limit)
+		if err != nil {
+			return fmt.Errorf("invalid limit `%s` of step %s: %w", limit, name, err)
+		}
+		timeouts.steps[name] = d
+	}
+	return nil
+}
+
+// DateLimit returns the limit of the run
+// for a date, or 0 if it has none.
+func (timeouts TimeoutsConf) DateLimit() time.Duration {
+	return timeouts.date
+}
+
+// StepLimit returns the limit of steps
+// named `name`, or 0 if they have none.
+func (timeouts TimeoutsConf) StepLimit(name string) time.Duration {
+	return timeouts.steps[name]
+}
@@ -12,12 +12,26 @@ const (
 	WPSThenDAPhase
 )
 
-// InputDataset ...
-type InputDataset int
+// InputDataset is the name of a
+// dataset of guiding forecasts.
+type InputDataset string
 
 const (
 	// GFS ...
-	GFS InputDataset = iota
+	GFS InputDataset = "GFS"
 	// IFS ...
-	IFS
+	IFS InputDataset = "IFS"
 )
+
+// String returns the name of the phase
+// used in the -p command line option.
+func (phase RunPhase) String() string {
+	switch phase {
+	case WPSPhase:
+		return "WPS"
+	case DAPhase:
+		return "DA"
+	default:
+		return "WPSDA"
+	}
+}
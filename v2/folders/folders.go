@@ -9,6 +9,7 @@ import (
 
 var Root vpath.VirtualPath
 var Cfg conf.FoldersConf
+var Cycles = conf.DefaultCycles
 
 func InputsDir(startDate time.Time) vpath.VirtualPath {
 	return Root.Join("inputs/%s", startDate.Format("20060102"))
@@ -19,17 +20,26 @@ func WPSWorkDir(startDate time.Time) vpath.VirtualPath {
 	return vpath.New("simulation", localPath.Path)
 }
 
+// cycleDirName returns the part of DA and WRF directory
+// names that identify a cycle. It is the hour of the
+// assimilation date, prefixed with the day when cycles span
+// a whole day or more, so that names remain unique.
+func cycleDirName(start time.Time, cycle int) string {
+	assimDate := Cycles.AssimDate(start, cycle)
+	if Cycles.Span() >= 24*time.Hour {
+		return assimDate.Format("0215")
+	}
+	return assimDate.Format("15")
+}
+
 func WRFWorkDir(start time.Time, cycle int) vpath.VirtualPath {
-	dtStart := start.Add(3 * time.Duration(cycle-3) * time.Hour)
-	pt := WorkdirForDate(start).Join("wrf%02d", dtStart.Hour())
+	pt := WorkdirForDate(start).Join("wrf%s", cycleDirName(start, cycle))
 	pt.Host = "simulation"
 	return pt
 }
 
 func DAWorkDir(startDate time.Time, domain, cycle int) vpath.VirtualPath {
-	assimDate := startDate.Add(3 * time.Duration(cycle-3) * time.Hour)
-
-	pt := WorkdirForDate(startDate).Join("da%02d_d%02d", assimDate.Hour(), domain)
+	pt := WorkdirForDate(startDate).Join("da%s_d%02d", cycleDirName(startDate, cycle), domain)
 	pt.Host = "simulation"
 	return pt
 }
@@ -42,9 +52,21 @@ func WorkdirForDate(startDate time.Time) vpath.VirtualPath {
 	return Root.Join(startDate.Format("20060102"))
 }
 
+// StateFile returns the path of the file
+// containing the persistent state of the run for `startDate`
+func StateFile(startDate time.Time) vpath.VirtualPath {
+	return WorkdirForDate(startDate).Join("state.json")
+}
+
+// JobsDir returns the path of the directory containing
+// the batch job scripts of the run for `startDate`
+func JobsDir(startDate time.Time) vpath.VirtualPath {
+	return WorkdirForDate(startDate).Join("jobs")
+}
+
 func GFSSources(startDate time.Time) vpath.VirtualPath {
 	// assimStartDate is the date of the first cycle assimilation
-	assimStartDate := startDate.Add(-6 * time.Hour)
+	assimStartDate := Cycles.FirstAssimDate(startDate)
 	gfsSources := Cfg.GFSArchive.Join(
 		assimStartDate.Format("2006/01/02/1504"),
 	).Join("daita")
@@ -56,8 +78,8 @@ func RadarObsForDate(startDate time.Time, cycle int, host string) vpath.VirtualP
 	workdir := vpath.New(host, localPath.Path)
 	observationDir := workdir.Join("observations")
 
-	// dt is the date of the first cycle assimilation
-	dt := startDate.Add(time.Duration(-6+3*(cycle-1)) * time.Hour)
+	// dt is the date of the cycle assimilation
+	dt := Cycles.AssimDate(startDate, cycle)
 	return observationDir.Join("ob.radar.%s", dt.Format("2006010215"))
 }
 
@@ -66,25 +88,25 @@ func StationsObsForDate(startDate time.Time, cycle int, host string) vpath.Virtu
 	workdir := vpath.New(host, localPath.Path)
 	observationDir := workdir.Join("observations")
 
-	// dt is the date of the first cycle assimilation
-	dt := startDate.Add(time.Duration(-6+3*(cycle-1)) * time.Hour)
+	// dt is the date of the cycle assimilation
+	dt := Cycles.AssimDate(startDate, cycle)
 	return observationDir.Join("ob.ascii.%s", dt.Format("2006010215"))
 }
 
 func RadarObsArchive(startDate time.Time, cycle int) vpath.VirtualPath {
-	// dt is the date of the first cycle assimilation
-	dt := startDate.Add(time.Duration(-6+3*(cycle-1)) * time.Hour)
+	// dt is the date of the cycle assimilation
+	dt := Cycles.AssimDate(startDate, cycle)
 	return Cfg.ObservationsArchive.Join("ob.radar_%s00", dt.Format("2006010215"))
 }
 
 func AlternativeRadarObsArchive(startDate time.Time, cycle int) vpath.VirtualPath {
-	// dt is the date of the first cycle assimilation
-	dt := startDate.Add(time.Duration(-6+3*(cycle-1)) * time.Hour)
+	// dt is the date of the cycle assimilation
+	dt := Cycles.AssimDate(startDate, cycle)
 	return Cfg.ObservationsArchive.Join("ob.radar.%s", dt.Format("2006010215"))
 }
 
 func StationsObsArchive(startDate time.Time, cycle int) vpath.VirtualPath {
-	// dt is the date of the first cycle assimilation
-	dt := startDate.Add(time.Duration(-6+3*(cycle-1)) * time.Hour)
+	// dt is the date of the cycle assimilation
+	dt := Cycles.AssimDate(startDate, cycle)
 	return Cfg.ObservationsArchive.Join("ob.ascii_%s00", dt.Format("2006010215"))
 }
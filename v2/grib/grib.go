@@ -0,0 +1,385 @@
+// Package grib scans GRIB edition 1 and 2 files, reading
+// from the header of each message its reference time and
+// forecast step, without decoding data.
+package grib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Message contains the header
+// informations of a GRIB message.
+type Message struct {
+	// Edition is the GRIB edition, 1 or 2
+	Edition int
+
+	// Reference is the reference time
+	// of the message, usually the start
+	// of the forecast or the analysis time.
+	Reference time.Time
+
+	// Valid is the time the data in the
+	// message refers to. For accumulated or
+	// averaged fields, it's the end of the interval.
+	Valid time.Time
+}
+
+// Step returns the forecast step of the message.
+func (msg Message) Step() time.Duration {
+	return msg.Valid.Sub(msg.Reference)
+}
+
+var magic = []byte("GRIB")
+
+// ErrNoMessages is returned by Scan
+// when the file doesn't contain any
+// GRIB message.
+var ErrNoMessages = errors.New("no GRIB messages found")
+
+type scanner struct {
+	r   *bufio.Reader
+	pos int64
+
+	// seeker is set when the source reader can seek,
+	// to skip data sections without reading them.
+	seeker io.ReadSeeker
+	size   int64
+}
+
+func (s *scanner) read(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	read, err := io.ReadFull(s.r, buf)
+	s.pos += int64(read)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf, err
+}
+
+func (s *scanner) skip(n int64) error {
+	if n < 0 {
+		return fmt.Errorf("invalid message length at offset %d", s.pos)
+	}
+
+	if buffered := int64(s.r.Buffered()); s.seeker != nil && n > buffered {
+		if s.pos+n > s.size {
+			return io.ErrUnexpectedEOF
+		}
+		if _, err := s.r.Discard(int(buffered)); err != nil {
+			return err
+		}
+		if _, err := s.seeker.Seek(n-buffered, io.SeekCurrent); err != nil {
+			return err
+		}
+		s.r.Reset(s.seeker)
+		s.pos += n
+		return nil
+	}
+
+	skipped, err := s.r.Discard(int(n))
+	s.pos += int64(skipped)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// next moves to the start of next message,
+// skipping any padding or garbage. It returns
+// io.EOF when there are no more messages.
+func (s *scanner) next() error {
+	matched := 0
+	for {
+		b, err := s.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		s.pos++
+		if b == magic[matched] {
+			matched++
+			if matched == len(magic) {
+				return nil
+			}
+			continue
+		}
+		matched = 0
+		if b == magic[0] {
+			matched = 1
+		}
+	}
+}
+
+// Scan reads all GRIB messages in `r`, and returns
+// their header informations. If `r` is an io.ReadSeeker,
+// data sections are skipped without reading them.
+func Scan(r io.Reader) ([]Message, error) {
+	s := scanner{r: bufio.NewReaderSize(r, 64*1024)}
+	if seeker, ok := r.(io.ReadSeeker); ok {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		end, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return nil, err
+		}
+		s.seeker = seeker
+		s.size = end - start
+	}
+	msgs := []Message{}
+	for {
+		err := s.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		start := s.pos - int64(len(magic))
+		indicator, err := s.read(4)
+		if err != nil {
+			return nil, fmt.Errorf("message at offset %d: %w", start, err)
+		}
+
+		var msg Message
+		switch edition := indicator[3]; edition {
+		case 1:
+			msg, err = s.scanGrib1(indicator)
+		case 2:
+			msg, err = s.scanGrib2()
+		default:
+			err = fmt.Errorf("unsupported GRIB edition %d", edition)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("message at offset %d: %w", start, err)
+		}
+		msgs = append(msgs, msg)
+	}
+
+	if len(msgs) == 0 {
+		return nil, ErrNoMessages
+	}
+	return msgs, nil
+}
+
+func uint3(b []byte) int {
+	return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+}
+
+// timeUnit returns the duration of the time unit with
+// given code, for both GRIB1 (table 4) and GRIB2 (table 4.4).
+func timeUnit(code byte, edition int) (time.Duration, error) {
+	switch code {
+	case 0:
+		return time.Minute, nil
+	case 1:
+		return time.Hour, nil
+	case 2:
+		return 24 * time.Hour, nil
+	case 10:
+		return 3 * time.Hour, nil
+	case 11:
+		return 6 * time.Hour, nil
+	case 12:
+		return 12 * time.Hour, nil
+	case 13:
+		if edition == 2 {
+			return time.Second, nil
+		}
+	case 254:
+		if edition == 1 {
+			return time.Second, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported time unit %d", code)
+}
+
+// scanGrib1 reads a GRIB1 message, whose indicator
+// section has already been read.
+func (s *scanner) scanGrib1(indicator []byte) (Message, error) {
+	msg := Message{Edition: 1}
+	length := uint3(indicator)
+	read := 8
+
+	// messages larger than 8MB (see below) have their
+	// length known only after the data section is read:
+	// sections are bounded by the largest one possible.
+	limit := length
+	if length&0x800000 != 0 {
+		limit = (length & 0x7fffff) * 120
+	}
+	checkSection := func(name string, secLen, minLen int) error {
+		if secLen < minLen || secLen > limit-read {
+			return fmt.Errorf("invalid %s length %d", name, secLen)
+		}
+		return nil
+	}
+
+	pdsLen, err := s.read(3)
+	if err != nil {
+		return msg, err
+	}
+	if err := checkSection("product definition section", uint3(pdsLen), 28); err != nil {
+		return msg, err
+	}
+	pdsRest, err := s.read(uint3(pdsLen) - 3)
+	if err != nil {
+		return msg, err
+	}
+	read += uint3(pdsLen)
+	pds := append(pdsLen, pdsRest...)
+
+	// octets are numbered from 1
+	octet := func(n int) byte { return pds[n-1] }
+
+	year := (int(octet(25))-1)*100 + int(octet(13))
+	msg.Reference = time.Date(year, time.Month(octet(14)), int(octet(15)), int(octet(16)), int(octet(17)), 0, 0, time.UTC)
+
+	unit, err := timeUnit(octet(18), 1)
+	if err != nil {
+		return msg, err
+	}
+	p1, p2 := int(octet(19)), int(octet(20))
+	var step int
+	switch octet(21) {
+	case 1:
+		step = 0
+	case 2, 3, 4, 5:
+		step = p2
+	case 10:
+		step = p1<<8 | p2
+	default:
+		step = p1
+	}
+	msg.Valid = msg.Reference.Add(time.Duration(step) * unit)
+
+	flags := octet(8)
+	optional := []bool{flags&0x80 != 0, flags&0x40 != 0}
+	for _, present := range optional {
+		if !present {
+			continue
+		}
+		secLen, err := s.read(3)
+		if err != nil {
+			return msg, err
+		}
+		if err := checkSection("section", uint3(secLen), 3); err != nil {
+			return msg, err
+		}
+		if err := s.skip(int64(uint3(secLen) - 3)); err != nil {
+			return msg, err
+		}
+		read += uint3(secLen)
+	}
+
+	bdsLen, err := s.read(3)
+	if err != nil {
+		return msg, err
+	}
+	read += 3
+
+	// ECMWF encodes messages larger than 8MB setting
+	// the highest bit of the length, in units of 120 bytes.
+	if length&0x800000 != 0 && uint3(bdsLen) <= 120 {
+		length = (length&0x7fffff)*120 - uint3(bdsLen) + 4
+	}
+
+	return msg, s.skip(int64(length - read))
+}
+
+// grib2EndOfInterval contains, for product definition templates
+// of statistically processed fields, the octet of section 4
+// where the end of the overall time interval is encoded.
+var grib2EndOfInterval = map[int]int{
+	8:  35,
+	9:  48,
+	10: 36,
+	11: 38,
+	12: 37,
+}
+
+func grib2Time(b []byte) time.Time {
+	year := int(binary.BigEndian.Uint16(b[0:2]))
+	return time.Date(year, time.Month(b[2]), int(b[3]), int(b[4]), int(b[5]), int(b[6]), 0, time.UTC)
+}
+
+// scanGrib2 reads a GRIB2 message, whose first
+// 8 octets of indicator section have already been read.
+func (s *scanner) scanGrib2() (Message, error) {
+	msg := Message{Edition: 2}
+
+	lenBuf, err := s.read(8)
+	if err != nil {
+		return msg, err
+	}
+	length := int64(binary.BigEndian.Uint64(lenBuf))
+	read := int64(16)
+
+	foundIdentification := false
+	for {
+		header, err := s.read(5)
+		if err != nil {
+			return msg, err
+		}
+		if bytes.Equal(header[:4], []byte("7777")) {
+			return msg, fmt.Errorf("product definition section not found")
+		}
+		secLen := int64(binary.BigEndian.Uint32(header))
+		if secLen < 5 || secLen > length-read {
+			return msg, fmt.Errorf("invalid section length %d", secLen)
+		}
+		body, err := s.read(int(secLen) - 5)
+		if err != nil {
+			return msg, err
+		}
+		read += secLen
+		sec := append(header, body...)
+		// octets are numbered from 1
+		octet := func(n int) byte { return sec[n-1] }
+
+		switch header[4] {
+		case 1:
+			if secLen < 19 {
+				return msg, fmt.Errorf("identification section too short")
+			}
+			msg.Reference = grib2Time(sec[12:19])
+			foundIdentification = true
+		case 4:
+			if !foundIdentification {
+				return msg, fmt.Errorf("identification section not found")
+			}
+			if secLen < 22 {
+				return msg, fmt.Errorf("product definition section too short")
+			}
+			template := int(binary.BigEndian.Uint16(sec[7:9]))
+			if template > 15 {
+				return msg, fmt.Errorf("unsupported product definition template 4.%d", template)
+			}
+
+			if end, ok := grib2EndOfInterval[template]; ok {
+				if secLen < int64(end+6) {
+					return msg, fmt.Errorf("product definition section too short")
+				}
+				msg.Valid = grib2Time(sec[end-1 : end+6])
+			} else {
+				unit, err := timeUnit(octet(18), 2)
+				if err != nil {
+					return msg, err
+				}
+				step := int32(binary.BigEndian.Uint32(sec[18:22]))
+				msg.Valid = msg.Reference.Add(time.Duration(step) * unit)
+			}
+			return msg, s.skip(length - read)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package grib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// grib1 returns a minimal GRIB1 message, with
+// a product definition and a binary data section.
+func grib1(ref time.Time, unit, p1, p2, timeRange byte) []byte {
+	pds := make([]byte, 28)
+	pds[2] = 28
+	pds[12] = byte(ref.Year() % 100)
+	pds[13] = byte(ref.Month())
+	pds[14] = byte(ref.Day())
+	pds[15] = byte(ref.Hour())
+	pds[17] = unit
+	pds[18] = p1
+	pds[19] = p2
+	pds[20] = timeRange
+	pds[24] = byte(ref.Year()/100 + 1)
+
+	bds := make([]byte, 20)
+	bds[2] = 20
+
+	length := 8 + len(pds) + len(bds) + 4
+	msg := []byte{'G', 'R', 'I', 'B', byte(length >> 16), byte(length >> 8), byte(length), 1}
+	msg = append(msg, pds...)
+	msg = append(msg, bds...)
+	return append(msg, "7777"...)
+}
+
+func grib2Date(t time.Time) []byte {
+	res := make([]byte, 7)
+	binary.BigEndian.PutUint16(res, uint16(t.Year()))
+	res[2] = byte(t.Month())
+	res[3] = byte(t.Day())
+	res[4] = byte(t.Hour())
+	res[5] = byte(t.Minute())
+	res[6] = byte(t.Second())
+	return res
+}
+
+// grib2 returns a minimal GRIB2 message, with identification,
+// product definition and data sections. If `end` is not zero,
+// product definition template 4.8 is used.
+func grib2(ref time.Time, unit byte, step uint32, end time.Time) []byte {
+	sec1 := make([]byte, 21)
+	binary.BigEndian.PutUint32(sec1, 21)
+	sec1[4] = 1
+	copy(sec1[12:], grib2Date(ref))
+
+	secLen := 34
+	template := uint16(0)
+	if !end.IsZero() {
+		secLen = 58
+		template = 8
+	}
+	sec4 := make([]byte, secLen)
+	binary.BigEndian.PutUint32(sec4, uint32(secLen))
+	sec4[4] = 4
+	binary.BigEndian.PutUint16(sec4[7:], template)
+	sec4[17] = unit
+	binary.BigEndian.PutUint32(sec4[18:], step)
+	if !end.IsZero() {
+		copy(sec4[34:], grib2Date(end))
+	}
+
+	sec7 := make([]byte, 10)
+	binary.BigEndian.PutUint32(sec7, 10)
+	sec7[4] = 7
+
+	length := 16 + len(sec1) + len(sec4) + len(sec7) + 4
+	msg := []byte{'G', 'R', 'I', 'B', 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(msg[8:], uint64(length))
+	msg = append(msg, sec1...)
+	msg = append(msg, sec4...)
+	msg = append(msg, sec7...)
+	return append(msg, "7777"...)
+}
+
+func TestScanGrib1(t *testing.T) {
+	ref := time.Date(2020, 12, 24, 18, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	buf.Write(grib1(ref, 1, 6, 0, 0))
+	// padding between messages is skipped
+	buf.Write([]byte{0, 0, 0, 0})
+	buf.Write(grib1(ref, 1, 0, 0, 1))
+	buf.Write(grib1(ref, 1, 3, 6, 4))
+	buf.Write(grib1(ref, 11, 1, 2, 10))
+	buf.Write(grib1(ref, 254, 0, 0, 1))
+
+	msgs, err := Scan(&buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 5, len(msgs))
+	for _, msg := range msgs {
+		assert.Equal(t, 1, msg.Edition)
+		assert.Equal(t, ref, msg.Reference)
+	}
+	assert.Equal(t, 6*time.Hour, msgs[0].Step())
+	assert.Equal(t, time.Duration(0), msgs[1].Step())
+	assert.Equal(t, 6*time.Hour, msgs[2].Step())
+	assert.Equal(t, 258*6*time.Hour, msgs[3].Step())
+	assert.Equal(t, ref.Add(6*time.Hour), msgs[0].Valid)
+}
+
+func TestScanGrib2(t *testing.T) {
+	ref := time.Date(2020, 12, 24, 18, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	buf.Write(grib2(ref, 1, 3, time.Time{}))
+	buf.Write(grib1(ref, 1, 9, 0, 0))
+	buf.Write(grib2(ref, 0, 90, time.Time{}))
+	buf.Write(grib2(ref, 1, 0, ref.Add(12*time.Hour)))
+
+	msgs, err := Scan(&buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 4, len(msgs))
+	assert.Equal(t, Message{Edition: 2, Reference: ref, Valid: ref.Add(3 * time.Hour)}, msgs[0])
+	assert.Equal(t, Message{Edition: 1, Reference: ref, Valid: ref.Add(9 * time.Hour)}, msgs[1])
+	assert.Equal(t, 90*time.Minute, msgs[2].Step())
+	assert.Equal(t, 12*time.Hour, msgs[3].Step())
+}
+
+func TestScanErrors(t *testing.T) {
+	_, err := Scan(bytes.NewReader([]byte("not a grib file")))
+	assert.Equal(t, ErrNoMessages, err)
+
+	ref := time.Date(2020, 12, 24, 18, 0, 0, 0, time.UTC)
+	msg := grib2(ref, 1, 3, time.Time{})
+	_, err = Scan(bytes.NewReader(msg[:len(msg)-10]))
+	assert.EqualError(t, err, "message at offset 0: unexpected EOF")
+
+	_, err = Scan(bytes.NewReader(grib2(ref, 3, 3, time.Time{})))
+	assert.EqualError(t, err, "message at offset 0: unsupported time unit 3")
+
+	_, err = Scan(bytes.NewReader([]byte("GRIB\x00\x00\x00\x03")))
+	assert.EqualError(t, err, "message at offset 0: unsupported GRIB edition 3")
+}
+
+func TestScanSeeker(t *testing.T) {
+	ref := time.Date(2020, 12, 24, 18, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	for step := uint32(0); step < 2000; step++ {
+		buf.Write(grib2(ref, 1, step, time.Time{}))
+		buf.Write(grib1(ref, 1, 6, 0, 0))
+	}
+
+	msgs, err := Scan(bytes.NewReader(buf.Bytes()))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 4000, len(msgs))
+	assert.Equal(t, 1999*time.Hour, msgs[3998].Step())
+
+	_, err = Scan(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	assert.EqualError(t, err, "message at offset 289940: unexpected EOF")
+}
+
+func TestScanCorrupt(t *testing.T) {
+	ref := time.Date(2020, 12, 24, 18, 0, 0, 0, time.UTC)
+
+	// a truncated GRIB1 file, whose PDS length is zero
+	truncated := append([]byte{}, grib1(ref, 1, 6, 0, 0)[:18]...)
+	truncated[8], truncated[9], truncated[10] = 0, 0, 0
+	_, err := Scan(bytes.NewReader(truncated))
+	assert.EqualError(t, err, "message at offset 0: invalid product definition section length 0")
+
+	msg := grib1(ref, 1, 6, 0, 0)
+	msg[10] = 200
+	_, err = Scan(bytes.NewReader(msg))
+	assert.EqualError(t, err, "message at offset 0: invalid product definition section length 200")
+
+	// a GRIB2 section claiming a length of 4GB
+	msg = grib2(ref, 1, 3, time.Time{})
+	binary.BigEndian.PutUint32(msg[16:], 0xffffffff)
+	_, err = Scan(bytes.NewReader(msg))
+	assert.EqualError(t, err, "message at offset 0: invalid section length 4294967295")
+
+	msg = grib2(ref, 1, 3, time.Time{})
+	binary.BigEndian.PutUint32(msg[37:], 5)
+	_, err = Scan(bytes.NewReader(msg))
+	assert.EqualError(t, err, "message at offset 0: product definition section too short")
+}
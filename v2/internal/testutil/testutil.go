@@ -0,0 +1,77 @@
+// Package testutil contains helpers
+// shared by the tests of all packages.
+package testutil
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Fixture returns the absolute path of
+// `filePath` in the fixtures directory.
+func Fixture(filePath string) string {
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		panic("cannot retrieve the source file path")
+	} else {
+		file = filepath.Dir(filepath.Dir(filepath.Dir(file)))
+	}
+
+	return path.Join(file, "fixtures", filePath)
+}
+
+// CopyTestrun copies configuration and namelist templates of
+// testrun fixture in a temporary directory, applying
+// `replacements` to the template named as the map key,
+// and returns the directory.
+func CopyTestrun(t *testing.T, replacements map[string][]string) string {
+	dir := t.TempDir()
+	nmlDir := path.Join(dir, "NamelistsDir")
+	if !assert.NoError(t, os.Mkdir(nmlDir, 0755)) {
+		t.FailNow()
+	}
+
+	cfg, err := os.ReadFile(Fixture("testrun/wrfda-runner.cfg"))
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path.Join(dir, "wrfda-runner.cfg"), cfg, 0644))
+
+	entries, err := os.ReadDir(Fixture("testrun/NamelistsDir"))
+	assert.NoError(t, err)
+	for _, entry := range entries {
+		content, err := os.ReadFile(Fixture("testrun/NamelistsDir/" + entry.Name()))
+		assert.NoError(t, err)
+		text := string(content)
+		if repl, ok := replacements[entry.Name()]; ok {
+			text = strings.NewReplacer(repl...).Replace(text)
+		}
+		assert.NoError(t, os.WriteFile(path.Join(nmlDir, entry.Name()), []byte(text), 0644))
+	}
+	return dir
+}
+
+// AppendToFile appends `content` to file `name`.
+func AppendToFile(t *testing.T, name, content string) {
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0644)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	_, err = f.WriteString(content)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+}
+
+// ReplaceInFile replaces `old` with `new`
+// in the content of file `name` of `dir`.
+func ReplaceInFile(t *testing.T, dir, name, old, new string) {
+	file := path.Join(dir, name)
+	content, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), old)
+	assert.NoError(t, os.WriteFile(file, []byte(strings.Replace(string(content), old, new, 1)), 0644))
+}
@@ -0,0 +1,308 @@
+// Package nml reads and writes Fortran namelist files.
+//
+// It supports groups delimited by `&name` and `/` (or `&end`),
+// comments starting with `!`, array values, indexed assignments
+// like `e_we(2) = 523`, repeat counts like `3*1` or `3*`, integer,
+// real, string and logical values. Group and variable names
+// are case-insensitive, and they are stored in lower case.
+//
+// Comments and original formatting are not preserved: writing
+// a parsed namelist produces a canonical representation of
+// the same groups and values, in their original order.
+package nml
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Kind is the type of a namelist value.
+type Kind int
+
+const (
+	// Null is an empty value, e.g. `a = 1, , 3` or `3*`
+	Null Kind = iota
+	// Int is an integer value
+	Int
+	// Real is a floating point value
+	Real
+	// String is a quoted character value
+	String
+	// Logical is a boolean value
+	Logical
+)
+
+func (kind Kind) String() string {
+	switch kind {
+	case Null:
+		return "null"
+	case Int:
+		return "integer"
+	case Real:
+		return "real"
+	case String:
+		return "string"
+	case Logical:
+		return "logical"
+	default:
+		return "unknown"
+	}
+}
+
+// Value is a single value of a namelist variable.
+type Value struct {
+	Kind Kind
+
+	// Text contains the value as written in the namelist
+	// for numbers, and the unquoted content for strings.
+	Text string
+
+	// Bool contains the value of logicals
+	Bool bool
+}
+
+// IntValue returns an integer Value.
+func IntValue(v int) Value {
+	return Value{Kind: Int, Text: strconv.Itoa(v)}
+}
+
+// RealValue returns a real Value.
+func RealValue(v float64) Value {
+	text := strconv.FormatFloat(v, 'g', -1, 64)
+	if !strings.ContainsAny(text, ".eE") {
+		text += "."
+	}
+	return Value{Kind: Real, Text: text}
+}
+
+// StringValue returns a string Value.
+func StringValue(v string) Value {
+	return Value{Kind: String, Text: v}
+}
+
+// LogicalValue returns a logical Value.
+func LogicalValue(v bool) Value {
+	return Value{Kind: Logical, Bool: v}
+}
+
+// Int returns the value as an integer.
+func (v Value) Int() (int, error) {
+	if v.Kind != Int {
+		return 0, fmt.Errorf("value `%s` is %s, not integer", v.Format(), v.Kind)
+	}
+	return strconv.Atoi(v.Text)
+}
+
+// Float returns the value as a float64.
+// Integers values are converted.
+func (v Value) Float() (float64, error) {
+	if v.Kind != Int && v.Kind != Real {
+		return 0, fmt.Errorf("value `%s` is %s, not a number", v.Format(), v.Kind)
+	}
+	text := strings.NewReplacer("d", "e", "D", "e").Replace(v.Text)
+	return strconv.ParseFloat(text, 64)
+}
+
+// Format returns the value formatted
+// as it's written in a namelist.
+func (v Value) Format() string {
+	switch v.Kind {
+	case String:
+		return "'" + strings.ReplaceAll(v.Text, "'", "''") + "'"
+	case Logical:
+		if v.Bool {
+			return ".true."
+		}
+		return ".false."
+	default:
+		return v.Text
+	}
+}
+
+// Var is a variable of a namelist group.
+type Var struct {
+	Name   string
+	Values []Value
+}
+
+// Group is a namelist group.
+type Group struct {
+	Name string
+	Vars []*Var
+}
+
+// Var returns the variable of the group with given
+// name, or nil if the group doesn't contain it.
+func (grp *Group) Var(name string) *Var {
+	name = strings.ToLower(name)
+	for _, v := range grp.Vars {
+		if v.Name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+// Set sets the values of variable `name`, adding it
+// to the group if it's not already present.
+func (grp *Group) Set(name string, values ...Value) {
+	v := grp.Var(name)
+	if v == nil {
+		v = &Var{Name: strings.ToLower(name)}
+		grp.Vars = append(grp.Vars, v)
+	}
+	v.Values = values
+}
+
+// Namelist is an ordered list of groups.
+type Namelist struct {
+	Groups []*Group
+}
+
+// Group returns the group with given name,
+// or nil if the namelist doesn't contain it.
+func (nl *Namelist) Group(name string) *Group {
+	name = strings.ToLower(name)
+	for _, grp := range nl.Groups {
+		if grp.Name == name {
+			return grp
+		}
+	}
+	return nil
+}
+
+// Lookup returns the first variable with given
+// name found in any group, or nil if there's none.
+func (nl *Namelist) Lookup(name string) *Var {
+	for _, grp := range nl.Groups {
+		if v := grp.Var(name); v != nil {
+			return v
+		}
+	}
+	return nil
+}
+
+// Set sets the values of variable `name` in
+// `group`, adding the group and the variable if
+// they are not already present.
+func (nl *Namelist) Set(group, name string, values ...Value) {
+	grp := nl.Group(group)
+	if grp == nil {
+		grp = &Group{Name: strings.ToLower(group)}
+		nl.Groups = append(nl.Groups, grp)
+	}
+	grp.Set(name, values...)
+}
+
+func (nl *Namelist) lookupValues(name string) ([]Value, error) {
+	v := nl.Lookup(name)
+	if v == nil {
+		return nil, fmt.Errorf("variable `%s` not found", name)
+	}
+	if len(v.Values) == 0 {
+		return nil, fmt.Errorf("variable `%s` has no values", name)
+	}
+	return v.Values, nil
+}
+
+// Int returns the first value of variable `name`,
+// searched in all groups, as an integer.
+func (nl *Namelist) Int(name string) (int, error) {
+	values, err := nl.lookupValues(name)
+	if err != nil {
+		return 0, err
+	}
+	res, err := values[0].Int()
+	if err != nil {
+		return 0, fmt.Errorf("variable `%s`: %w", name, err)
+	}
+	return res, nil
+}
+
+// Ints returns all values of variable `name`,
+// searched in all groups, as integers.
+func (nl *Namelist) Ints(name string) ([]int, error) {
+	values, err := nl.lookupValues(name)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]int, len(values))
+	for idx, v := range values {
+		res[idx], err = v.Int()
+		if err != nil {
+			return nil, fmt.Errorf("variable `%s`, value %d: %w", name, idx+1, err)
+		}
+	}
+	return res, nil
+}
+
+// Floats returns all values of variable `name`,
+// searched in all groups, as float64.
+func (nl *Namelist) Floats(name string) ([]float64, error) {
+	values, err := nl.lookupValues(name)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]float64, len(values))
+	for idx, v := range values {
+		res[idx], err = v.Float()
+		if err != nil {
+			return nil, fmt.Errorf("variable `%s`, value %d: %w", name, idx+1, err)
+		}
+	}
+	return res, nil
+}
+
+// Strings returns all values of variable
+// `name`, searched in all groups, as strings.
+func (nl *Namelist) Strings(name string) ([]string, error) {
+	values, err := nl.lookupValues(name)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, len(values))
+	for idx, v := range values {
+		if v.Kind != String {
+			return nil, fmt.Errorf("variable `%s`, value %d: value `%s` is %s, not string", name, idx+1, v.Format(), v.Kind)
+		}
+		res[idx] = v.Text
+	}
+	return res, nil
+}
+
+// WriteTo writes the namelist to `w`.
+func (nl *Namelist) WriteTo(w io.Writer) (int64, error) {
+	n, err := io.WriteString(w, nl.String())
+	return int64(n), err
+}
+
+// String returns the namelist formatted
+// in canonical format.
+func (nl *Namelist) String() string {
+	var buf strings.Builder
+	for idx, grp := range nl.Groups {
+		if idx > 0 {
+			buf.WriteString("\n")
+		}
+		buf.WriteString("&" + grp.Name + "\n")
+
+		width := 0
+		for _, v := range grp.Vars {
+			if len(v.Name) > width {
+				width = len(v.Name)
+			}
+		}
+
+		for _, v := range grp.Vars {
+			values := make([]string, len(v.Values))
+			for idx, val := range v.Values {
+				values[idx] = val.Format()
+			}
+			fmt.Fprintf(&buf, " %-*s = %s,\n", width, v.Name, strings.Join(values, ", "))
+		}
+		buf.WriteString("/\n")
+	}
+	return buf.String()
+}
@@ -0,0 +1,164 @@
+package nml
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meteocima/namelist-prepare/namelist"
+	"github.com/meteocima/wrfda-runner/v2/internal/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+const sample = `
+! a comment before the first group
+&Share
+ wrf_core = 'ARW',           ! inline comment
+ MAX_DOM=3 ! note
+ start_date = '2020-12-24_18:00:00','2020-12-24_18:00:00', "it's"
+ interval_seconds              = 10800
+/
+
+&domains
+ e_we = 216, 523, 430,
+ dx = 22500., 7500.0, 2.5d3
+ feedback = 3*1
+ nested = .false., 2*.true.
+ specified = T, F
+ nulls = 1, , 3, 2*
+ names = 2*'a!b'
+ e_we(3) = 431
+ e_sn(2) = 448
+&end
+`
+
+func TestParse(t *testing.T) {
+	nl, err := ParseString(sample)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, 2, len(nl.Groups))
+	assert.Equal(t, "share", nl.Groups[0].Name)
+
+	maxDom, err := nl.Int("max_dom")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, maxDom)
+
+	dates, err := nl.Strings("start_date")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2020-12-24_18:00:00", "2020-12-24_18:00:00", "it's"}, dates)
+
+	ewe, err := nl.Ints("E_WE")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{216, 523, 431}, ewe)
+
+	dx, err := nl.Floats("dx")
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{22500, 7500, 2500}, dx)
+
+	feedback, err := nl.Ints("feedback")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 1, 1}, feedback)
+
+	nested := nl.Lookup("nested").Values
+	assert.Equal(t, []Value{LogicalValue(false), LogicalValue(true), LogicalValue(true)}, nested)
+	assert.Equal(t, []Value{LogicalValue(true), LogicalValue(false)}, nl.Lookup("specified").Values)
+
+	nulls := nl.Lookup("nulls").Values
+	assert.Equal(t, []Kind{Int, Null, Int, Null, Null}, []Kind{nulls[0].Kind, nulls[1].Kind, nulls[2].Kind, nulls[3].Kind, nulls[4].Kind})
+
+	names, err := nl.Strings("names")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a!b", "a!b"}, names)
+
+	esn := nl.Lookup("e_sn").Values
+	assert.Equal(t, Null, esn[0].Kind)
+	assert.Equal(t, "448", esn[1].Text)
+
+	_, err = nl.Int("wrf_core")
+	assert.Error(t, err)
+	_, err = nl.Int("not_there")
+	assert.Error(t, err)
+}
+
+func TestRoundTrip(t *testing.T) {
+	nl, err := ParseString(sample)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	nl.Set("domains", "e_we", IntValue(200), IntValue(400), IntValue(600))
+	nl.Set("physics", "mp_physics", IntValue(6))
+
+	written := nl.String()
+	reparsed, err := ParseString(written)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, nl, reparsed)
+
+	ewe, err := reparsed.Ints("e_we")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{200, 400, 600}, ewe)
+	assert.True(t, strings.HasPrefix(written, "&share\n wrf_core         = 'ARW',\n max_dom          = 3,\n"))
+}
+
+func TestParseLogicals(t *testing.T) {
+	nl, err := ParseString("&share\n flags = T, F, .true., .false., .t, .Fal, t, false,\n/")
+	if !assert.NoError(t, err) {
+		return
+	}
+	flags := nl.Lookup("flags")
+	if !assert.NotNil(t, flags) {
+		return
+	}
+	bools := make([]bool, len(flags.Values))
+	for idx, v := range flags.Values {
+		assert.Equal(t, Logical, v.Kind)
+		bools[idx] = v.Bool
+	}
+	assert.Equal(t, []bool{true, false, true, false, true, false, true, false}, bools)
+}
+
+func TestParseErrors(t *testing.T) {
+	_, err := ParseString("&share\n max_dom = 3,\n")
+	assert.EqualError(t, err, "namelist syntax error at line 3: unterminated group `share`")
+
+	_, err = ParseString("&share\n max_dom = 1x,\n/")
+	assert.EqualError(t, err, "namelist syntax error at line 2: invalid value `1x`")
+
+	_, err = ParseString("&share\n debug = foo,\n/")
+	assert.EqualError(t, err, "namelist syntax error at line 2: invalid value `foo`")
+
+	_, err = ParseString("max_dom = 3")
+	assert.EqualError(t, err, "namelist syntax error at line 1: expected group start")
+
+	_, err = ParseString("&share\n name = 'unterminated\n/")
+	assert.EqualError(t, err, "namelist syntax error at line 3: unterminated string")
+}
+
+func TestParseRenderedTemplates(t *testing.T) {
+	for _, name := range []string{"namelist.wps", "namelist.step.wrf", "namelist.run.wrf"} {
+		content, err := os.ReadFile(testutil.Fixture("testrun/NamelistsDir/" + name))
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		tmpl := namelist.Tmpl{}
+		tmpl.ReadTemplateFrom(strings.NewReader(string(content)))
+		var rendered strings.Builder
+		start := time.Date(2020, 12, 24, 18, 0, 0, 0, time.UTC)
+		tmpl.RenderTo(namelist.Args{Start: start, End: start.Add(54 * time.Hour)}, &rendered)
+
+		nl, err := ParseString(rendered.String())
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+
+		maxDom, err := nl.Int("max_dom")
+		assert.NoError(t, err, name)
+		assert.Equal(t, 3, maxDom, name)
+	}
+}
@@ -0,0 +1,400 @@
+package nml
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenType int
+
+const (
+	tEOF tokenType = iota
+	tGroupStart
+	tGroupEnd
+	tWord
+	tString
+	tRepeat
+	tIndex
+	tEquals
+	tComma
+)
+
+type token struct {
+	typ  tokenType
+	text string
+	line int
+
+	// count is the repeat count of tRepeat tokens
+	count int
+	// attached is true for tRepeat tokens
+	// immediately followed by their value
+	attached bool
+}
+
+// ParseError is returned when
+// the namelist syntax is invalid.
+type ParseError struct {
+	Line int
+	Msg  string
+}
+
+func (err *ParseError) Error() string {
+	return fmt.Sprintf("namelist syntax error at line %d: %s", err.Line, err.Msg)
+}
+
+type lexer struct {
+	src  []rune
+	pos  int
+	line int
+}
+
+func isSeparator(r rune) bool {
+	return unicode.IsSpace(r) || strings.ContainsRune(",/=!()&$'\"", r)
+}
+
+func (lx *lexer) peek() rune {
+	if lx.pos >= len(lx.src) {
+		return 0
+	}
+	return lx.src[lx.pos]
+}
+
+func (lx *lexer) fail(format string, args ...interface{}) error {
+	return &ParseError{Line: lx.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (lx *lexer) readWhile(pred func(r rune) bool) string {
+	start := lx.pos
+	for lx.pos < len(lx.src) && pred(lx.src[lx.pos]) {
+		lx.pos++
+	}
+	return string(lx.src[start:lx.pos])
+}
+
+func (lx *lexer) readString(quote rune) (string, error) {
+	var buf strings.Builder
+	lx.pos++
+	for {
+		if lx.pos >= len(lx.src) {
+			return "", lx.fail("unterminated string")
+		}
+		r := lx.src[lx.pos]
+		lx.pos++
+		if r == '\n' {
+			lx.line++
+		}
+		if r == quote {
+			// a doubled quote is an escaped quote
+			if lx.peek() == quote {
+				buf.WriteRune(quote)
+				lx.pos++
+				continue
+			}
+			return buf.String(), nil
+		}
+		buf.WriteRune(r)
+	}
+}
+
+func (lx *lexer) tokens() ([]token, error) {
+	toks := []token{}
+	for {
+		r := lx.peek()
+		switch {
+		case r == 0:
+			return append(toks, token{typ: tEOF, line: lx.line}), nil
+		case r == '\n':
+			lx.line++
+			lx.pos++
+		case unicode.IsSpace(r):
+			lx.pos++
+		case r == '!':
+			lx.readWhile(func(r rune) bool { return r != '\n' })
+		case r == '&' || r == '$':
+			lx.pos++
+			name := strings.ToLower(lx.readWhile(func(r rune) bool { return !isSeparator(r) }))
+			if name == "" {
+				return nil, lx.fail("missing group name after `%c`", r)
+			}
+			if name == "end" {
+				toks = append(toks, token{typ: tGroupEnd, line: lx.line})
+			} else {
+				toks = append(toks, token{typ: tGroupStart, text: name, line: lx.line})
+			}
+		case r == '/':
+			lx.pos++
+			toks = append(toks, token{typ: tGroupEnd, line: lx.line})
+		case r == '=':
+			lx.pos++
+			toks = append(toks, token{typ: tEquals, line: lx.line})
+		case r == ',':
+			lx.pos++
+			toks = append(toks, token{typ: tComma, line: lx.line})
+		case r == '(':
+			lx.pos++
+			idx := lx.readWhile(func(r rune) bool { return r != ')' && r != '\n' })
+			if lx.peek() != ')' {
+				return nil, lx.fail("unterminated index `(%s`", idx)
+			}
+			lx.pos++
+			toks = append(toks, token{typ: tIndex, text: strings.TrimSpace(idx), line: lx.line})
+		case r == ')':
+			return nil, lx.fail("unexpected `)`")
+		case r == '\'' || r == '"':
+			str, err := lx.readString(r)
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, token{typ: tString, text: str, line: lx.line})
+		default:
+			word := lx.readWhile(func(r rune) bool { return !isSeparator(r) })
+			star := strings.IndexRune(word, '*')
+			if star == -1 {
+				toks = append(toks, token{typ: tWord, text: word, line: lx.line})
+				continue
+			}
+
+			count, err := strconv.Atoi(word[:star])
+			if err != nil || count <= 0 {
+				return nil, lx.fail("invalid repeat count in `%s`", word)
+			}
+			rest := word[star+1:]
+			next := lx.peek()
+			toks = append(toks, token{
+				typ:      tRepeat,
+				count:    count,
+				attached: rest != "" || next == '\'' || next == '"',
+				line:     lx.line,
+			})
+			if rest != "" {
+				toks = append(toks, token{typ: tWord, text: rest, line: lx.line})
+			}
+		}
+	}
+}
+
+// parseWord classifies a non quoted value.
+func parseWord(word string) (Value, bool) {
+	if _, err := strconv.Atoi(word); err == nil {
+		return Value{Kind: Int, Text: word}, true
+	}
+
+	lower := strings.ToLower(word)
+	if _, err := strconv.ParseFloat(strings.NewReplacer("d", "e").Replace(lower), 64); err == nil {
+		return Value{Kind: Real, Text: word}, true
+	}
+
+	// a logical is T, F, true or false, or a period
+	// followed by T or F and optionally other
+	// characters, as in .true. or .false.
+	switch {
+	case lower == "t" || lower == "true" || strings.HasPrefix(lower, ".t"):
+		return Value{Kind: Logical, Bool: true}, true
+	case lower == "f" || lower == "false" || strings.HasPrefix(lower, ".f"):
+		return Value{Kind: Logical, Bool: false}, true
+	}
+
+	return Value{}, false
+}
+
+func isName(word string) bool {
+	for idx, r := range word {
+		if idx == 0 && !unicode.IsLetter(r) {
+			return false
+		}
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '%' {
+			return false
+		}
+	}
+	return word != ""
+}
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func (p *parser) next() token {
+	tok := p.toks[p.pos]
+	if tok.typ != tEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) peek(offset int) token {
+	if p.pos+offset >= len(p.toks) {
+		return p.toks[len(p.toks)-1]
+	}
+	return p.toks[p.pos+offset]
+}
+
+// atAssignment returns true if next
+// tokens starts a new variable assignment.
+func (p *parser) atAssignment() bool {
+	if p.peek(0).typ != tWord {
+		return false
+	}
+	after := p.peek(1).typ
+	return after == tEquals || after == tIndex
+}
+
+func fail(tok token, format string, args ...interface{}) error {
+	return &ParseError{Line: tok.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) parseValues() ([]Value, error) {
+	values := []Value{}
+	// afterValue is true when last token
+	// read was a value, and false after
+	// `=` or after a comma.
+	afterValue := false
+	for {
+		if p.atAssignment() {
+			return values, nil
+		}
+
+		tok := p.peek(0)
+		switch tok.typ {
+		case tEOF, tGroupEnd, tGroupStart:
+			return values, nil
+		case tComma:
+			p.next()
+			if !afterValue {
+				values = append(values, Value{Kind: Null})
+			}
+			afterValue = false
+		case tString:
+			p.next()
+			values = append(values, Value{Kind: String, Text: tok.text})
+			afterValue = true
+		case tWord:
+			p.next()
+			val, ok := parseWord(tok.text)
+			if !ok {
+				return nil, fail(tok, "invalid value `%s`", tok.text)
+			}
+			values = append(values, val)
+			afterValue = true
+		case tRepeat:
+			p.next()
+			val := Value{Kind: Null}
+			if tok.attached {
+				valTok := p.next()
+				switch valTok.typ {
+				case tString:
+					val = Value{Kind: String, Text: valTok.text}
+				case tWord:
+					var ok bool
+					val, ok = parseWord(valTok.text)
+					if !ok {
+						return nil, fail(valTok, "invalid value `%s`", valTok.text)
+					}
+				default:
+					return nil, fail(valTok, "missing value after repeat count")
+				}
+			}
+			for i := 0; i < tok.count; i++ {
+				values = append(values, val)
+			}
+			afterValue = true
+		default:
+			return nil, fail(tok, "unexpected token in values")
+		}
+	}
+}
+
+func (p *parser) parseGroup(grp *Group) error {
+	for {
+		tok := p.next()
+		switch tok.typ {
+		case tGroupEnd:
+			return nil
+		case tEOF:
+			return fail(tok, "unterminated group `%s`", grp.Name)
+		case tWord:
+			if !isName(tok.text) {
+				return fail(tok, "invalid variable name `%s`", tok.text)
+			}
+			name := strings.ToLower(tok.text)
+
+			start := 1
+			if p.peek(0).typ == tIndex {
+				idxTok := p.next()
+				var err error
+				start, err = strconv.Atoi(idxTok.text)
+				if err != nil || start < 1 {
+					return fail(idxTok, "unsupported index `(%s)` for variable `%s`", idxTok.text, name)
+				}
+			}
+
+			if eq := p.next(); eq.typ != tEquals {
+				return fail(eq, "expected `=` after variable `%s`", name)
+			}
+
+			values, err := p.parseValues()
+			if err != nil {
+				return err
+			}
+
+			v := grp.Var(name)
+			if v == nil {
+				grp.Set(name)
+				v = grp.Var(name)
+			}
+
+			// assignments overwrite previous values
+			// starting from the index, leaving
+			// the others untouched.
+			for len(v.Values) < start-1+len(values) {
+				v.Values = append(v.Values, Value{Kind: Null})
+			}
+			copy(v.Values[start-1:], values)
+		default:
+			return fail(tok, "expected variable name in group `%s`", grp.Name)
+		}
+	}
+}
+
+// Parse reads a namelist from `r`.
+func Parse(r io.Reader) (*Namelist, error) {
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return ParseString(string(src))
+}
+
+// ParseString parses a namelist from `src`.
+func ParseString(src string) (*Namelist, error) {
+	lx := lexer{src: []rune(src), line: 1}
+	toks, err := lx.tokens()
+	if err != nil {
+		return nil, err
+	}
+
+	p := parser{toks: toks}
+	nl := &Namelist{Groups: []*Group{}}
+	for {
+		tok := p.next()
+		switch tok.typ {
+		case tEOF:
+			return nl, nil
+		case tGroupStart:
+			grp := nl.Group(tok.text)
+			if grp == nil {
+				grp = &Group{Name: tok.text, Vars: []*Var{}}
+				nl.Groups = append(nl.Groups, grp)
+			}
+			if err := p.parseGroup(grp); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fail(tok, "expected group start")
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package runctx
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/meteocima/virtual-server/connection"
+	"github.com/meteocima/virtual-server/ctx"
+	"github.com/meteocima/virtual-server/tailor"
+	"github.com/meteocima/virtual-server/vpath"
+)
+
+// KillGrace is the time given to processes to
+// exit after SIGTERM, before they are killed.
+var KillGrace = 10 * time.Second
+
+// WithContext returns a Context that shares Err, the
+// standard streams and the plan of `vs`, whose processes
+// are killed when `parent` is done.
+func (vs *Context) WithContext(parent context.Context) *Context {
+	return &Context{
+		Context: vs.Context,
+		Plan:    vs.Plan,
+		parent:  parent,
+		exits:   vs.exits,
+	}
+}
+
+// Exit is the exit status of a
+// process executed by Exec.
+type Exit struct {
+	Command string
+	// Code is the exit code, or -1 if
+	// the process was killed by a signal.
+	Code int
+}
+
+func (exit Exit) String() string {
+	if exit.Code == -1 {
+		return fmt.Sprintf("`%s` killed by a signal", exit.Command)
+	}
+	return fmt.Sprintf("`%s` exited with code %d", exit.Command, exit.Code)
+}
+
+// ExitError is the error of a process
+// that exited with a non-zero code.
+type ExitError struct {
+	Exit
+}
+
+func (err *ExitError) Error() string {
+	return err.Exit.String()
+}
+
+type exitLog struct {
+	lock  sync.Mutex
+	exits []Exit
+	// parent is the log of the Context
+	// TrackExits was called on, if any.
+	parent *exitLog
+}
+
+// TrackExits returns a Context like WithContext that
+// records the exit status of the processes executed
+// by it and by its clones. They are recorded in the
+// exits tracked by `vs` too.
+func (vs *Context) TrackExits() *Context {
+	tracking := vs.WithContext(vs.parent)
+	tracking.exits = &exitLog{parent: vs.exits}
+	return tracking
+}
+
+// Exits returns the exit status of the processes
+// executed since TrackExits, in order of completion.
+func (vs *Context) Exits() []Exit {
+	if vs.exits == nil {
+		return nil
+	}
+	vs.exits.lock.Lock()
+	defer vs.exits.lock.Unlock()
+	return append([]Exit{}, vs.exits.exits...)
+}
+
+func (vs *Context) recordExit(command string, code int) {
+	for log := vs.exits; log != nil; log = log.parent {
+		log.lock.Lock()
+		log.exits = append(log.exits, Exit{Command: command, Code: code})
+		log.lock.Unlock()
+	}
+}
+
+// Ctx returns the context.Context that
+// limits the execution of processes.
+func (vs *Context) Ctx() context.Context {
+	if vs.parent == nil {
+		return context.Background()
+	}
+	return vs.parent
+}
+
+// execInContext executes `command` like Exec, killing it with
+// its whole process tree when the context of `vs` is done.
+// In that case, Err wraps the error of the context. The exit
+// status of processes is recorded when tracked.
+func (vs *Context) execInContext(command vpath.VirtualPath, args []string, options *connection.RunOptions) {
+	if options == nil {
+		options = &connection.RunOptions{}
+	}
+	if err := vs.Ctx().Err(); err != nil {
+		vs.Err = fmt.Errorf("`%s` not started: %w", command.String(), err)
+		return
+	}
+
+	conn, err := connection.FindHost(command.Host)
+	if err != nil {
+		vs.Err = err
+		return
+	}
+	if _, local := conn.(*connection.LocalConnection); !local {
+		vs.execRemote(command, args, options)
+		return
+	}
+
+	cmd := exec.Command(command.Path, args...)
+	cmd.Dir = options.Cwd.Path
+	cmd.Env = options.Env
+	cmd.Stdin = vs.GetStdIn()
+	cmd.Stdout = vs.GetStdOut()
+	cmd.Stderr = vs.GetStdErr()
+	setProcessGroup(cmd)
+
+	vs.LogInfo("START %s %s", command.String(), strings.Join(args, " "))
+	if err := cmd.Start(); err != nil {
+		vs.Err = fmt.Errorf("Run `%s`: Start error: %w", command.String(), err)
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(done)
+	}()
+	if options.OutFromLog != nil {
+		go tailLog(*options.OutFromLog, cmd.Stdout, done)
+	}
+
+	select {
+	case <-done:
+		vs.completed(command.String(), cmd.ProcessState.ExitCode())
+		return
+	case <-vs.Ctx().Done():
+	}
+
+	vs.LogInfo("KILLING %s: %s", command.String(), vs.Ctx().Err())
+	killProcessGroup(cmd, false)
+	select {
+	case <-done:
+	case <-time.After(KillGrace):
+		killProcessGroup(cmd, true)
+		<-done
+	}
+	vs.recordExit(command.String(), cmd.ProcessState.ExitCode())
+	vs.Err = fmt.Errorf("`%s` killed: %w", command.String(), vs.Ctx().Err())
+}
+
+// completed records and logs the exit
+// `code` of a process executing `command`.
+func (vs *Context) completed(command string, code int) {
+	vs.recordExit(command, code)
+	if code != 0 {
+		vs.LogInfo("COMPLETED WITH EXIT CODE %d %s", code, command)
+		return
+	}
+	vs.LogInfo("COMPLETED OK %s", command)
+}
+
+// startRemote starts `command` on its host through
+// the connection of `vs`. Tests replace it to run
+// remote commands in a local shell.
+var startRemote = func(vs *ctx.Context, command vpath.VirtualPath, args []string, options connection.RunOptions) connection.Process {
+	return vs.Run(command, args, options)
+}
+
+// execRemote executes `command` on a remote host. The
+// command runs in a new session through setsid, and the id
+// of its process group is written in a file on the host, so
+// that when the context is done the whole group can be
+// killed over the connection, like for local processes.
+// The exit status of remote processes is recorded too.
+func (vs *Context) execRemote(command vpath.VirtualPath, args []string, options *connection.RunOptions) {
+	pgidFile := vpath.New(command.Host, "/tmp/wrfda-runner-%d.pgid", time.Now().UnixNano())
+	runOptions := *options
+	runOptions.Stdin = vs.GetStdIn()
+	runOptions.Stdout = vs.GetStdOut()
+	runOptions.Stderr = vs.GetStdErr()
+
+	vs.LogInfo("START %s %s", command.String(), strings.Join(args, " "))
+	done := make(chan struct{})
+	startCtx := vs.Context.Clone()
+	code := 0
+	go func() {
+		proc := startRemote(startCtx, vpath.New(command.Host, "setsid"), remoteArgs(command, args, pgidFile), runOptions)
+		if proc != nil {
+			// Wait of remote processes never fails.
+			code, _ = proc.Wait()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		vs.removePgidFile(pgidFile)
+		if startCtx.Err != nil {
+			vs.Err = startCtx.Err
+			return
+		}
+		vs.completed(command.String(), code)
+		return
+	case <-vs.Ctx().Done():
+	}
+
+	vs.LogInfo("KILLING %s: %s", command.String(), vs.Ctx().Err())
+	vs.killRemoteGroup(pgidFile, "TERM")
+	select {
+	case <-done:
+		vs.recordExit(command.String(), code)
+	case <-time.After(KillGrace):
+		vs.killRemoteGroup(pgidFile, "KILL")
+		select {
+		case <-done:
+			vs.recordExit(command.String(), code)
+		case <-time.After(KillGrace):
+			vs.LogInfo("WARNING: remote process %s still not exited after SIGKILL", command.String())
+		}
+	}
+	vs.removePgidFile(pgidFile)
+	vs.Err = fmt.Errorf("`%s` killed: %w", command.String(), vs.Ctx().Err())
+}
+
+// shellQuote quotes `arg` as a single word for the remote shell.
+func shellQuote(arg string) string {
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// remoteArgs returns the arguments of setsid that execute
+// `command` with `args`, after writing the id of its process
+// group in `pgidFile`. Arguments are quoted, because remote
+// connections pass the command line to a shell.
+func remoteArgs(command vpath.VirtualPath, args []string, pgidFile vpath.VirtualPath) []string {
+	script := []string{"echo $$ >", shellQuote(pgidFile.Path), "&& exec", shellQuote(command.Path)}
+	for _, arg := range args {
+		script = append(script, shellQuote(arg))
+	}
+	return []string{"/bin/sh", "-c", shellQuote(strings.Join(script, " "))}
+}
+
+// killRemoteGroup sends `signal` to the process
+// group whose id is written in `pgidFile`.
+func (vs *Context) killRemoteGroup(pgidFile vpath.VirtualPath, signal string) {
+	killCtx := vs.Context.Clone()
+	pgid := strings.TrimSpace(killCtx.ReadString(pgidFile))
+	if killCtx.Err != nil || pgid == "" {
+		vs.LogInfo("WARNING: cannot read process group from %s: %v", pgidFile.String(), killCtx.Err)
+		return
+	}
+	killCtx.Exec(vpath.New(pgidFile.Host, "kill"), []string{"-" + signal, "--", "-" + pgid}, nil)
+	if killCtx.Err != nil {
+		vs.LogInfo("WARNING: cannot kill process group %s: %s", pgid, killCtx.Err)
+	}
+}
+
+func (vs *Context) removePgidFile(pgidFile vpath.VirtualPath) {
+	rmCtx := vs.Context.Clone()
+	if rmCtx.Exists(pgidFile) {
+		rmCtx.RmFile(pgidFile)
+	}
+}
+
+// tailLog copies the lines appended to local file `log`
+// to `w`, until `done` is closed.
+func tailLog(log vpath.VirtualPath, w io.Writer, done chan struct{}) {
+	var file *os.File
+	for file == nil {
+		var err error
+		file, err = os.Open(log.Path)
+		if err == nil {
+			break
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	defer file.Close()
+
+	tail := tailor.New(file, w, 1024)
+	errs := tail.Start()
+	<-done
+	tail.Stop()
+	<-errs
+}
+
+// Output executes `command` in `cwd`, and returns its
+// standard output. Unlike Exec, it sets Err when the
+// command exits with a non-zero code. While planning,
+// the command is only recorded, and the output is empty.
+func (vs *Context) Output(command vpath.VirtualPath, args []string, cwd vpath.VirtualPath) string {
+	if vs.Err != nil {
+		return ""
+	}
+	if vs.Plan != nil {
+		vs.Plan.record(Action{Op: OpExec, Command: command.String(), Args: args, Cwd: cwd.String()})
+		return ""
+	}
+
+	conn, err := connection.FindHost(command.Host)
+	if err != nil {
+		vs.Err = err
+		return ""
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := 0
+	if _, local := conn.(*connection.LocalConnection); local {
+		cmd := exec.Command(command.Path, args...)
+		cmd.Dir = cwd.Path
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		err = cmd.Run()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			code, err = exitErr.ExitCode(), nil
+		}
+	} else {
+		proc := vs.Run(command, args, connection.RunOptions{
+			Cwd:    cwd,
+			Stdout: &stdout,
+			Stderr: &stderr,
+		})
+		if proc == nil {
+			return ""
+		}
+		code, err = proc.Wait()
+	}
+
+	if err == nil && code != 0 {
+		err = fmt.Errorf("exit code %d: %s", code, strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		vs.Err = fmt.Errorf("`%s %s` failed: %w", command.Path, strings.Join(args, " "), err)
+		return ""
+	}
+	return stdout.String()
+}
+
+// setProcessGroup starts `cmd` in a new process group, so
+// that it can be killed together with all its children.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup sends SIGTERM, or SIGKILL when
+// `force` is true, to the process group of `cmd`.
+func killProcessGroup(cmd *exec.Cmd, force bool) {
+	sig := syscall.SIGTERM
+	if force {
+		sig = syscall.SIGKILL
+	}
+	syscall.Kill(-cmd.Process.Pid, sig)
+}
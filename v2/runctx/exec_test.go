@@ -0,0 +1,131 @@
+package runctx
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	vsConfig "github.com/meteocima/virtual-server/config"
+	"github.com/meteocima/virtual-server/connection"
+	"github.com/meteocima/virtual-server/ctx"
+	"github.com/meteocima/virtual-server/vpath"
+	"github.com/meteocima/wrfda-runner/v2/internal/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// isRunning returns whether process `pid` exists
+// and it's not a zombie waiting to be reaped.
+func isRunning(pid string) bool {
+	stat, err := os.ReadFile(path.Join("/proc", pid, "stat"))
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(stat))
+	return len(fields) > 2 && fields[2] != "Z"
+}
+
+func TestExecKillsProcessTree(t *testing.T) {
+	err := vsConfig.Init(testutil.Fixture("testrun/wrfda-runner.cfg"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	dir := t.TempDir()
+	pidFile := path.Join(dir, "child.pid")
+
+	parent, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	vs := New(os.Stdin, &bytes.Buffer{}, &bytes.Buffer{}).WithContext(parent)
+
+	start := time.Now()
+	vs.Exec(vpath.Local("/bin/sh"), []string{"-c", "sleep 30 & echo $! > " + pidFile + "; wait"}, &connection.RunOptions{
+		Cwd: vpath.Local(dir),
+	})
+	assert.True(t, time.Since(start) < 10*time.Second)
+	assert.ErrorIs(t, vs.Err, context.DeadlineExceeded)
+
+	pid, err := os.ReadFile(pidFile)
+	if assert.NoError(t, err) {
+		// the child exits asynchronously after the signal
+		child := strings.TrimSpace(string(pid))
+		for i := 0; i < 100 && isRunning(child); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.False(t, isRunning(child))
+	}
+
+	// once the context is done, processes are not started.
+	vs = New(os.Stdin, &bytes.Buffer{}, &bytes.Buffer{}).WithContext(parent)
+	vs.Exec(vpath.Local("/bin/true"), nil, &connection.RunOptions{Cwd: vpath.Local(dir)})
+	assert.ErrorIs(t, vs.Err, context.DeadlineExceeded)
+}
+
+func TestRemoteArgs(t *testing.T) {
+	dir := t.TempDir()
+	pgidFile := vpath.Local(path.Join(dir, "test.pgid"))
+	outFile := path.Join(dir, "out")
+
+	// remote connections run the command line in a shell,
+	// with arguments joined by spaces.
+	args := remoteArgs(vpath.Local("/bin/sh"), []string{"-c", "echo \"it's $1\" > " + outFile + "; sleep 30 & wait", "sh", "a b"}, pgidFile)
+	cmd := exec.Command("/bin/sh", "-c", "setsid "+strings.Join(args, " "))
+	if !assert.NoError(t, cmd.Start()) {
+		return
+	}
+	done := make(chan error)
+	go func() { done <- cmd.Wait() }()
+
+	var pgid int
+	for i := 0; i < 100 && pgid == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+		content, _ := os.ReadFile(pgidFile.Path)
+		pgid, _ = strconv.Atoi(strings.TrimSpace(string(content)))
+	}
+	if !assert.NotZero(t, pgid) {
+		cmd.Process.Kill()
+		return
+	}
+	assert.NoError(t, syscall.Kill(-pgid, syscall.SIGTERM))
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("process group not killed")
+	}
+	out, err := os.ReadFile(outFile)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "it's a b\n", string(out))
+	}
+}
+
+func TestExecRemoteExitCode(t *testing.T) {
+	err := vsConfig.Init(testutil.Fixture("testrun/wrfda-runner.cfg"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// like remote connections, run the command line in a shell
+	oldStart := startRemote
+	startRemote = func(vs *ctx.Context, command vpath.VirtualPath, args []string, options connection.RunOptions) connection.Process {
+		return vs.Run(vpath.Local("/bin/sh"), []string{"-c", command.Path + " " + strings.Join(args, " ")}, options)
+	}
+	t.Cleanup(func() { startRemote = oldStart })
+
+	dir := t.TempDir()
+	vs := New(os.Stdin, &bytes.Buffer{}, &bytes.Buffer{}).TrackExits()
+	vs.execRemote(vpath.Local("/bin/sh"), []string{"-c", "exit 3"}, &connection.RunOptions{Cwd: vpath.Local(dir)})
+	assert.NoError(t, vs.Err)
+	vs.execRemote(vpath.Local("/bin/true"), nil, &connection.RunOptions{Cwd: vpath.Local(dir)})
+	assert.NoError(t, vs.Err)
+	assert.Equal(t, []Exit{
+		{Command: "localhost:/bin/sh", Code: 3},
+		{Command: "localhost:/bin/true", Code: 0},
+	}, vs.Exits())
+}
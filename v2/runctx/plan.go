@@ -0,0 +1,221 @@
+package runctx
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/meteocima/virtual-server/ctx"
+	"github.com/meteocima/virtual-server/vpath"
+)
+
+// Op is the kind of an operation recorded in a plan.
+type Op string
+
+const (
+	// OpMkDir - create a directory
+	OpMkDir Op = "mkdir"
+	// OpRmDir - remove a directory
+	OpRmDir Op = "rmdir"
+	// OpRmFile - remove a file
+	OpRmFile Op = "rm"
+	// OpLink - create a symbolic link
+	OpLink Op = "link"
+	// OpCopy - copy a file
+	OpCopy Op = "copy"
+	// OpWrite - write a file
+	OpWrite Op = "write"
+	// OpRender - render a namelist template
+	OpRender Op = "render"
+	// OpExec - execute a process
+	OpExec Op = "exec"
+)
+
+// Action is a single operation recorded in a plan.
+type Action struct {
+	Step    string   `json:"step,omitempty"`
+	Op      Op       `json:"op"`
+	From    string   `json:"from,omitempty"`
+	To      string   `json:"to,omitempty"`
+	Command string   `json:"command,omitempty"`
+	Args    []string `json:"args,omitempty"`
+	Cwd     string   `json:"cwd,omitempty"`
+}
+
+// String returns a single line
+// description of the action.
+func (action Action) String() string {
+	switch action.Op {
+	case OpLink, OpCopy, OpRender:
+		return fmt.Sprintf("%-6s %s -> %s", action.Op, action.From, action.To)
+	case OpExec:
+		cmd := strings.TrimSpace(action.Command + " " + strings.Join(action.Args, " "))
+		if action.Cwd == "" {
+			return fmt.Sprintf("%-6s %s", action.Op, cmd)
+		}
+		return fmt.Sprintf("%-6s %s (in %s)", action.Op, cmd, action.Cwd)
+	default:
+		return fmt.Sprintf("%-6s %s", action.Op, action.To)
+	}
+}
+
+// Plan is an ordered list of the operations
+// that a run would perform.
+type Plan struct {
+	// Step is the ID of the step currently
+	// recorded. It's copied in every action.
+	Step    string
+	Actions []Action
+
+	lock     sync.Mutex
+	files    map[string]bool
+	removed  map[string]bool
+	links    map[string]vpath.VirtualPath
+	execDirs map[string]bool
+}
+
+// NewPlan returns an empty plan.
+func NewPlan() *Plan {
+	return &Plan{
+		Actions:  []Action{},
+		files:    map[string]bool{},
+		removed:  map[string]bool{},
+		links:    map[string]vpath.VirtualPath{},
+		execDirs: map[string]bool{},
+	}
+}
+
+// WriteText writes the plan to `w`
+// as human readable text.
+func (plan *Plan) WriteText(w io.Writer) error {
+	step := ""
+	for idx, action := range plan.Actions {
+		if action.Step != step || idx == 0 {
+			step = action.Step
+			if _, err := fmt.Fprintf(w, "[%s]\n", step); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%5d  %s\n", idx+1, action.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes the plan to `w` in JSON format.
+func (plan *Plan) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(plan.Actions)
+}
+
+func key(file vpath.VirtualPath) string {
+	return path.Clean(file.Path)
+}
+
+func (plan *Plan) record(action Action) {
+	plan.lock.Lock()
+	defer plan.lock.Unlock()
+	action.Step = plan.Step
+	plan.Actions = append(plan.Actions, action)
+}
+
+func (plan *Plan) produce(file vpath.VirtualPath) {
+	plan.lock.Lock()
+	defer plan.lock.Unlock()
+	plan.files[key(file)] = true
+	delete(plan.removed, key(file))
+}
+
+func (plan *Plan) link(from, to vpath.VirtualPath) {
+	plan.lock.Lock()
+	defer plan.lock.Unlock()
+	plan.files[key(to)] = true
+	plan.links[key(to)] = from
+	delete(plan.removed, key(to))
+}
+
+func (plan *Plan) execIn(dir vpath.VirtualPath) {
+	plan.lock.Lock()
+	defer plan.lock.Unlock()
+	plan.execDirs[key(dir)] = true
+}
+
+func (plan *Plan) remove(file vpath.VirtualPath) {
+	plan.lock.Lock()
+	defer plan.lock.Unlock()
+	k := key(file)
+	plan.removed[k] = true
+	for f := range plan.files {
+		if f == k || strings.HasPrefix(f, k+"/") {
+			delete(plan.files, f)
+			delete(plan.links, f)
+		}
+	}
+	for d := range plan.execDirs {
+		if d == k || strings.HasPrefix(d, k+"/") {
+			delete(plan.execDirs, d)
+		}
+	}
+}
+
+// produced returns true if `file` is
+// written by an operation of the plan.
+func (plan *Plan) produced(file vpath.VirtualPath) bool {
+	plan.lock.Lock()
+	defer plan.lock.Unlock()
+	return plan.files[key(file)]
+}
+
+// resolvable returns true if `file` exists, or if it
+// would be produced by an operation already in the plan.
+// Files contained in a directory in which a process is
+// executed are supposed to be produced by that process.
+func (plan *Plan) resolvable(vs *ctx.Context, file vpath.VirtualPath) bool {
+	plan.lock.Lock()
+	k := key(file)
+	if plan.files[k] {
+		plan.lock.Unlock()
+		return true
+	}
+
+	for dir := k; dir != "/" && dir != "."; dir = path.Dir(dir) {
+		if plan.execDirs[dir] && dir != k {
+			plan.lock.Unlock()
+			return true
+		}
+		if plan.removed[dir] {
+			plan.lock.Unlock()
+			return false
+		}
+		if target, ok := plan.links[dir]; ok {
+			plan.lock.Unlock()
+			return plan.resolvable(vs, target.Join(strings.TrimPrefix(k, dir)))
+		}
+	}
+	plan.lock.Unlock()
+
+	return vs.Exists(file)
+}
+
+// mustResolve checks that `file` is resolvable, setting
+// vs.Err and returning false otherwise.
+func (plan *Plan) mustResolve(vs *ctx.Context, op string, file vpath.VirtualPath) bool {
+	if plan.resolvable(vs, file) {
+		return true
+	}
+	if vs.Err == nil {
+		vs.SetContextFailed("%s: cannot resolve `%s`: file does not exist and is not produced by previous steps", op, file.String())
+	}
+	return false
+}
+
+// isPathCommand returns false for commands
+// that are searched in the PATH of the host.
+func isPathCommand(command vpath.VirtualPath) bool {
+	return strings.Contains(command.Path, "/")
+}
@@ -0,0 +1,48 @@
+package runctx
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	vsConfig "github.com/meteocima/virtual-server/config"
+	"github.com/meteocima/virtual-server/connection"
+	"github.com/meteocima/virtual-server/vpath"
+	"github.com/meteocima/wrfda-runner/v2/internal/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanRecordsOperations(t *testing.T) {
+	err := vsConfig.Init(testutil.Fixture("testrun/wrfda-runner.cfg"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	vs := NewPlanning(os.Stdin, &bytes.Buffer{}, &bytes.Buffer{})
+	workdir := vpath.New("simulation", "/tmp/not-existent/wps")
+	prg := vpath.New("simulation", testutil.Fixture("testrun/WPSPrg"))
+
+	vs.Plan.Step = "BuildWPSDir"
+	vs.MkDir(workdir)
+	vs.Link(prg.Join("geogrid.exe"), workdir.Join("geogrid.exe"))
+	vs.Exec(workdir.Join("geogrid.exe"), []string{}, &connection.RunOptions{Cwd: workdir})
+
+	// produced by geogrid.exe
+	assert.True(t, vs.Exists(workdir.Join("geo_em.d01.nc")))
+	vs.Copy(workdir.Join("geo_em.d01.nc"), workdir.Join("copy.nc"))
+	assert.NoError(t, vs.Err)
+	assert.NoDirExists(t, workdir.Path)
+
+	var buf bytes.Buffer
+	assert.NoError(t, vs.Plan.WriteText(&buf))
+	assert.Equal(t, `[BuildWPSDir]
+    1  mkdir  simulation:/tmp/not-existent/wps
+    2  link   simulation:`+testutil.Fixture("testrun/WPSPrg/geogrid.exe")+` -> simulation:/tmp/not-existent/wps/geogrid.exe
+    3  exec   simulation:/tmp/not-existent/wps/geogrid.exe (in simulation:/tmp/not-existent/wps)
+    4  copy   simulation:/tmp/not-existent/wps/geo_em.d01.nc -> simulation:/tmp/not-existent/wps/copy.nc
+`, buf.String())
+
+	vs.Link(prg.Join("not-existent.exe"), workdir.Join("not-existent.exe"))
+	assert.Error(t, vs.Err)
+	assert.Equal(t, 4, len(vs.Plan.Actions))
+}
@@ -0,0 +1,230 @@
+// Package runctx contains the Context used by
+// the runner to operate on files and processes.
+//
+// A Context wraps a virtual-server ctx.Context. When
+// a Plan is attached to it, operations that modify files
+// or execute processes are recorded in the plan instead of
+// being executed, while read-only operations still access
+// the real file systems.
+package runctx
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/meteocima/virtual-server/connection"
+	"github.com/meteocima/virtual-server/ctx"
+	"github.com/meteocima/virtual-server/vpath"
+)
+
+// Context abstract the set of operations
+// on files and processes performed by the runner.
+type Context struct {
+	*ctx.Context
+
+	// Plan, if set, records operations
+	// instead of executing them.
+	Plan *Plan
+
+	// parent, if set, kills processes
+	// executed by Exec when it's done.
+	parent context.Context
+
+	// exits, if set, records the exit
+	// status of processes executed by Exec.
+	exits *exitLog
+}
+
+// New returns a Context that executes its
+// operations, using given standard streams.
+func New(stdin io.Reader, stdout io.Writer, stderr io.Writer) *Context {
+	return Wrap(ctx.New(stdin, stdout, stderr))
+}
+
+// Wrap returns a Context that executes its
+// operations using `vs`. The standard output and
+// error of `vs` are replaced with writers that
+// serialize the writes of the log and the ones
+// of the processes executed.
+func Wrap(vs *ctx.Context) *Context {
+	if _, ok := vs.GetStdOut().(*syncWriter); !ok {
+		lock := &sync.Mutex{}
+		vs.SetStdOut(&syncWriter{lock: lock, w: vs.GetStdOut()})
+		vs.SetStdErr(&syncWriter{lock: lock, w: vs.GetStdErr()})
+	}
+	return &Context{Context: vs}
+}
+
+// syncWriter serializes the writes to w. The standard
+// output and error of a Context share the same lock,
+// since they often are the same writer.
+type syncWriter struct {
+	lock *sync.Mutex
+	w    io.Writer
+}
+
+func (sw *syncWriter) Write(p []byte) (int, error) {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+	return sw.w.Write(p)
+}
+
+// NewPlanning returns a Context that records its
+// operations in a new, empty plan.
+func NewPlanning(stdin io.Reader, stdout io.Writer, stderr io.Writer) *Context {
+	vs := New(stdin, stdout, stderr)
+	vs.Plan = NewPlan()
+	return vs
+}
+
+// Clone returns a new Context that shares
+// the standard streams, the plan and the
+// context.Context of `vs`, but has its own Err.
+// The exit status of its processes is tracked
+// together with the ones of `vs`.
+func (vs *Context) Clone() *Context {
+	return &Context{
+		Context: vs.Context.Clone(),
+		Plan:    vs.Plan,
+		parent:  vs.parent,
+		exits:   vs.exits,
+	}
+}
+
+// Exists ...
+func (vs *Context) Exists(file vpath.VirtualPath) bool {
+	if vs.Plan == nil {
+		return vs.Context.Exists(file)
+	}
+	return vs.Plan.resolvable(vs.Context, file)
+}
+
+// IsFile ...
+func (vs *Context) IsFile(file vpath.VirtualPath) bool {
+	if vs.Plan == nil {
+		return vs.Context.IsFile(file)
+	}
+	return vs.Plan.resolvable(vs.Context, file)
+}
+
+// ReadString ...
+func (vs *Context) ReadString(file vpath.VirtualPath) string {
+	if vs.Plan == nil || vs.Err != nil {
+		return vs.Context.ReadString(file)
+	}
+
+	if vs.Plan.produced(file) {
+		// the file would be written by a
+		// previous operation of the plan.
+		return ""
+	}
+
+	return vs.Context.ReadString(file)
+}
+
+// WriteString ...
+func (vs *Context) WriteString(file vpath.VirtualPath, content string) {
+	if vs.Plan == nil || vs.Err != nil {
+		vs.Context.WriteString(file, content)
+		return
+	}
+	vs.Plan.record(Action{Op: OpWrite, To: file.String()})
+	vs.Plan.produce(file)
+}
+
+// WriteRendered writes to `target` the `content` of a
+// namelist rendered from template `tmpl`.
+func (vs *Context) WriteRendered(tmpl, target vpath.VirtualPath, content string) {
+	if vs.Plan == nil || vs.Err != nil {
+		vs.Context.WriteString(target, content)
+		return
+	}
+	vs.Plan.record(Action{Op: OpRender, From: tmpl.String(), To: target.String()})
+	vs.Plan.produce(target)
+}
+
+// MkDir ...
+func (vs *Context) MkDir(dir vpath.VirtualPath) {
+	if vs.Plan == nil || vs.Err != nil {
+		vs.Context.MkDir(dir)
+		return
+	}
+	vs.Plan.record(Action{Op: OpMkDir, To: dir.String()})
+	vs.Plan.produce(dir)
+}
+
+// RmDir ...
+func (vs *Context) RmDir(dir vpath.VirtualPath) {
+	if vs.Plan == nil || vs.Err != nil {
+		vs.Context.RmDir(dir)
+		return
+	}
+	vs.Plan.record(Action{Op: OpRmDir, To: dir.String()})
+	vs.Plan.remove(dir)
+}
+
+// RmFile ...
+func (vs *Context) RmFile(file vpath.VirtualPath) {
+	if vs.Plan == nil || vs.Err != nil {
+		vs.Context.RmFile(file)
+		return
+	}
+	vs.Plan.record(Action{Op: OpRmFile, To: file.String()})
+	vs.Plan.remove(file)
+}
+
+// Link ...
+func (vs *Context) Link(from, to vpath.VirtualPath) {
+	if vs.Plan == nil || vs.Err != nil {
+		vs.Context.Link(from, to)
+		return
+	}
+	if !vs.Plan.mustResolve(vs.Context, "Link", from) {
+		return
+	}
+	vs.Plan.record(Action{Op: OpLink, From: from.String(), To: to.String()})
+	vs.Plan.link(from, to)
+}
+
+// Copy ...
+func (vs *Context) Copy(from, to vpath.VirtualPath) {
+	if vs.Plan == nil || vs.Err != nil {
+		vs.Context.Copy(from, to)
+		return
+	}
+	if !vs.Plan.mustResolve(vs.Context, "Copy", from) {
+		return
+	}
+	vs.Plan.record(Action{Op: OpCopy, From: from.String(), To: to.String()})
+	vs.Plan.produce(to)
+}
+
+// Exec ...
+func (vs *Context) Exec(command vpath.VirtualPath, args []string, options *connection.RunOptions) {
+	if vs.Plan == nil && vs.Err == nil {
+		vs.execInContext(command, args, options)
+		return
+	}
+	if vs.Err != nil {
+		return
+	}
+
+	action := Action{
+		Op:      OpExec,
+		Command: command.String(),
+		Args:    args,
+	}
+	if options != nil {
+		action.Cwd = options.Cwd.String()
+	}
+
+	if isPathCommand(command) && !vs.Plan.mustResolve(vs.Context, "Exec", command) {
+		return
+	}
+
+	vs.Plan.record(action)
+	if options != nil {
+		vs.Plan.execIn(options.Cwd)
+	}
+}
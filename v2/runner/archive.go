@@ -0,0 +1,162 @@
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/meteocima/virtual-server/connection"
+	"github.com/meteocima/virtual-server/vpath"
+	"github.com/meteocima/wrfda-runner/v2/conf"
+	"github.com/meteocima/wrfda-runner/v2/grib"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
+)
+
+// archiveFiles returns the files of `src` in `dir`: the
+// ones matching its glob, or all files if it has none.
+func archiveFiles(vs *runctx.Context, src *conf.UngribSource, dir vpath.VirtualPath) []vpath.VirtualPath {
+	if vs.Err != nil {
+		return nil
+	}
+	if !vs.Exists(dir) {
+		vs.Err = fmt.Errorf("directory `%s` not found", dir.String())
+		return nil
+	}
+
+	files := []vpath.VirtualPath{}
+	for _, file := range vs.ReadDir(dir) {
+		if src.Glob != "" {
+			if ok, _ := path.Match(src.Glob, path.Base(file.Path)); !ok {
+				continue
+			}
+		}
+		if vs.IsFile(file) {
+			files = append(files, file)
+		}
+	}
+	if vs.Err == nil && len(files) == 0 {
+		if src.Glob != "" {
+			vs.Err = fmt.Errorf("no files matching `%s` found in `%s`", src.Glob, dir.String())
+		} else {
+			vs.Err = fmt.Errorf("no files found in `%s`", dir.String())
+		}
+	}
+	return files
+}
+
+// scanGribFile returns the valid times
+// of all messages in GRIB `file`.
+func scanGribFile(file vpath.VirtualPath) ([]time.Time, error) {
+	conn, err := connection.FindHost(file.Host)
+	if err != nil {
+		return nil, err
+	}
+	r, err := conn.OpenReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	msgs, err := grib.Scan(r)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]time.Time, len(msgs))
+	for idx, msg := range msgs {
+		res[idx] = msg.Valid
+	}
+	return res, nil
+}
+
+// checkArchive verifies, reading the headers of the GRIB
+// files of `src` in `dir`, that fields valid at every
+// `src.StepHours` hours from `from` to `to` are present.
+// When `src` has no glob, files that contain no GRIB
+// messages are skipped.
+func checkArchive(vs *runctx.Context, src *conf.UngribSource, dir vpath.VirtualPath, from, to time.Time) {
+	if vs.Err != nil {
+		return
+	}
+	if src.StepHours <= 0 {
+		vs.Err = fmt.Errorf("invalid StepHours %d for source %s", src.StepHours, src.Prefix)
+		return
+	}
+	files := archiveFiles(vs, src, dir)
+	if vs.Err != nil {
+		return
+	}
+	vs.LogInfo("Check GRIB archive `%s` of source %s", dir.String(), src.Prefix)
+
+	found := map[time.Time]bool{}
+	for _, file := range files {
+		validTimes, err := scanGribFile(file)
+		if src.Glob == "" && errors.Is(err, grib.ErrNoMessages) {
+			// without a glob, all files of the directory are
+			// used, including indexes or other non GRIB files.
+			vs.LogInfo("Skip `%s`: not a GRIB file", file.String())
+			continue
+		}
+		if err != nil {
+			vs.Err = fmt.Errorf("cannot scan GRIB file `%s`: %w", file.String(), err)
+			return
+		}
+		for _, valid := range validTimes {
+			found[valid.UTC()] = true
+		}
+	}
+
+	missing := []string{}
+	step := time.Duration(src.StepHours) * time.Hour
+	for dt := from; !dt.After(to); dt = dt.Add(step) {
+		if !found[dt.UTC()] {
+			missing = append(missing, dt.Format("2006010215"))
+		}
+	}
+	if len(missing) > 0 {
+		vs.Err = fmt.Errorf(
+			"GRIB archive `%s` of source %s is incomplete: missing fields valid at %s",
+			dir.String(), src.Prefix, strings.Join(missing, ", "),
+		)
+	}
+}
+
+// selectGuidingRun returns the archive directory and the reference
+// time of the most recent guiding run of `src` whose files cover
+// the period from `from` to `to`. The latest run starting at or
+// before `from`, according to the schedule of runs every
+// `src.RunInterval` hours, is tried first, followed by the
+// `src.Fallback` previous ones.
+func selectGuidingRun(vs *runctx.Context, src *conf.UngribSource, from, to time.Time) (vpath.VirtualPath, time.Time) {
+	if vs.Err != nil {
+		return vpath.VirtualPath{}, time.Time{}
+	}
+
+	interval := time.Duration(src.RunInterval) * time.Hour
+	latest := from.Truncate(interval)
+	problems := []string{}
+	for candidate := 0; candidate <= src.Fallback; candidate++ {
+		run := latest.Add(-time.Duration(candidate) * interval)
+		dir := src.ArchiveDir(run)
+
+		cvs := vs.Clone()
+		checkArchive(cvs, src, dir, from, to)
+		if cvs.Err == nil {
+			if candidate > 0 {
+				vs.LogInfo("Source %s: using guiding run %s, %d runs before the latest", src.Prefix, run.Format("2006010215"), candidate)
+			}
+			return dir, run
+		}
+
+		vs.LogInfo("Source %s: guiding run %s not usable: %s", src.Prefix, run.Format("2006010215"), cvs.Err)
+		problems = append(problems, fmt.Sprintf("run %s: %s", run.Format("2006010215"), cvs.Err))
+	}
+
+	vs.Err = fmt.Errorf(
+		"no guiding run of source %s covers the period from %s to %s:\n  %s",
+		src.Prefix, from.Format("2006010215"), to.Format("2006010215"), strings.Join(problems, "\n  "),
+	)
+	return vpath.VirtualPath{}, time.Time{}
+}
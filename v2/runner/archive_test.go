@@ -0,0 +1,136 @@
+package runner
+
+import (
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/meteocima/wrfda-runner/v2/conf"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
+	"github.com/stretchr/testify/assert"
+)
+
+// grib1Message returns a minimal GRIB1 message
+// with reference time `ref` and forecast step `hours`.
+func grib1Message(ref time.Time, hours byte) []byte {
+	pds := make([]byte, 28)
+	pds[2] = 28
+	pds[12] = byte(ref.Year() % 100)
+	pds[13] = byte(ref.Month())
+	pds[14] = byte(ref.Day())
+	pds[15] = byte(ref.Hour())
+	pds[17] = 1
+	pds[18] = hours
+	pds[24] = byte(ref.Year()/100 + 1)
+
+	bds := make([]byte, 20)
+	bds[2] = 20
+
+	length := 8 + len(pds) + len(bds) + 4
+	msg := []byte{'G', 'R', 'I', 'B', 0, 0, byte(length), 1}
+	msg = append(msg, pds...)
+	msg = append(msg, bds...)
+	return append(msg, "7777"...)
+}
+
+func TestCheckArchive(t *testing.T) {
+	dir, wd := initTestrun(t, "")
+
+	ref := time.Date(2020, 12, 24, 18, 0, 0, 0, time.UTC)
+	writeGrib := func(name string, steps ...byte) {
+		content := []byte{}
+		for _, step := range steps {
+			content = append(content, grib1Message(ref, step)...)
+		}
+		assert.NoError(t, os.WriteFile(path.Join(dir, name), content, 0644))
+	}
+	writeGrib("gfs.f000", 0, 3)
+	writeGrib("gfs.f006", 6, 9)
+
+	src := &conf.UngribSource{Prefix: "FILE", Glob: "gfs.*", StepHours: 3}
+	vs := runctx.New(os.Stdin, io.Discard, io.Discard)
+	checkArchive(vs, src, wd, ref, ref.Add(9*time.Hour))
+	assert.NoError(t, vs.Err)
+
+	checkArchive(vs, src, wd, ref, ref.Add(15*time.Hour))
+	assert.EqualError(t, vs.Err, "GRIB archive `localhost:"+dir+"` of source FILE is incomplete: missing fields valid at 2020122506, 2020122509")
+
+	vs.Err = nil
+	writeGrib("gfs.f012")
+	checkArchive(vs, src, wd, ref, ref.Add(9*time.Hour))
+	assert.EqualError(t, vs.Err, "cannot scan GRIB file `localhost:"+dir+"/gfs.f012`: no GRIB messages found")
+
+	// without a glob, files that are not GRIB are skipped
+	vs.Err = nil
+	assert.NoError(t, os.Remove(path.Join(dir, "gfs.f012")))
+	assert.NoError(t, os.WriteFile(path.Join(dir, "gfs.f000.idx"), []byte("1:0:d=2020122418:HGT:1000 mb:anl:\n"), 0644))
+	src.Glob = ""
+	checkArchive(vs, src, wd, ref, ref.Add(9*time.Hour))
+	assert.NoError(t, vs.Err)
+
+	src.Glob = "ifs.*"
+	checkArchive(vs, src, wd, ref, ref.Add(9*time.Hour))
+	assert.EqualError(t, vs.Err, "no files matching `ifs.*` found in `localhost:"+dir+"`")
+}
+
+func TestSelectGuidingRun(t *testing.T) {
+	dir, _ := initTestrun(t, "\n[Datasets.TEST]\n    Vtable = \"Vtable.TEST\"\n    Archive = \"gfs/2006010215\"\n")
+	dataset, err := conf.Dataset("TEST")
+	if !assert.NoError(t, err) {
+		return
+	}
+	src := &dataset.UngribSource
+
+	first := time.Date(2020, 12, 24, 18, 0, 0, 0, time.UTC)
+	writeRun := func(ref time.Time, steps ...byte) {
+		runDir := path.Join(dir, "gfs", ref.Format("2006010215"))
+		assert.NoError(t, os.MkdirAll(runDir, 0755))
+		content := []byte{}
+		for _, step := range steps {
+			content = append(content, grib1Message(ref, step)...)
+		}
+		assert.NoError(t, os.WriteFile(path.Join(runDir, "gfs.grib"), content, 0644))
+	}
+	// latest run is incomplete, the previous one is
+	// missing, the one before covers the period.
+	writeRun(first, 0, 3)
+	writeRun(first.Add(-18*time.Hour), 18, 21, 24, 27)
+	to := first.Add(9 * time.Hour)
+
+	vs := runctx.New(os.Stdin, io.Discard, io.Discard)
+	_, run := selectGuidingRun(vs, src, first, to)
+	assert.Error(t, vs.Err)
+	assert.True(t, run.IsZero())
+
+	vs.Err = nil
+	src.Fallback = 3
+	runDir, run := selectGuidingRun(vs, src, first, to)
+	if !assert.NoError(t, vs.Err) {
+		return
+	}
+	assert.Equal(t, first.Add(-18*time.Hour), run)
+	assert.Equal(t, path.Join(dir, "gfs/2020122400"), runDir.Path)
+
+	vs.Err = nil
+	src.Fallback = 2
+	selectGuidingRun(vs, src, first, to)
+	assert.EqualError(t, vs.Err, "no guiding run of source FILE covers the period from 2020122418 to 2020122503:\n"+
+		"  run 2020122418: GRIB archive `localhost:"+dir+"/gfs/2020122418` of source FILE is incomplete: missing fields valid at 2020122500, 2020122503\n"+
+		"  run 2020122412: directory `localhost:"+dir+"/gfs/2020122412` not found\n"+
+		"  run 2020122406: directory `localhost:"+dir+"/gfs/2020122406` not found")
+
+	// with hourly cycles, the first one doesn't start at
+	// the time of a guiding run: runs are taken from the
+	// schedule, using lead times that cover the cycle.
+	vs.Err = nil
+	src.Fallback = 0
+	writeRun(first.Add(-6*time.Hour), 3, 6, 9, 12, 15)
+	runDir, run = selectGuidingRun(vs, src, first.Add(-3*time.Hour), to)
+	if !assert.NoError(t, vs.Err) {
+		return
+	}
+	assert.Equal(t, first.Add(-6*time.Hour), run)
+	assert.Equal(t, path.Join(dir, "gfs/2020122412"), runDir.Path)
+}
@@ -0,0 +1,376 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/meteocima/virtual-server/vpath"
+	"github.com/meteocima/wrfda-runner/v2/conf"
+	"github.com/meteocima/wrfda-runner/v2/folders"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
+	"github.com/parro-it/fileargs"
+)
+
+// jobKinds maps the name of each step to
+// the kind of the batch job that runs it.
+var jobKinds = map[string]string{
+	"BuildWPSDir":    "WPS",
+	"RunWPS":         "WPS",
+	"RunReal":        "Real",
+	"BuildDAStepDir": "DA",
+	"RunDAStep":      "DA",
+	"BuildWRFDir":    "WRF",
+	"RunWRFStep":     "WRF",
+}
+
+// batchJob is a group of consecutive steps of
+// the run for a date, run by a single batch job.
+type batchJob struct {
+	// Name identifies the job, e.g. WPS or DA-2
+	Name  string
+	Kind  string
+	Cycle int
+	Steps []*step
+}
+
+// batchJobs groups `steps` in batch jobs. Steps
+// that don't belong to any kind of job, like
+// BuildWorkdir, run in the following job.
+func batchJobs(steps []*step) []*batchJob {
+	jobs := []*batchJob{}
+	pending := []*step{}
+	var last *batchJob
+	for _, s := range steps {
+		parts := strings.SplitN(s.ID, "-", 2)
+		kind, ok := jobKinds[parts[0]]
+		if !ok {
+			pending = append(pending, s)
+			continue
+		}
+
+		name := kind
+		cycle := 0
+		if len(parts) == 2 {
+			cycle, _ = strconv.Atoi(parts[1])
+			name = fmt.Sprintf("%s-%d", kind, cycle)
+		}
+		if last == nil || last.Name != name {
+			last = &batchJob{Name: name, Kind: kind, Cycle: cycle}
+			jobs = append(jobs, last)
+		}
+		last.Steps = append(last.Steps, pending...)
+		last.Steps = append(last.Steps, s)
+		pending = []*step{}
+	}
+	return jobs
+}
+
+// completed returns true if all steps
+// of the job are recorded in `state`.
+func (job *batchJob) completed(state *RunState) bool {
+	for _, s := range job.Steps {
+		if !state.IsCompleted(s.ID) {
+			return false
+		}
+	}
+	return true
+}
+
+// procCount converts a process count of the
+// configuration to a number. Empty counts are 1.
+func procCount(count string) (int, error) {
+	if count == "" {
+		return 1, nil
+	}
+	procs, err := strconv.Atoi(count)
+	if err != nil || procs < 1 {
+		return 0, fmt.Errorf("invalid process count `%s`", count)
+	}
+	return procs, nil
+}
+
+// procs returns the number of processes requested
+// by the job: the largest one among its programs,
+// or the sum of all domains for parallel WRFDA.
+func (job *batchJob) procs(vs *runctx.Context, domainCount int) int {
+	if vs.Err != nil {
+		return 0
+	}
+	var counts []string
+	switch job.Kind {
+	case "WPS":
+		counts = []string{conf.Config.Procs.GeogridProcCount, conf.Config.Procs.MetgridProcCount}
+	case "Real":
+		counts = []string{conf.Config.Procs.RealProcCount}
+	case "DA":
+		counts = daProcCounts(vs, domainCount)
+	case "WRF":
+		counts = []string{conf.Config.Procs.Wrf(job.Cycle)}
+	}
+
+	result := 1
+	sum := 0
+	for _, count := range counts {
+		procs, err := procCount(count)
+		if err != nil {
+			vs.Err = fmt.Errorf("cannot submit job %s: %w", job.Name, err)
+			return 0
+		}
+		sum += procs
+		if procs > result {
+			result = procs
+		}
+	}
+	if job.Kind == "DA" && conf.Config.Procs.ParallelDA {
+		return sum
+	}
+	return result
+}
+
+// scheduler submits jobs to a batch system.
+type scheduler interface {
+	// directives returns the lines of the job script
+	// that request the resources of the job.
+	directives(name string, procs int, wallTime string, logFile vpath.VirtualPath) []string
+	// submit submits `script`, to be run after successful
+	// completion of jobs `after`, and returns the job ID.
+	submit(vs *runctx.Context, script vpath.VirtualPath, after []string) string
+	// queued returns the IDs of all jobs
+	// queued or running in the batch system.
+	queued(vs *runctx.Context, dir vpath.VirtualPath) map[string]bool
+}
+
+// nodes returns the number of nodes needed to run
+// `procs` processes, and the processes per node.
+func nodes(procs int) (int, int) {
+	perNode := conf.Config.Procs.CoresPerNode
+	if perNode <= 0 || procs < perNode {
+		return 1, procs
+	}
+	return (procs + perNode - 1) / perNode, perNode
+}
+
+type slurm struct{}
+
+func (slurm) directives(name string, procs int, wallTime string, logFile vpath.VirtualPath) []string {
+	nodeCount, _ := nodes(procs)
+	lines := []string{
+		"#SBATCH --job-name=" + name,
+		fmt.Sprintf("#SBATCH --ntasks=%d", procs),
+		fmt.Sprintf("#SBATCH --nodes=%d", nodeCount),
+		"#SBATCH --time=" + wallTime,
+		"#SBATCH --output=" + logFile.Path,
+	}
+	if conf.Config.Batch.Queue != "" {
+		lines = append(lines, "#SBATCH --partition="+conf.Config.Batch.Queue)
+	}
+	if conf.Config.Batch.Account != "" {
+		lines = append(lines, "#SBATCH --account="+conf.Config.Batch.Account)
+	}
+	return lines
+}
+
+func (slurm) submit(vs *runctx.Context, script vpath.VirtualPath, after []string) string {
+	args := []string{"--parsable"}
+	if len(after) > 0 {
+		args = append(args, "--dependency=afterok:"+strings.Join(after, ":"))
+	}
+	args = append(args, script.Path)
+	out := vs.Output(vpath.New(script.Host, "sbatch"), args, script.Dir())
+	// --parsable prints "id" or "id;cluster"
+	return strings.TrimSpace(strings.SplitN(out, ";", 2)[0])
+}
+
+func (slurm) queued(vs *runctx.Context, dir vpath.VirtualPath) map[string]bool {
+	out := vs.Output(vpath.New(dir.Host, "squeue"), []string{"-h", "-o", "%i"}, dir)
+	ids := map[string]bool{}
+	for _, line := range strings.Fields(out) {
+		ids[line] = true
+	}
+	return ids
+}
+
+type pbs struct{}
+
+func (pbs) directives(name string, procs int, wallTime string, logFile vpath.VirtualPath) []string {
+	nodeCount, perNode := nodes(procs)
+	lines := []string{
+		"#PBS -N " + name,
+		fmt.Sprintf("#PBS -l select=%d:ncpus=%d:mpiprocs=%d", nodeCount, perNode, perNode),
+		"#PBS -l walltime=" + wallTime,
+		"#PBS -j oe",
+		"#PBS -o " + logFile.Path,
+	}
+	if conf.Config.Batch.Queue != "" {
+		lines = append(lines, "#PBS -q "+conf.Config.Batch.Queue)
+	}
+	if conf.Config.Batch.Account != "" {
+		lines = append(lines, "#PBS -A "+conf.Config.Batch.Account)
+	}
+	return lines
+}
+
+func (pbs) submit(vs *runctx.Context, script vpath.VirtualPath, after []string) string {
+	args := []string{}
+	if len(after) > 0 {
+		args = append(args, "-W", "depend=afterok:"+strings.Join(after, ":"))
+	}
+	args = append(args, script.Path)
+	return strings.TrimSpace(vs.Output(vpath.New(script.Host, "qsub"), args, script.Dir()))
+}
+
+func (pbs) queued(vs *runctx.Context, dir vpath.VirtualPath) map[string]bool {
+	out := vs.Output(vpath.New(dir.Host, "qstat"), []string{}, dir)
+	ids := map[string]bool{}
+	for _, line := range strings.Split(out, "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			ids[fields[0]] = true
+		}
+	}
+	return ids
+}
+
+func configuredScheduler() (scheduler, error) {
+	switch conf.Config.Batch.Scheduler {
+	case conf.SLURM:
+		return slurm{}, nil
+	case conf.PBS:
+		return pbs{}, nil
+	}
+	return nil, fmt.Errorf("Scheduler is not configured in the Batch section")
+}
+
+// jobScript returns the content of the script of `job`
+// of the run from `start` to `end`, that runs with
+// configuration `cfgFile`.
+func jobScript(sched scheduler, job *batchJob, procs int, cfgFile, workdir vpath.VirtualPath, phase conf.RunPhase, input conf.InputDataset, start, end time.Time) string {
+	command := conf.Config.Batch.Command
+	if command == "" {
+		command, _ = os.Executable()
+	}
+	name := fmt.Sprintf("wrfda-%s-%s", start.Format("2006010215"), job.Name)
+	logFile := folders.JobsDir(start).Join("%s.log", job.Name)
+
+	lines := []string{"#!/bin/bash"}
+	lines = append(lines, sched.directives(name, procs, conf.Config.Batch.JobWallTime(job.Kind), logFile)...)
+	lines = append(lines, conf.Config.Batch.Directives...)
+	lines = append(lines,
+		"",
+		"cd "+workdir.Path,
+		fmt.Sprintf("exec %s -cfg %s -p %s -i %s -job %s %s %s %s",
+			command, cfgFile.Path, phase, input, job.Name, workdir.Path,
+			start.Format("2006010215"), end.Format("2006010215")),
+		"",
+	)
+	return strings.Join(lines, "\n")
+}
+
+// SubmitBatch writes the script of a batch job for each group of
+// steps of the runs of `periods`, and when `submit` is true submits
+// them to the scheduler configured in the Batch section. Each job
+// runs after the successful completion of the previous one. Jobs
+// whose steps are all completed are skipped. The ID of submitted
+// jobs is recorded in the run state of each date, and submission
+// fails if any job recorded is still queued or running. Jobs run
+// with configuration `cfgFile`, that must be the one in use.
+func SubmitBatch(periods []*fileargs.Period, cfgFile, workdir vpath.VirtualPath, phase conf.RunPhase, input conf.InputDataset, submit bool,
+	logWriter io.Writer, detailLogWriter io.Writer,
+) error {
+	sched, err := configuredScheduler()
+	if err != nil {
+		return err
+	}
+
+	vs := runctx.New(os.Stdin, logWriter, detailLogWriter)
+	domainCount := ReadDomainCount(vs, phase)
+
+	var queued map[string]bool
+	if submit {
+		queued = sched.queued(vs, workdir)
+	}
+
+	previous := []string{}
+	for _, period := range periods {
+		start := period.Start
+		end := start.Add(period.Duration)
+
+		state := ReadRunState(vs, start)
+		if vs.Err != nil {
+			return vs.Err
+		}
+		if submit {
+			for _, job := range state.Jobs {
+				if queued[job.ID] {
+					return fmt.Errorf("job %s (%s) of run %s is still queued: cancel it before submitting the run again",
+						job.Name, job.ID, start.Format("2006010215"))
+				}
+			}
+			state.Jobs = nil
+		}
+
+		jobsDir := folders.JobsDir(start)
+		vs.MkDir(jobsDir)
+		for _, job := range batchJobs(planSteps(state, phase, start, end, input, domainCount)) {
+			if job.completed(state) {
+				vs.LogInfo("Skipping job %s: already completed", job.Name)
+				continue
+			}
+
+			script := jobsDir.Join("%s.sh", job.Name)
+			vs.WriteString(script, jobScript(sched, job, job.procs(vs, domainCount), cfgFile, workdir, phase, input, start, end))
+			if !submit {
+				vs.LogInfo("Job %s written to `%s`", job.Name, script.String())
+				continue
+			}
+
+			id := sched.submit(vs, script, previous)
+			if vs.Err != nil {
+				state.Save(vs.Clone())
+				return vs.Err
+			}
+			if id == "" {
+				return fmt.Errorf("cannot read ID of job %s submitted from `%s`", job.Name, script.String())
+			}
+			vs.LogInfo("Job %s submitted with ID %s", job.Name, id)
+			state.Jobs = append(state.Jobs, &BatchJob{Name: job.Name, ID: id, Submitted: time.Now().UTC()})
+			previous = []string{id}
+		}
+		state.Save(vs)
+	}
+
+	return vs.Err
+}
+
+// RunJob executes the steps of batch job `name` of the run from
+// `start` to `end`, skipping the ones already completed like a
+// resumed run, and records them in the run state. When `ctx`
+// is cancelled, the job is interrupted like Run does.
+func RunJob(ctx context.Context, start, end time.Time, workdir vpath.VirtualPath, phase conf.RunPhase, input conf.InputDataset, name string,
+	logWriter io.Writer, detailLogWriter io.Writer,
+) error {
+	vs := runctx.New(os.Stdin, logWriter, detailLogWriter).WithContext(ctx)
+	if !vs.Exists(workdir) {
+		return fmt.Errorf("directory not found: %s", workdir.String())
+	}
+	domainCount := ReadDomainCount(vs, phase)
+	state := ReadRunState(vs, start)
+	if vs.Err != nil {
+		return vs.Err
+	}
+
+	names := []string{}
+	for _, job := range batchJobs(planSteps(state, phase, start, end, input, domainCount)) {
+		if job.Name == name {
+			vs.LogInfo("STARTING JOB %s FOR DATE %s", name, start.Format("2006010215"))
+			runSteps(vs, state, job.Steps, true)
+			return vs.Err
+		}
+		names = append(names, job.Name)
+	}
+	return fmt.Errorf("unknown job `%s`, jobs of the run are: %s", name, strings.Join(names, ", "))
+}
@@ -0,0 +1,130 @@
+package runner
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meteocima/virtual-server/vpath"
+	"github.com/meteocima/wrfda-runner/v2/conf"
+	"github.com/meteocima/wrfda-runner/v2/internal/testutil"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
+	"github.com/parro-it/fileargs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubmitBatch(t *testing.T) {
+	dir, wd := initTestrun(t, "\n[Procs]\n    CoresPerNode = 36\n    WrfdaProcCount = \"72\"\n    WrfCycleProcCount = [\"\", \"\", \"144\"]\n"+
+		"\n[Batch]\n    Scheduler = \"slurm\"\n    Queue = \"meteo\"\n    Command = \"/opt/bin/wrfda-run\"\n"+
+		"    Directives = [\"#SBATCH --exclusive\"]\n[Batch.WallTimes]\n    WRF = \"12:00:00\"\n")
+
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", testutil.Fixture("testbin")+":"+oldPath)
+	sbatchLog := path.Join(dir, "sbatch.log")
+	os.Setenv("FAKE_SBATCH_LOG", sbatchLog)
+	os.Setenv("FAKE_SQUEUE_JOBS", path.Join(dir, "squeue.jobs"))
+	t.Cleanup(func() {
+		os.Setenv("PATH", oldPath)
+		os.Unsetenv("FAKE_SBATCH_LOG")
+		os.Unsetenv("FAKE_SQUEUE_JOBS")
+	})
+
+	start := time.Date(2020, 12, 25, 0, 0, 0, 0, time.UTC)
+	periods := []*fileargs.Period{{Start: start, Duration: 48 * time.Hour}}
+
+	// the run is resumed after WPS
+	vs := runctx.New(os.Stdin, io.Discard, io.Discard)
+	state := NewRunState(start)
+	for _, id := range []string{"BuildWorkdir", "BuildWPSDir", "RunWPS"} {
+		state.SetStatus(id, StepCompleted)
+	}
+	state.Save(vs)
+	assert.NoError(t, vs.Err)
+
+	err := SubmitBatch(periods, wd.Join("wrfda-runner.cfg"), wd, conf.WPSThenDAPhase, conf.GFS, true, io.Discard, io.Discard)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	content, err := os.ReadFile(sbatchLog)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	names := []string{"Real-1", "Real-2", "Real-3", "DA-1", "WRF-1", "DA-2", "WRF-2", "DA-3", "WRF-3"}
+	if !assert.Len(t, lines, len(names)) {
+		return
+	}
+	jobsDir := path.Join(dir, "20201225", "jobs")
+	assert.Equal(t, "1000 --parsable "+jobsDir+"/Real-1.sh", lines[0])
+	assert.Equal(t, "1004 --parsable --dependency=afterok:1003 "+jobsDir+"/WRF-1.sh", lines[4])
+
+	script, err := os.ReadFile(path.Join(jobsDir, "WRF-3.sh"))
+	assert.NoError(t, err)
+	assert.Equal(t, "#!/bin/bash\n"+
+		"#SBATCH --job-name=wrfda-2020122500-WRF-3\n"+
+		"#SBATCH --ntasks=144\n"+
+		"#SBATCH --nodes=4\n"+
+		"#SBATCH --time=12:00:00\n"+
+		"#SBATCH --output="+jobsDir+"/WRF-3.log\n"+
+		"#SBATCH --partition=meteo\n"+
+		"#SBATCH --exclusive\n"+
+		"\n"+
+		"cd "+dir+"\n"+
+		"exec /opt/bin/wrfda-run -cfg "+dir+"/wrfda-runner.cfg -p WPSDA -i GFS -job WRF-3 "+dir+" 2020122500 2020122700\n", string(script))
+
+	state = ReadRunState(vs, start)
+	if assert.Len(t, state.Jobs, len(names)) {
+		for idx, job := range state.Jobs {
+			assert.Equal(t, names[idx], job.Name)
+		}
+		assert.Equal(t, "1003", state.Jobs[3].ID)
+	}
+
+	// a job of the chain is still queued
+	assert.NoError(t, os.WriteFile(path.Join(dir, "squeue.jobs"), []byte("999\n1005\n"), 0644))
+	err = SubmitBatch(periods, wd.Join("wrfda-runner.cfg"), wd, conf.WPSThenDAPhase, conf.GFS, true, io.Discard, io.Discard)
+	assert.EqualError(t, err, "job DA-2 (1005) of run 2020122500 is still queued: cancel it before submitting the run again")
+
+	err = RunJob(context.Background(), start, start.Add(48*time.Hour), wd, conf.WPSThenDAPhase, conf.GFS, "DA-4", io.Discard, io.Discard)
+	assert.EqualError(t, err, "unknown job `DA-4`, jobs of the run are: WPS, Real-1, Real-2, Real-3, DA-1, WRF-1, DA-2, WRF-2, DA-3, WRF-3")
+
+	directives := pbs{}.directives("wrfda-2020122500-DA-1", 72, "01:00:00", vpath.Local("/jobs/DA-1.log"))
+	assert.Contains(t, directives, "#PBS -l select=2:ncpus=36:mpiprocs=36")
+	assert.Contains(t, directives, "#PBS -q meteo")
+}
+
+func TestSubmitBatchFromArguments(t *testing.T) {
+	dir := testutil.CopyTestrun(t, nil)
+	cfgPath := path.Join(dir, "italy-config.gfs.cfg")
+	assert.NoError(t, os.Rename(path.Join(dir, "wrfda-runner.cfg"), cfgPath))
+	testutil.AppendToFile(t, cfgPath, "\n[Batch]\n    Scheduler = \"slurm\"\n    Command = \"/opt/bin/wrfda-run\"\n")
+	assert.NoError(t, os.Mkdir(path.Join(dir, "inputs"), 0755))
+	assert.NoError(t, os.WriteFile(path.Join(dir, "inputs", "arguments.txt"), []byte("italy-config.gfs.cfg\n2020122500 48\n"), 0644))
+
+	// arguments.txt is read from the current directory
+	oldWd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(dir))
+	t.Cleanup(func() { os.Chdir(oldWd) })
+
+	dates, err := ReadTimes("inputs/arguments.txt")
+	if !assert.NoError(t, err) {
+		return
+	}
+	wd := vpath.Local(dir)
+	cfgFile := wd.Join(dates.CfgPath)
+	if !assert.NoError(t, initConfig(cfgFile, wd)) {
+		return
+	}
+
+	err = SubmitBatch(dates.Periods, cfgFile, wd, conf.WPSThenDAPhase, conf.GFS, false, io.Discard, io.Discard)
+	if !assert.NoError(t, err) {
+		return
+	}
+	script, err := os.ReadFile(path.Join(dir, "20201225", "jobs", "WRF-3.sh"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(script), "exec /opt/bin/wrfda-run -cfg "+cfgPath+" -p WPSDA -i GFS -job WRF-3 "+dir+" 2020122500 2020122700\n")
+}
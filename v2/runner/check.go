@@ -0,0 +1,190 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/meteocima/virtual-server/vpath"
+	"github.com/meteocima/wrfda-runner/v2/conf"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
+)
+
+type checker struct {
+	vs       *runctx.Context
+	problems []string
+	dirs     map[string]bool
+}
+
+func (c *checker) fail(format string, args ...interface{}) {
+	c.problems = append(c.problems, fmt.Sprintf(format, args...))
+}
+
+// exists returns true if `file` exists. Errors
+// accessing the file are recorded as problems.
+func (c *checker) exists(file vpath.VirtualPath) bool {
+	ok := c.vs.Exists(file)
+	if c.vs.Err != nil {
+		c.fail("cannot access `%s`: %s", file.String(), c.vs.Err)
+		c.vs.Err = nil
+		return false
+	}
+	return ok
+}
+
+// dir checks that configured folder `name` exists
+// and it's a directory, returning false otherwise.
+func (c *checker) dir(name string, dir vpath.VirtualPath) bool {
+	if ok, checked := c.dirs[name]; checked {
+		return ok
+	}
+	ok := c.checkDir(name, dir)
+	c.dirs[name] = ok
+	return ok
+}
+
+func (c *checker) checkDir(name string, dir vpath.VirtualPath) bool {
+	if !c.exists(dir) {
+		c.fail("folder %s not found: `%s`", name, dir.String())
+		return false
+	}
+	if c.vs.IsFile(dir) {
+		c.fail("folder %s is not a directory: `%s`", name, dir.String())
+		return false
+	}
+	return true
+}
+
+// file checks that `file` exists and it's a regular file.
+func (c *checker) file(desc string, file vpath.VirtualPath) {
+	if !c.exists(file) {
+		c.fail("%s not found: `%s`", desc, file.String())
+		return
+	}
+	if !c.vs.IsFile(file) {
+		c.fail("%s is not a file: `%s`", desc, file.String())
+	}
+}
+
+// Check verifies the configuration read from `cfgFile`: that
+// every configured folder exists, and that executables, tables,
+// namelist templates and covariance matrixes needed to run
+// `phase` are found. It returns the list of all problems found.
+func Check(cfgFile, workdir vpath.VirtualPath, phase conf.RunPhase, ds conf.InputDataset, logWriter io.Writer, detailLogWriter io.Writer) []string {
+	c := checker{
+		vs:       runctx.New(os.Stdin, logWriter, detailLogWriter),
+		problems: []string{},
+		dirs:     map[string]bool{},
+	}
+
+	if err := initConfig(cfgFile, workdir); err != nil {
+		c.fail("cannot read configuration `%s`: %s", cfgFile.String(), err)
+		return c.problems
+	}
+
+	flds := conf.Config.Folders
+	hasWPS := phase == conf.WPSPhase || phase == conf.WPSThenDAPhase
+	hasDA := phase == conf.DAPhase || phase == conf.WPSThenDAPhase
+
+	namelistsOk := c.dir("NamelistsDir", flds.NamelistsDir)
+
+	domainCount := 0
+	if namelistsOk {
+		domainCount = ReadDomainCount(c.vs, phase)
+		if c.vs.Err != nil {
+			c.fail("cannot read domain count: %s", c.vs.Err)
+			c.vs.Err = nil
+		}
+	}
+
+	if hasWPS {
+		c.dir("GeodataDir", flds.GeodataDir)
+
+		dataset, err := conf.Dataset(ds)
+		if err != nil {
+			c.fail("%s", err)
+		}
+
+		if c.dir("WPSPrg", flds.WPSPrg) {
+			for _, file := range wpsPrgFiles {
+				c.file("WPS executable", flds.WPSPrg.Join(file))
+			}
+		}
+
+		if dataset != nil {
+			for _, src := range dataset.UngribSources() {
+				c.dir(fmt.Sprintf("archive of dataset %s, source %s", dataset.Name, src.Prefix), src.ArchiveRoot())
+				c.file(fmt.Sprintf("Vtable of dataset %s, source %s", dataset.Name, src.Prefix), src.VtableFile())
+			}
+		}
+
+		if c.dir("WRFAssStepPrg", flds.WRFAssStepPrg) {
+			c.file("real executable", flds.WRFAssStepPrg.Join(realPrgFile))
+		}
+	}
+
+	if hasDA {
+		c.dir("ObservationsArchive", flds.ObservationsArchive)
+
+		if c.dir("WRFDAPrg", flds.WRFDAPrg) {
+			for _, file := range wrfdaPrgFiles {
+				c.file("WRFDA file", flds.WRFDAPrg.Join(file))
+			}
+		}
+
+		if c.dir("WRFAssStepPrg", flds.WRFAssStepPrg) {
+			for _, file := range wrfPrgFiles {
+				c.file("WRF file", flds.WRFAssStepPrg.Join(file))
+			}
+		}
+
+		if c.dir("WRFMainRunPrg", flds.WRFMainRunPrg) {
+			for _, file := range wrfPrgFiles {
+				c.file("WRF file", flds.WRFMainRunPrg.Join(file))
+			}
+		}
+
+		if c.dir("CovarMatrixesDir", flds.CovarMatrixesDir) {
+			files, err := beFiles(domainCount)
+			if err != nil {
+				c.fail("%s", err)
+			}
+			for _, file := range files {
+				c.file("covariance matrix", flds.CovarMatrixesDir.Join(file))
+			}
+		}
+	}
+
+	if namelistsOk {
+		c.problems = append(c.problems, checkNamelists(c.vs, phase)...)
+	}
+
+	return c.problems
+}
+
+// beFiles returns the background error files used by
+// `domainCount` domains in every month, for cycles of runs
+// starting every Cycles.PreviousRun hours from 00 UTC.
+func beFiles(domainCount int) ([]string, error) {
+	found := map[string]bool{}
+	files := []string{}
+	for month := time.January; month <= time.December; month++ {
+		day := time.Date(2020, month, 15, 0, 0, 0, 0, time.UTC)
+		for start := day; start.Before(day.Add(24 * time.Hour)); start = start.Add(conf.Config.Cycles.PreviousRunDuration()) {
+			for cycle := 1; cycle <= conf.Config.Cycles.Count; cycle++ {
+				for domain := 1; domain <= domainCount; domain++ {
+					file, err := conf.Config.BackgroundError.BEFile(domain, start, conf.Config.Cycles.AssimDate(start, cycle))
+					if err != nil {
+						return nil, err
+					}
+					if !found[file] {
+						found[file] = true
+						files = append(files, file)
+					}
+				}
+			}
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,63 @@
+package runner
+
+import (
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/meteocima/virtual-server/vpath"
+	"github.com/meteocima/wrfda-runner/v2/conf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	_, wd := initTestrun(t, "")
+
+	touch := func(file vpath.VirtualPath) {
+		assert.NoError(t, os.MkdirAll(path.Dir(file.Path), 0755))
+		assert.NoError(t, os.WriteFile(file.Path, []byte{}, 0755))
+	}
+
+	// build a workdir with all files needed by a run
+	flds := conf.Config.Folders
+	assert.NoError(t, os.MkdirAll(flds.GeodataDir.Path, 0755))
+	assert.NoError(t, os.MkdirAll(flds.ObservationsArchive.Path, 0755))
+	for _, file := range wpsPrgFiles {
+		touch(flds.WPSPrg.Join(file))
+	}
+	touch(flds.WRFAssStepPrg.Join(realPrgFile))
+	for _, file := range wrfdaPrgFiles {
+		touch(flds.WRFDAPrg.Join(file))
+	}
+	for _, file := range wrfPrgFiles {
+		touch(flds.WRFAssStepPrg.Join(file))
+		touch(flds.WRFMainRunPrg.Join(file))
+	}
+	dataset, err := conf.Dataset(conf.GFS)
+	if !assert.NoError(t, err) {
+		return
+	}
+	src := dataset.UngribSources()[0]
+	assert.NoError(t, os.MkdirAll(src.ArchiveRoot().Path, 0755))
+	touch(src.VtableFile())
+	files, err := beFiles(3)
+	assert.NoError(t, err)
+	for _, file := range files {
+		touch(flds.CovarMatrixesDir.Join(file))
+	}
+
+	check := func() []string {
+		return Check(wd.Join("wrfda-runner.cfg"), wd, conf.WPSThenDAPhase, conf.GFS, io.Discard, io.Discard)
+	}
+	assert.Equal(t, []string{}, check())
+
+	assert.NoError(t, os.Remove(flds.WPSPrg.Join("ungrib.exe").Path))
+	assert.NoError(t, os.Remove(src.VtableFile().Path))
+	assert.NoError(t, os.Remove(flds.CovarMatrixesDir.Join(files[0]).Path))
+	assert.Equal(t, []string{
+		"WPS executable not found: `" + flds.WPSPrg.Join("ungrib.exe").String() + "`",
+		"Vtable of dataset GFS, source " + src.Prefix + " not found: `" + src.VtableFile().String() + "`",
+		"covariance matrix not found: `" + flds.CovarMatrixesDir.Join(files[0]).String() + "`",
+	}, check())
+}
@@ -0,0 +1,163 @@
+package runner
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/meteocima/namelist-prepare/namelist"
+	"github.com/meteocima/virtual-server/connection"
+	"github.com/meteocima/virtual-server/vpath"
+	"github.com/meteocima/wrfda-runner/v2/conf"
+	"github.com/meteocima/wrfda-runner/v2/nml"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
+)
+
+// geogridCacheMarker is the file written in a cache
+// entry after all geo_em files have been copied. It
+// contains the namelist settings the entry was built with.
+const geogridCacheMarker = "namelist.geogrid"
+
+// geogridCacheEntry returns the directory of the geogrid
+// cache containing the geo_em files for the geogrid settings
+// of namelist.wps, the settings formatted as a namelist, and
+// the number of domains. The directory name is a hash of the
+// &geogrid group, of the &share settings used by geogrid
+// (max_dom, wrf_core and io_form_geogrid) and of the GeodataDir
+// path.
+// It returns an empty path when the cache is not configured.
+func geogridCacheEntry(vs *runctx.Context, host string, args namelist.Args) (vpath.VirtualPath, string, int) {
+	cacheDir := conf.Config.Folders.GeogridCacheDir
+	if vs.Err != nil || cacheDir.Path == "" {
+		return vpath.VirtualPath{}, "", 0
+	}
+
+	nl := conf.ReadNamelist(vs, "namelist.wps", args)
+	if vs.Err != nil {
+		return vpath.VirtualPath{}, "", 0
+	}
+	domainCount, err := nl.Int("max_dom")
+	if err != nil {
+		vs.Err = fmt.Errorf("cannot read max_dom from namelist.wps: %w", err)
+		return vpath.VirtualPath{}, "", 0
+	}
+	geogrid := nl.Group("geogrid")
+	if geogrid == nil {
+		vs.Err = fmt.Errorf("group &geogrid not found in namelist.wps")
+		return vpath.VirtualPath{}, "", 0
+	}
+
+	settings := &nml.Namelist{Groups: []*nml.Group{geogrid}}
+	settings.Set("share", "max_dom", nml.IntValue(domainCount))
+	for _, name := range []string{"wrf_core", "io_form_geogrid"} {
+		if v := nl.Lookup(name); v != nil {
+			settings.Set("share", name, v.Values...)
+		}
+	}
+	settings.Set("runner", "geodata_dir", nml.StringValue(conf.Config.Folders.GeodataDir.String()))
+	content := settings.String()
+
+	hash := sha256.Sum256([]byte(content))
+	return vpath.New(host, cacheDir.Join("%x", hash[:8]).Path), content, domainCount
+}
+
+// geoEmFile returns the name of the
+// geogrid output file for `domain`.
+func geoEmFile(domain int) string {
+	return fmt.Sprintf("geo_em.d%02d.nc", domain)
+}
+
+// linkCachedGeogrid links the geo_em files of the geogrid cache
+// entry for `start` into the WPS directory, and returns true.
+// It returns false when the cache is not configured or doesn't
+// contain a complete entry: geogrid must run in that case.
+func linkCachedGeogrid(vs *runctx.Context, wpsDir vpath.VirtualPath, start, end time.Time) bool {
+	entry, _, domainCount := geogridCacheEntry(vs, wpsDir.Host, namelist.Args{
+		Start: conf.Config.Cycles.FirstAssimDate(start),
+		End:   end,
+	})
+	if vs.Err != nil || entry.Path == "" || !vs.Exists(entry.Join(geogridCacheMarker)) {
+		return false
+	}
+
+	vs.LogInfo("Using geogrid output cached in `%s`", entry.String())
+	for domain := 1; domain <= domainCount; domain++ {
+		vs.Link(entry.Join(geoEmFile(domain)), wpsDir.Join(geoEmFile(domain)))
+	}
+	return vs.Err == nil
+}
+
+// storeGeogridCache copies the geo_em files produced by geogrid
+// in the WPS directory into the geogrid cache entry for `start`.
+// Files are copied in a hidden directory, with the marker file
+// written last, that is then published as the entry by a
+// symbolic link, created atomically: partially copied entries
+// are never used, and when concurrent runs store the same
+// entry only the first one is kept. In plan mode the link
+// is only recorded.
+func storeGeogridCache(vs *runctx.Context, wpsDir vpath.VirtualPath, start, end time.Time) {
+	entry, settings, domainCount := geogridCacheEntry(vs, wpsDir.Host, namelist.Args{
+		Start: conf.Config.Cycles.FirstAssimDate(start),
+		End:   end,
+	})
+	if vs.Err != nil || entry.Path == "" {
+		return
+	}
+	conn, err := connection.FindHost(entry.Host)
+	if err != nil {
+		vs.Err = err
+		return
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		vs.Err = err
+		return
+	}
+
+	vs.LogInfo("Store geogrid output in cache `%s`", entry.String())
+	data := vpath.New(entry.Host, "%s/.%s-%s-%d-%d", path.Dir(entry.Path), path.Base(entry.Path), hostname, os.Getpid(), time.Now().UnixNano())
+	vs.MkDir(data)
+	for domain := 1; domain <= domainCount; domain++ {
+		vs.Copy(wpsDir.Join(geoEmFile(domain)), data.Join(geoEmFile(domain)))
+	}
+	vs.WriteString(data.Join(geogridCacheMarker), settings)
+	if vs.Err != nil {
+		return
+	}
+	if vs.Plan != nil {
+		vs.Link(data, entry)
+		return
+	}
+
+	// the creation of a symbolic link
+	// fails if the entry already exists
+	if err := conn.Link(data, entry); err != nil {
+		vs.LogInfo("Geogrid cache entry `%s` already stored by another run", entry.String())
+		vs.RmDir(data)
+	}
+}
+
+// InvalidateGeogridCache removes all entries of the
+// geogrid cache configured in `cfgFile`.
+func InvalidateGeogridCache(cfgFile, workdir vpath.VirtualPath, logWriter io.Writer, detailLogWriter io.Writer) error {
+	if err := initConfig(cfgFile, workdir); err != nil {
+		return err
+	}
+	cacheDir := conf.Config.Folders.GeogridCacheDir
+	if cacheDir.Path == "" {
+		return fmt.Errorf("GeogridCacheDir is not configured in `%s`", cfgFile.String())
+	}
+
+	vs := runctx.New(os.Stdin, logWriter, detailLogWriter)
+	if !vs.Exists(cacheDir) {
+		return nil
+	}
+	for _, entry := range vs.ReadDir(cacheDir) {
+		vs.LogInfo("Remove geogrid cache entry `%s`", entry.String())
+		vs.RmDir(entry)
+	}
+	return vs.Err
+}
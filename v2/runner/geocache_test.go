@@ -0,0 +1,103 @@
+package runner
+
+import (
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/meteocima/wrfda-runner/v2/internal/testutil"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeogridCache(t *testing.T) {
+	dir := testutil.CopyTestrun(t, nil)
+	testutil.ReplaceInFile(t, dir, "wrfda-runner.cfg", "[Folders]\n", "[Folders]\n    GeogridCacheDir=\"./GeogridCache\"\n")
+	wd := readTestConfig(t, dir)
+
+	start := time.Date(2020, 12, 25, 0, 0, 0, 0, time.UTC)
+	end := start.Add(48 * time.Hour)
+	wpsDir := wd.Join("wps")
+	assert.NoError(t, os.Mkdir(wpsDir.Path, 0755))
+
+	vs := runctx.New(os.Stdin, io.Discard, io.Discard)
+	assert.False(t, linkCachedGeogrid(vs, wpsDir, start, end))
+	assert.NoError(t, vs.Err)
+
+	for domain := 1; domain <= 3; domain++ {
+		assert.NoError(t, os.WriteFile(path.Join(wpsDir.Path, geoEmFile(domain)), []byte("geo"), 0644))
+	}
+	storeGeogridCache(vs, wpsDir, start, end)
+	assert.NoError(t, vs.Err)
+
+	// another date with the same settings uses the cache
+	otherDir := wd.Join("wps2")
+	assert.NoError(t, os.Mkdir(otherDir.Path, 0755))
+	assert.True(t, linkCachedGeogrid(vs, otherDir, start.Add(24*time.Hour), end.Add(24*time.Hour)))
+	assert.NoError(t, vs.Err)
+	for domain := 1; domain <= 3; domain++ {
+		content, err := os.ReadFile(path.Join(otherDir.Path, geoEmFile(domain)))
+		assert.NoError(t, err)
+		assert.Equal(t, "geo", string(content))
+	}
+
+	// storing an entry already stored keeps the first copy
+	assert.NoError(t, os.WriteFile(path.Join(wpsDir.Path, geoEmFile(1)), []byte("other"), 0644))
+	storeGeogridCache(vs, wpsDir, start, end)
+	assert.NoError(t, vs.Err)
+	entries, err := os.ReadDir(path.Join(dir, "GeogridCache"))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2, "the entry and the hidden directory it links")
+	content, err := os.ReadFile(path.Join(otherDir.Path, geoEmFile(1)))
+	assert.NoError(t, err)
+	assert.Equal(t, "geo", string(content))
+
+	// changing geogrid settings changes the cache entry
+	testutil.ReplaceInFile(t, dir, "NamelistsDir/namelist.wps", "'modis_lakes+30s'", "'default'")
+	assert.False(t, linkCachedGeogrid(vs, wd.Join("wps3"), start, end))
+	assert.NoError(t, vs.Err)
+	testutil.ReplaceInFile(t, dir, "NamelistsDir/namelist.wps", "'default'", "'modis_lakes+30s'")
+
+	// and so do the &share settings used by geogrid
+	testutil.ReplaceInFile(t, dir, "NamelistsDir/namelist.wps", "io_form_geogrid               = 2,", "io_form_geogrid               = 102,")
+	assert.False(t, linkCachedGeogrid(vs, wd.Join("wps3"), start, end))
+	assert.NoError(t, vs.Err)
+	testutil.ReplaceInFile(t, dir, "NamelistsDir/namelist.wps", "io_form_geogrid               = 102,", "io_form_geogrid               = 2,")
+	assert.NoError(t, os.Mkdir(path.Join(dir, "wps3"), 0755))
+	assert.True(t, linkCachedGeogrid(vs, wd.Join("wps3"), start, end))
+	assert.NoError(t, vs.Err)
+
+	assert.NoError(t, InvalidateGeogridCache(wd.Join("wrfda-runner.cfg"), wd, io.Discard, io.Discard))
+	entries, err = os.ReadDir(path.Join(dir, "GeogridCache"))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+	assert.False(t, linkCachedGeogrid(vs, wd.Join("wps4"), start, end))
+	assert.NoError(t, vs.Err)
+}
+
+func TestGeogridCachePlan(t *testing.T) {
+	dir := testutil.CopyTestrun(t, nil)
+	testutil.ReplaceInFile(t, dir, "wrfda-runner.cfg", "[Folders]\n", "[Folders]\n    GeogridCacheDir=\"./GeogridCache\"\n")
+	wd := readTestConfig(t, dir)
+
+	start := time.Date(2020, 12, 25, 0, 0, 0, 0, time.UTC)
+	wpsDir := wd.Join("wps")
+	assert.NoError(t, os.Mkdir(wpsDir.Path, 0755))
+	assert.NoError(t, os.Mkdir(path.Join(dir, "GeogridCache"), 0755))
+	for domain := 1; domain <= 3; domain++ {
+		assert.NoError(t, os.WriteFile(path.Join(wpsDir.Path, geoEmFile(domain)), []byte("geo"), 0644))
+	}
+
+	vs := runctx.NewPlanning(os.Stdin, io.Discard, io.Discard)
+	storeGeogridCache(vs, wpsDir, start, start.Add(48*time.Hour))
+	assert.NoError(t, vs.Err)
+
+	entries, err := os.ReadDir(path.Join(dir, "GeogridCache"))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+	last := vs.Plan.Actions[len(vs.Plan.Actions)-1]
+	assert.Equal(t, runctx.OpLink, last.Op)
+	assert.Equal(t, "localhost:"+path.Join(dir, "GeogridCache"), path.Dir(last.To))
+}
@@ -0,0 +1,35 @@
+package runner
+
+import (
+	"github.com/meteocima/virtual-server/connection"
+	"github.com/meteocima/virtual-server/vpath"
+	"github.com/meteocima/wrfda-runner/v2/conf"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
+)
+
+// runMPI runs program `exe` in directory `options.Cwd`,
+// with `procs` processes started by the MPI launcher
+// configured in the Launcher section. When the launcher
+// exits with a non-zero code, Err is set to a
+// *runctx.ExitError.
+func runMPI(vs *runctx.Context, procs, exe string, options *connection.RunOptions) {
+	if vs.Err != nil {
+		return
+	}
+	command, args, err := conf.Config.Launcher.Args(conf.LaunchArgs{
+		Procs: procs,
+		Exe:   exe,
+		Cwd:   options.Cwd.Path,
+	})
+	if err != nil {
+		vs.Err = err
+		return
+	}
+	launcher := vs.TrackExits()
+	launcher.Exec(vpath.New(options.Cwd.Host, command), args, options)
+	for _, exit := range launcher.Exits() {
+		if vs.Err == nil && exit.Code != 0 {
+			vs.Err = &runctx.ExitError{Exit: exit}
+		}
+	}
+}
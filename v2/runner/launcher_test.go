@@ -0,0 +1,36 @@
+package runner
+
+import (
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/meteocima/wrfda-runner/v2/runctx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLauncher(t *testing.T) {
+	dir, _ := initTestrun(t, "\n[Procs]\n    WrfstepProcCount = \"48\"\n\n[Launcher]\n    Command = \"fakesrun --ntasks {{.Procs}} {{.Exe}}\"\n")
+
+	bin := path.Join(dir, "bin")
+	assert.NoError(t, os.Mkdir(bin, 0755))
+	assert.NoError(t, os.WriteFile(path.Join(bin, "fakesrun"), []byte("#!/bin/sh\necho \"$@\" > launched\n"), 0755))
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", bin+":"+oldPath)
+	t.Cleanup(func() { os.Setenv("PATH", oldPath) })
+
+	wrfDir := path.Join(dir, "20201225", "wrf18")
+	assert.NoError(t, os.MkdirAll(wrfDir, 0755))
+
+	start := time.Date(2020, 12, 25, 0, 0, 0, 0, time.UTC)
+	vs := runctx.New(os.Stdin, io.Discard, io.Discard)
+	RunWRFStep(vs, start, 1)
+	if !assert.NoError(t, vs.Err) {
+		return
+	}
+	launched, err := os.ReadFile(path.Join(wrfDir, "launched"))
+	assert.NoError(t, err)
+	assert.Equal(t, "--ntasks 48 ./wrf.exe\n", string(launched))
+}
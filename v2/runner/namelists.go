@@ -0,0 +1,346 @@
+package runner
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/meteocima/namelist-prepare/namelist"
+	"github.com/meteocima/wrfda-runner/v2/conf"
+	"github.com/meteocima/wrfda-runner/v2/nml"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
+)
+
+// sampleDate is the date used to render
+// namelist templates when checking them.
+var sampleDate = time.Date(2020, 12, 24, 18, 0, 0, 0, time.UTC)
+
+// gridIntVars are the integer nesting parameters
+// that must agree among all namelists.
+var gridIntVars = []string{"e_we", "e_sn", "parent_id", "parent_grid_ratio", "i_parent_start", "j_parent_start"}
+
+// grid contains the domains configuration
+// read from a namelist.
+type grid struct {
+	source string
+	// firstDomain is the number of the first
+	// domain described, 1 except for WRFDA namelists.
+	firstDomain int
+	// nested is false for WRFDA namelists, that
+	// describe a single domain without nesting parameters.
+	nested bool
+	ints   map[string][]int
+	dx     []float64
+	dy     []float64
+}
+
+type namelistChecker struct {
+	vs       *runctx.Context
+	problems []string
+}
+
+func (c *namelistChecker) fail(format string, args ...interface{}) {
+	c.problems = append(c.problems, fmt.Sprintf(format, args...))
+}
+
+// read renders and parses namelist template `source`.
+// It returns nil if the template doesn't exist, or
+// if it cannot be parsed.
+func (c *namelistChecker) read(source string, required bool) *nml.Namelist {
+	if !c.vs.Exists(conf.NamelistFile(source)) {
+		if required {
+			c.fail("namelist template not found: `%s`", conf.NamelistFile(source).String())
+		}
+		c.vs.Err = nil
+		return nil
+	}
+
+	nl := conf.ReadNamelist(c.vs, source, namelist.Args{
+		Start: sampleDate,
+		End:   sampleDate.Add(48 * time.Hour),
+	})
+	if c.vs.Err != nil {
+		c.fail("%s", c.vs.Err)
+		c.vs.Err = nil
+		return nil
+	}
+	return nl
+}
+
+// require checks that non namelist template `source` exists.
+func (c *namelistChecker) require(source string) {
+	if !c.vs.Exists(conf.NamelistFile(source)) {
+		c.fail("namelist template not found: `%s`", conf.NamelistFile(source).String())
+	}
+	c.vs.Err = nil
+}
+
+// readGrid reads the domains configuration of `maxDom`
+// domains from group `groupName` of namelist `nl`.
+func (c *namelistChecker) readGrid(source string, nl *nml.Namelist, groupName string, maxDom int) *grid {
+	grp := nl.Group(groupName)
+	if grp == nil {
+		c.fail("%s: group `&%s` not found", source, groupName)
+		return nil
+	}
+
+	g := &grid{source: source, firstDomain: 1, nested: true, ints: map[string][]int{}}
+	ok := true
+
+	readInts := func(name string) []int {
+		v := grp.Var(name)
+		if v == nil {
+			c.fail("%s: variable `%s` not found in `&%s`", source, name, groupName)
+			ok = false
+			return nil
+		}
+		values := make([]int, len(v.Values))
+		for idx, val := range v.Values {
+			var err error
+			values[idx], err = val.Int()
+			if err != nil {
+				c.fail("%s: variable `%s`, value %d: %s", source, name, idx+1, err)
+				ok = false
+				return nil
+			}
+		}
+		if len(values) < maxDom {
+			c.fail("%s: variable `%s` has %d values, but max_dom is %d", source, name, len(values), maxDom)
+			ok = false
+			return nil
+		}
+		return values[:maxDom]
+	}
+
+	readFloats := func(name string) []float64 {
+		v := grp.Var(name)
+		if v == nil || len(v.Values) == 0 {
+			c.fail("%s: variable `%s` not found in `&%s`", source, name, groupName)
+			ok = false
+			return nil
+		}
+		values := []float64{}
+		for idx, val := range v.Values {
+			if idx == maxDom {
+				break
+			}
+			f, err := val.Float()
+			if err != nil {
+				c.fail("%s: variable `%s`, value %d: %s", source, name, idx+1, err)
+				ok = false
+				return nil
+			}
+			values = append(values, f)
+		}
+		return values
+	}
+
+	for _, name := range gridIntVars {
+		g.ints[name] = readInts(name)
+	}
+	g.dx = readFloats("dx")
+	g.dy = readFloats("dy")
+	if !ok {
+		return nil
+	}
+
+	g.dx = c.nestResolution(g, "dx", g.dx, maxDom)
+	g.dy = c.nestResolution(g, "dy", g.dy, maxDom)
+	return g
+}
+
+func sameFloat(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-6*math.Max(math.Abs(a), math.Abs(b))
+}
+
+// nestResolution returns the resolution of all domains, calculating
+// the ones missing in `values` from their parent domain. It also checks
+// that the given ones agree with the parent resolution and grid ratio.
+func (c *namelistChecker) nestResolution(g *grid, name string, values []float64, maxDom int) []float64 {
+	parents := g.ints["parent_id"]
+	ratios := g.ints["parent_grid_ratio"]
+
+	res := make([]float64, maxDom)
+	copy(res, values)
+	for domain := 2; domain <= maxDom; domain++ {
+		parent := parents[domain-1]
+		if parent < 1 || parent >= domain {
+			c.fail("%s: invalid parent_id %d for domain %d", g.source, parent, domain)
+			return res
+		}
+		ratio := ratios[domain-1]
+		if ratio < 1 {
+			c.fail("%s: invalid parent_grid_ratio %d for domain %d", g.source, ratio, domain)
+			return res
+		}
+
+		expected := res[parent-1] / float64(ratio)
+		if domain > len(values) {
+			res[domain-1] = expected
+			continue
+		}
+		if !sameFloat(res[domain-1], expected) {
+			c.fail("%s: %s of domain %d is %g, but parent domain %d has %s %g and parent_grid_ratio is %d",
+				g.source, name, domain, res[domain-1], parent, name, res[parent-1], ratio)
+		}
+	}
+	return res
+}
+
+// compare checks that grid `g` agrees with `ref`.
+func (c *namelistChecker) compare(ref, g *grid) {
+	for idx := range g.dx {
+		domain := g.firstDomain + idx
+		refIdx := domain - ref.firstDomain
+		if refIdx < 0 || refIdx >= len(ref.dx) {
+			c.fail("%s: domain %d is not defined in %s", g.source, domain, ref.source)
+			continue
+		}
+
+		names := gridIntVars
+		if !g.nested {
+			names = []string{"e_we", "e_sn"}
+		}
+		for _, name := range names {
+			if g.ints[name][idx] != ref.ints[name][refIdx] {
+				c.fail("%s of domain %d is %d in %s, but %d in %s",
+					name, domain, ref.ints[name][refIdx], ref.source, g.ints[name][idx], g.source)
+			}
+		}
+
+		if !sameFloat(g.dx[idx], ref.dx[refIdx]) {
+			c.fail("dx of domain %d is %g in %s, but %g in %s", domain, ref.dx[refIdx], ref.source, g.dx[idx], g.source)
+		}
+		if !sameFloat(g.dy[idx], ref.dy[refIdx]) {
+			c.fail("dy of domain %d is %g in %s, but %g in %s", domain, ref.dy[refIdx], ref.source, g.dy[idx], g.source)
+		}
+	}
+}
+
+// readWRFDAGrid reads the domain configuration of
+// a WRFDA namelist, if it contains a `&domains` group.
+func (c *namelistChecker) readWRFDAGrid(source string, nl *nml.Namelist, domain int) *grid {
+	grp := nl.Group("domains")
+	if grp == nil {
+		return nil
+	}
+
+	g := &grid{source: source, firstDomain: domain, ints: map[string][]int{}}
+	for _, name := range []string{"e_we", "e_sn"} {
+		value, err := nl.Int(name)
+		if err != nil {
+			c.fail("%s: %s", source, err)
+			return nil
+		}
+		g.ints[name] = []int{value}
+	}
+
+	dx, err := nl.Floats("dx")
+	if err != nil {
+		c.fail("%s: %s", source, err)
+		return nil
+	}
+	dy, err := nl.Floats("dy")
+	if err != nil {
+		c.fail("%s: %s", source, err)
+		return nil
+	}
+	g.dx = dx[:1]
+	g.dy = dy[:1]
+	return g
+}
+
+func (c *namelistChecker) maxDom(source string, nl *nml.Namelist) int {
+	maxDom, err := nl.Int("max_dom")
+	if err != nil {
+		c.fail("%s: %s", source, err)
+		return 0
+	}
+	if maxDom < 1 {
+		c.fail("%s: invalid max_dom %d", source, maxDom)
+		return 0
+	}
+	return maxDom
+}
+
+// checkNamelists renders all namelist templates needed
+// by `phase`, and checks that they agree on domain count,
+// grid dimensions, resolution and nesting parameters.
+// It also checks that WRFDA namelists and WRF variables
+// tables exist for every domain and cycle.
+// It returns the list of all problems found.
+func checkNamelists(vs *runctx.Context, phase conf.RunPhase) []string {
+	c := namelistChecker{vs: vs.Clone(), problems: []string{}}
+
+	hasWPS := phase == conf.WPSPhase || phase == conf.WPSThenDAPhase
+	hasDA := phase == conf.DAPhase || phase == conf.WPSThenDAPhase
+
+	if hasWPS {
+		c.require("namelist.real")
+	}
+	if hasDA {
+		c.require("parame.in")
+		for cycle := 1; cycle <= conf.Config.Cycles.Count; cycle++ {
+			c.require(fmt.Sprintf("wrf_var.txt.wrf_%02d", cycle))
+		}
+	}
+
+	// namelist.wps is also checked in DA phase if it's
+	// present, because it describes the domains of WPS
+	// output used as input by the DA phase.
+	sources := []struct {
+		name  string
+		group string
+	}{
+		{"namelist.wps", "geogrid"},
+		{"namelist.step.wrf", "domains"},
+		{"namelist.run.wrf", "domains"},
+	}
+
+	var ref *grid
+	refMaxDom := 0
+	for _, src := range sources {
+		required := src.name == "namelist.wps" && hasWPS || src.name != "namelist.wps" && hasDA
+		nl := c.read(src.name, required)
+		if nl == nil {
+			continue
+		}
+
+		maxDom := c.maxDom(src.name, nl)
+		if maxDom == 0 {
+			continue
+		}
+		if refMaxDom != 0 && maxDom != refMaxDom {
+			c.fail("max_dom is %d in %s, but %d in %s", refMaxDom, ref.source, maxDom, src.name)
+			continue
+		}
+
+		g := c.readGrid(src.name, nl, src.group, maxDom)
+		if g == nil {
+			continue
+		}
+		if ref == nil {
+			ref = g
+			refMaxDom = maxDom
+			continue
+		}
+		c.compare(ref, g)
+	}
+
+	if !hasDA {
+		return c.problems
+	}
+
+	for domain := 1; domain <= refMaxDom; domain++ {
+		source := fmt.Sprintf("namelist.d%02d.wrfda", domain)
+		nl := c.read(source, true)
+		if nl == nil {
+			continue
+		}
+		if g := c.readWRFDAGrid(source, nl, domain); g != nil && ref != nil {
+			c.compare(ref, g)
+		}
+	}
+
+	return c.problems
+}
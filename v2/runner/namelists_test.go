@@ -0,0 +1,70 @@
+package runner
+
+import (
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/meteocima/virtual-server/vpath"
+	"github.com/meteocima/wrfda-runner/v2/conf"
+	"github.com/meteocima/wrfda-runner/v2/internal/testutil"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
+	"github.com/stretchr/testify/assert"
+)
+
+func checkNamelistsIn(dir string) []string {
+	wd := vpath.Local(dir)
+	return CheckNamelists(wd.Join("wrfda-runner.cfg"), wd, conf.WPSThenDAPhase, io.Discard, io.Discard)
+}
+
+func TestCheckNamelists(t *testing.T) {
+	dir := testutil.CopyTestrun(t, nil)
+	assert.Equal(t, []string{}, checkNamelistsIn(dir))
+}
+
+func TestCheckNamelistsInconsistent(t *testing.T) {
+	dir := testutil.CopyTestrun(t, map[string][]string{
+		"namelist.step.wrf": {
+			" parent_grid_ratio             =              1,             3,             3,",
+			" parent_grid_ratio             =              1,             3,             5,",
+		},
+		"namelist.run.wrf": {
+			" max_dom                       = 3,",
+			" max_dom                       = 2,",
+		},
+		"namelist.d02.wrfda": {
+			" e_sn                          =            448,",
+			" e_sn                          =            440,",
+			" dy                            =           7500,",
+			" dy                            =           7000,",
+		},
+	})
+	assert.NoError(t, os.Remove(path.Join(dir, "NamelistsDir", "wrf_var.txt.wrf_02")))
+
+	assert.Equal(t, []string{
+		"namelist template not found: `localhost:" + dir + "/NamelistsDir/wrf_var.txt.wrf_02`",
+		"namelist.step.wrf: dx of domain 3 is 2500, but parent domain 2 has dx 7500 and parent_grid_ratio is 5",
+		"namelist.step.wrf: dy of domain 3 is 2500, but parent domain 2 has dy 7500 and parent_grid_ratio is 5",
+		"parent_grid_ratio of domain 3 is 3 in namelist.wps, but 5 in namelist.step.wrf",
+		"max_dom is 3 in namelist.wps, but 2 in namelist.run.wrf",
+		"e_sn of domain 2 is 448 in namelist.wps, but 440 in namelist.d02.wrfda",
+		"dy of domain 2 is 7500 in namelist.wps, but 7000 in namelist.d02.wrfda",
+	}, checkNamelistsIn(dir))
+}
+
+func TestReadDomainCountCached(t *testing.T) {
+	dir, _ := initTestrun(t, "")
+
+	vs := runctx.New(os.Stdin, io.Discard, io.Discard)
+	assert.Equal(t, 3, ReadDomainCount(vs, conf.WPSPhase))
+
+	// the namelist is not read again until initConfig.
+	testutil.ReplaceInFile(t, dir, "NamelistsDir/namelist.wps", "max_dom                       = 3,", "max_dom                       = 2,")
+	assert.Equal(t, 3, ReadDomainCount(vs, conf.WPSPhase))
+
+	readTestConfig(t, dir)
+	assert.Equal(t, 2, ReadDomainCount(vs, conf.WPSPhase))
+	assert.Equal(t, 3, ReadDomainCount(vs, conf.DAPhase))
+	assert.NoError(t, vs.Err)
+}
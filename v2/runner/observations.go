@@ -0,0 +1,108 @@
+package runner
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/meteocima/virtual-server/vpath"
+	"github.com/meteocima/wrfda-runner/v2/conf"
+	"github.com/meteocima/wrfda-runner/v2/folders"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
+)
+
+// obsArchives returns the files of ObservationsArchive that
+// can contain observations of type `obs` for `cycle`, in
+// order of preference.
+func obsArchives(obs conf.ObsType, start time.Time, cycle int) []vpath.VirtualPath {
+	if obs == conf.Radar {
+		return []vpath.VirtualPath{
+			folders.RadarObsArchive(start, cycle),
+			folders.AlternativeRadarObsArchive(start, cycle),
+		}
+	}
+	return []vpath.VirtualPath{folders.StationsObsArchive(start, cycle)}
+}
+
+// obsFile returns the path of the observations of type
+// `obs` for `cycle` in the work directory of the date.
+func obsFile(obs conf.ObsType, start time.Time, cycle int, host string) vpath.VirtualPath {
+	if obs == conf.Radar {
+		return folders.RadarObsForDate(start, cycle, host)
+	}
+	return folders.StationsObsForDate(start, cycle, host)
+}
+
+// obsLinkName returns the name of the link to
+// observations of type `obs` in WRFDA directories.
+func obsLinkName(obs conf.ObsType) string {
+	if obs == conf.Radar {
+		return "ob.radar"
+	}
+	return "ob.ascii"
+}
+
+func cpObservations(vs *runctx.Context, cycle int, startDate time.Time, host string) {
+	for _, obs := range conf.ObsTypes {
+		dst := obsFile(obs, startDate, cycle, host)
+		candidates := obsArchives(obs, startDate, cycle)
+
+		found := false
+		for _, src := range candidates {
+			if vs.Exists(src) {
+				vs.LogInfo("Copy %s observations for cycle %d to %s: %s -> %s", obs, cycle, host, src, dst)
+				vs.Copy(src, dst)
+				vs.LogInfo("Copy done")
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+
+		names := make([]string, len(candidates))
+		for idx, src := range candidates {
+			names[idx] = fmt.Sprintf("`%s`", src.String())
+		}
+
+		switch conf.Config.Observations.Policy(obs) {
+		case conf.Required:
+			vs.Err = fmt.Errorf("missing %s observations for cycle %d: %s not found", obs, cycle, strings.Join(names, " or "))
+			return
+		case conf.SkipDA:
+			vs.LogInfo("No %s observations for cycle %d: the cycle will not assimilate any observation", obs, cycle)
+		default:
+			vs.LogInfo("No %s observations for cycle %d: the cycle will assimilate the other observations", obs, cycle)
+		}
+	}
+}
+
+// missingObservations returns the types of observations
+// that were not found in the archive for `cycle`.
+func missingObservations(vs *runctx.Context, start time.Time, cycle int, host string) []conf.ObsType {
+	res := []conf.ObsType{}
+	for _, obs := range conf.ObsTypes {
+		if !vs.Exists(obsFile(obs, start, cycle, host)) {
+			res = append(res, obs)
+		}
+	}
+	return res
+}
+
+// cycleReport returns the report of `cycle`, according
+// to observations available and configured policies.
+func cycleReport(vs *runctx.Context, start time.Time, cycle int, host string) *CycleReport {
+	report := &CycleReport{
+		Cycle:               cycle,
+		MissingObservations: missingObservations(vs, start, cycle, host),
+	}
+	for _, obs := range report.MissingObservations {
+		if conf.Config.Observations.Policy(obs) == conf.SkipDA {
+			report.NoAssimilation = true
+			report.Reason = fmt.Sprintf("missing %s observations", obs)
+			break
+		}
+	}
+	return report
+}
@@ -0,0 +1,66 @@
+package runner
+
+import (
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/meteocima/virtual-server/vpath"
+	"github.com/meteocima/wrfda-runner/v2/conf"
+	"github.com/meteocima/wrfda-runner/v2/internal/testutil"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObservationsPolicy(t *testing.T) {
+	dir, _ := initTestrun(t, "\n[Observations]\n    Radar = \"skip-da\"\n    Stations = \"required\"\n")
+	assert.Equal(t, conf.SkipDA, conf.Config.Observations.Policy(conf.Radar))
+
+	start := time.Date(2020, 12, 25, 0, 0, 0, 0, time.UTC)
+	archive := path.Join(dir, "ObservationsArchive")
+	assert.NoError(t, os.Mkdir(archive, 0755))
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "20201225", "observations"), 0755))
+
+	vs := runctx.New(os.Stdin, io.Discard, io.Discard)
+	cpObservations(vs, 1, start, "localhost")
+	assert.EqualError(t, vs.Err, "missing stations observations for cycle 1: `localhost:"+archive+"/ob.ascii_202012241800` not found")
+
+	// radar is found with the alternative name
+	vs.Err = nil
+	for _, name := range []string{"ob.ascii_202012241800", "ob.ascii_202012242100", "ob.radar.2020122421"} {
+		assert.NoError(t, os.WriteFile(path.Join(archive, name), []byte("obs"), 0644))
+	}
+	cpObservations(vs, 1, start, "localhost")
+	cpObservations(vs, 2, start, "localhost")
+	if !assert.NoError(t, vs.Err) {
+		return
+	}
+
+	report := cycleReport(vs, start, 1, "localhost")
+	assert.Equal(t, &CycleReport{
+		Cycle:               1,
+		MissingObservations: []conf.ObsType{conf.Radar},
+		NoAssimilation:      true,
+		Reason:              "missing radar observations",
+	}, report)
+	assert.Equal(t, "no assimilation in cycle 1: missing radar observations", report.String())
+
+	report = cycleReport(vs, start, 2, "localhost")
+	assert.Equal(t, &CycleReport{Cycle: 2, MissingObservations: []conf.ObsType{}}, report)
+	assert.Equal(t, "cycle 2 assimilated all observations", report.String())
+
+	conf.Config.Observations.Radar = conf.Optional
+	report = cycleReport(vs, start, 1, "localhost")
+	assert.False(t, report.NoAssimilation)
+	assert.Equal(t, "cycle 1 assimilated without radar observations", report.String())
+}
+
+func TestObservationsPolicyInvalid(t *testing.T) {
+	dir := testutil.CopyTestrun(t, nil)
+	testutil.ReplaceInFile(t, dir, "wrfda-runner.cfg", "[Hosts]\n", "[Observations]\n    Radar = \"sometimes\"\n\n[Hosts]\n")
+	wd := vpath.Local(dir)
+	err := initConfig(wd.Join("wrfda-runner.cfg"), wd)
+	assert.EqualError(t, err, "invalid Observations in `localhost:"+dir+"/wrfda-runner.cfg`: unknown missing observations policy `sometimes`, must be one of required, optional, skip-da")
+}
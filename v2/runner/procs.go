@@ -0,0 +1,507 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/meteocima/namelist-prepare/namelist"
+	"github.com/meteocima/virtual-server/vpath"
+	"github.com/meteocima/wrfda-runner/v2/conf"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
+)
+
+// minPatchSize is the minimum number of grid points, in
+// each direction, of the patch of a domain computed by
+// a single process. WRF refuses to run with smaller ones.
+const minPatchSize = 10
+
+// efficientPatchSize is the patch size under which
+// communication among processes usually costs
+// more than the computation they save.
+const efficientPatchSize = 25
+
+// gridNamelists are the namelist templates from which
+// domains dimensions are read, in order of preference.
+var gridNamelists = []string{"namelist.run.wrf", "namelist.step.wrf", "namelist.wps"}
+
+// DomainSize contains the grid dimensions of a domain.
+type DomainSize struct {
+	Domain int
+	WE     int
+	SN     int
+	// Vert is 0 when read from namelist.wps. Domains
+	// are decomposed only horizontally, so it doesn't
+	// limit the number of processes.
+	Vert int
+}
+
+// decompose returns the number of processes along the
+// x and y axes used by WRF to split a domain among `procs`
+// processes: the factorization nearest to a square one.
+func decompose(procs int) (int, int) {
+	x := 1
+	for m := 1; m*m <= procs; m++ {
+		if procs%m == 0 {
+			x = m
+		}
+	}
+	return x, procs / x
+}
+
+// fits returns whether each one of `procs` processes
+// gets a patch of at least `patch` points in each direction.
+func (d DomainSize) fits(procs, patch int) bool {
+	x, y := decompose(procs)
+	return (d.WE-1)/x >= patch && (d.SN-1)/y >= patch
+}
+
+// maxProcs returns the number of processes that
+// split the domain in patches of `patch` points.
+func (d DomainSize) maxProcs(patch int) int {
+	procs := ((d.WE - 1) / patch) * ((d.SN - 1) / patch)
+	if procs < 1 {
+		return 1
+	}
+	return procs
+}
+
+// suggestProcs returns the number of processes suggested to run
+// a program on all `domains`: the largest one not exceeding the
+// efficient patch size in any domain, that WRF can decompose
+// respecting its minimum patch size. It's a multiple of
+// `coresPerNode` unless the domains are too small to fill a node.
+func suggestProcs(domains []DomainSize, coresPerNode int) int {
+	limit := 0
+	for _, d := range domains {
+		if max := d.maxProcs(efficientPatchSize); limit == 0 || max < limit {
+			limit = max
+		}
+	}
+
+	for procs := limit; procs > 1; procs-- {
+		if procs >= coresPerNode && procs%coresPerNode != 0 {
+			continue
+		}
+		fits := true
+		for _, d := range domains {
+			fits = fits && d.fits(procs, minPatchSize)
+		}
+		if fits {
+			return procs
+		}
+	}
+	return 1
+}
+
+// ProcsSuggestion contains the number of processes
+// suggested for the domains of a configuration.
+type ProcsSuggestion struct {
+	// Source is the namelist template
+	// from which Domains were read.
+	Source       string
+	Domains      []DomainSize
+	CoresPerNode int
+	Procs        conf.ProcsConf
+}
+
+// readDomainSizes reads the dimensions of all domains
+// from the first template of gridNamelists found.
+func readDomainSizes(vs *runctx.Context) (string, []DomainSize) {
+	for _, source := range gridNamelists {
+		if !vs.Exists(conf.NamelistFile(source)) {
+			vs.Err = nil
+			continue
+		}
+
+		nl := conf.ReadNamelist(vs, source, namelist.Args{
+			Start: sampleDate,
+			End:   sampleDate.Add(48 * time.Hour),
+		})
+		if vs.Err != nil {
+			return source, nil
+		}
+
+		fail := func(err error) (string, []DomainSize) {
+			vs.Err = fmt.Errorf("%s: %w", source, err)
+			return source, nil
+		}
+		maxDom, err := nl.Int("max_dom")
+		if err != nil {
+			return fail(err)
+		}
+		we, err := nl.Ints("e_we")
+		if err != nil {
+			return fail(err)
+		}
+		sn, err := nl.Ints("e_sn")
+		if err != nil {
+			return fail(err)
+		}
+		var vert []int
+		if nl.Lookup("e_vert") != nil {
+			if vert, err = nl.Ints("e_vert"); err != nil {
+				return fail(err)
+			}
+		}
+		if len(we) < maxDom || len(sn) < maxDom {
+			return fail(fmt.Errorf("e_we and e_sn must have a value for each one of %d domains", maxDom))
+		}
+
+		domains := make([]DomainSize, maxDom)
+		for idx := range domains {
+			domains[idx] = DomainSize{Domain: idx + 1, WE: we[idx], SN: sn[idx]}
+			if idx < len(vert) {
+				domains[idx].Vert = vert[idx]
+			} else if len(vert) > 0 {
+				domains[idx].Vert = vert[len(vert)-1]
+			}
+		}
+		return source, domains
+	}
+
+	vs.Err = fmt.Errorf("none of namelist templates %s found in `%s`",
+		strings.Join(gridNamelists, ", "), conf.Config.Folders.NamelistsDir.String())
+	return "", nil
+}
+
+// SuggestProcs reads the dimensions of the domains configured in
+// `cfgFile`, and suggests the number of processes of each program
+// for nodes with `coresPerNode` cores. When `coresPerNode` is 0,
+// the CoresPerNode of the configuration is used.
+func SuggestProcs(cfgFile, workdir vpath.VirtualPath, coresPerNode int, logWriter io.Writer, detailLogWriter io.Writer) (*ProcsSuggestion, error) {
+	if err := initConfig(cfgFile, workdir); err != nil {
+		return nil, err
+	}
+	if coresPerNode == 0 {
+		coresPerNode = conf.Config.Procs.CoresPerNode
+	}
+	if coresPerNode < 0 {
+		return nil, fmt.Errorf("invalid cores per node %d: must be greater than 0", coresPerNode)
+	}
+	if coresPerNode == 0 {
+		coresPerNode = 1
+	}
+
+	vs := runctx.New(os.Stdin, logWriter, detailLogWriter)
+	source, domains := readDomainSizes(vs)
+	if vs.Err != nil {
+		return nil, vs.Err
+	}
+
+	all := strconv.Itoa(suggestProcs(domains, coresPerNode))
+	suggestion := &ProcsSuggestion{
+		Source:       source,
+		Domains:      domains,
+		CoresPerNode: coresPerNode,
+		Procs: conf.ProcsConf{
+			GeogridProcCount: all,
+			MetgridProcCount: all,
+			RealProcCount:    all,
+			WrfstepProcCount: all,
+		},
+	}
+
+	// WRFDA runs separately on each domain, so its
+	// processes are suggested for each one of them.
+	daMin := 0
+	for _, d := range domains {
+		procs := suggestProcs([]DomainSize{d}, coresPerNode)
+		suggestion.Procs.WrfdaDomainProcCount = append(suggestion.Procs.WrfdaDomainProcCount, strconv.Itoa(procs))
+		if daMin == 0 || procs < daMin {
+			daMin = procs
+		}
+	}
+	suggestion.Procs.WrfdaProcCount = strconv.Itoa(daMin)
+
+	return suggestion, nil
+}
+
+// procsValues returns the TOML values of the suggested
+// process counts, in the order they are written.
+func (s *ProcsSuggestion) procsValues() [][2]string {
+	domainCounts := make([]string, len(s.Procs.WrfdaDomainProcCount))
+	for idx, count := range s.Procs.WrfdaDomainProcCount {
+		domainCounts[idx] = strconv.Quote(count)
+	}
+	return [][2]string{
+		{"GeogridProcCount", strconv.Quote(s.Procs.GeogridProcCount)},
+		{"MetgridProcCount", strconv.Quote(s.Procs.MetgridProcCount)},
+		{"RealProcCount", strconv.Quote(s.Procs.RealProcCount)},
+		{"WrfstepProcCount", strconv.Quote(s.Procs.WrfstepProcCount)},
+		{"WrfdaProcCount", strconv.Quote(s.Procs.WrfdaProcCount)},
+		{"WrfdaDomainProcCount", "[" + strings.Join(domainCounts, ", ") + "]"},
+	}
+}
+
+// WriteText writes to `w` the domains dimensions and
+// the suggested `[Procs]` section of the configuration.
+func (s *ProcsSuggestion) WriteText(w io.Writer) error {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "domains read from %s:\n", s.Source)
+	for _, d := range s.Domains {
+		fmt.Fprintf(&buf, "  d%02d: e_we %d, e_sn %d, e_vert %d\n", d.Domain, d.WE, d.SN, d.Vert)
+	}
+	fmt.Fprintf(&buf, "suggested processes for nodes with %d cores:\n[Procs]\n", s.CoresPerNode)
+	for _, v := range s.procsValues() {
+		fmt.Fprintf(&buf, "    %s = %s\n", v[0], v[1])
+	}
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
+// WriteProcs writes the suggested process counts in
+// the `[Procs]` section of `cfgFile`, replacing the
+// values already there and adding the section if needed.
+func (s *ProcsSuggestion) WriteProcs(cfgFile vpath.VirtualPath) error {
+	vs := runctx.New(os.Stdin, io.Discard, io.Discard)
+	content := vs.ReadString(cfgFile)
+	if vs.Err != nil {
+		return vs.Err
+	}
+	updated, err := setProcsSection(content, s.procsValues())
+	if err != nil {
+		return fmt.Errorf("cannot write `%s`: %w", cfgFile.String(), err)
+	}
+	vs.WriteString(cfgFile, updated)
+	return vs.Err
+}
+
+// openBrackets returns the number of square brackets opened
+// and not closed in TOML `line`, outside strings and comments.
+// It fails if the line contains a multi-line string.
+func openBrackets(line string) (int, error) {
+	if strings.Contains(line, `"""`) || strings.Contains(line, "'''") {
+		return 0, fmt.Errorf("multi-line strings are not supported, edit the [Procs] section by hand")
+	}
+	depth := 0
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case quote == '"' && escaped:
+			escaped = false
+		case quote == '"' && r == '\\':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#':
+			return depth, nil
+		case r == '[':
+			depth++
+		case r == ']':
+			depth--
+		}
+	}
+	return depth, nil
+}
+
+// setProcsSection returns TOML `content` with the keys of the
+// `[Procs]` section set to `values`. Missing keys are added
+// at the end of the section, and a missing section at the
+// end of the file. Values spanning multiple lines, like
+// arrays, are replaced whole. All other lines are left
+// untouched.
+func setProcsSection(content string, values [][2]string) (string, error) {
+	lines := strings.Split(content, "\n")
+	isHeader := func(line string) bool {
+		return strings.HasPrefix(strings.TrimSpace(line), "[")
+	}
+	isProcs := func(line string) bool {
+		header := strings.TrimSpace(strings.SplitN(line, "#", 2)[0])
+		return header == "[Procs]"
+	}
+	keyOf := func(line string) string {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) < 2 || isHeader(line) {
+			return ""
+		}
+		return strings.TrimSpace(parts[0])
+	}
+
+	start := -1
+	for idx, line := range lines {
+		if isProcs(line) {
+			start = idx
+			break
+		}
+	}
+	if start == -1 {
+		section := "[Procs]\n"
+		for _, v := range values {
+			section += fmt.Sprintf("    %s = %s\n", v[0], v[1])
+		}
+		if !strings.HasSuffix(content, "\n") && content != "" {
+			content += "\n"
+		}
+		return content + "\n" + section, nil
+	}
+
+	// lines starting with a bracket inside
+	// an array are not section headers.
+	end := len(lines)
+	depth := 0
+	for idx := start + 1; idx < len(lines); idx++ {
+		if depth == 0 && isHeader(lines[idx]) {
+			end = idx
+			break
+		}
+		more, err := openBrackets(lines[idx])
+		if err != nil {
+			return "", err
+		}
+		depth += more
+	}
+
+	written := map[string]bool{}
+	section := []string{}
+	for idx := start + 1; idx < end; idx++ {
+		// the value of a key ends on the line
+		// where its brackets are all closed.
+		first := idx
+		depth, err := openBrackets(lines[idx])
+		if err != nil {
+			return "", err
+		}
+		for depth > 0 && idx+1 < end {
+			idx++
+			more, err := openBrackets(lines[idx])
+			if err != nil {
+				return "", err
+			}
+			depth += more
+		}
+
+		key := keyOf(lines[first])
+		replaced := false
+		for _, v := range values {
+			if strings.EqualFold(key, v[0]) {
+				indent := lines[first][:len(lines[first])-len(strings.TrimLeft(lines[first], " \t"))]
+				section = append(section, fmt.Sprintf("%s%s = %s", indent, v[0], v[1]))
+				written[v[0]] = true
+				replaced = true
+			}
+		}
+		if !replaced {
+			section = append(section, lines[first:idx+1]...)
+		}
+	}
+	lines = append(append(append([]string{}, lines[:start+1]...), section...), lines[end:]...)
+	end = start + 1 + len(section)
+
+	// missing keys go after the last
+	// non blank line of the section.
+	last := start
+	for idx := start + 1; idx < end; idx++ {
+		if strings.TrimSpace(lines[idx]) != "" {
+			last = idx
+		}
+	}
+	added := []string{}
+	for _, v := range values {
+		if !written[v[0]] {
+			added = append(added, fmt.Sprintf("    %s = %s", v[0], v[1]))
+		}
+	}
+
+	result := append([]string{}, lines[:last+1]...)
+	result = append(result, added...)
+	result = append(result, lines[last+1:]...)
+	return strings.Join(result, "\n"), nil
+}
+
+// daProcCounts returns the number of WRFDA processes of each
+// domain. When Procs.ParallelDA is set, domains without a count
+// of their own share WrfdaProcCount, proportionally to their
+// number of grid points.
+func daProcCounts(vs *runctx.Context, domainCount int) []string {
+	if vs.Err != nil {
+		return nil
+	}
+	procs := conf.Config.Procs
+	counts := make([]string, domainCount)
+	shared := []DomainSize{}
+	for domain := 1; domain <= domainCount; domain++ {
+		counts[domain-1] = procs.Wrfda(domain)
+		if domain > len(procs.WrfdaDomainProcCount) || procs.WrfdaDomainProcCount[domain-1] == "" {
+			shared = append(shared, DomainSize{Domain: domain})
+		}
+	}
+	if !procs.ParallelDA || len(shared) < 2 {
+		return counts
+	}
+
+	total, err := strconv.Atoi(procs.WrfdaProcCount)
+	if err != nil {
+		vs.Err = fmt.Errorf("cannot split WrfdaProcCount `%s` among domains: %w", procs.WrfdaProcCount, err)
+		return nil
+	}
+
+	_, domains := readDomainSizes(vs)
+	if vs.Err != nil {
+		return nil
+	}
+	for idx, d := range shared {
+		if d.Domain > len(domains) {
+			vs.Err = fmt.Errorf("cannot split WrfdaProcCount among domains: domain %d not found", d.Domain)
+			return nil
+		}
+		shared[idx] = domains[d.Domain-1]
+	}
+
+	if total < len(shared) {
+		vs.Err = fmt.Errorf("cannot split WrfdaProcCount `%s` among %d domains", procs.WrfdaProcCount, len(shared))
+		return nil
+	}
+
+	sizes := make([]int, len(shared))
+	for idx, d := range shared {
+		sizes[idx] = d.WE * d.SN
+	}
+	for idx, share := range splitProcs(total, sizes) {
+		counts[shared[idx].Domain-1] = strconv.Itoa(share)
+	}
+	return counts
+}
+
+// splitProcs splits `total` processes proportionally to `points`.
+// Every share is at least one process, taken from the largest
+// shares, and the processes left by rounding go to the share
+// with most points. `total` must be at least len(points).
+func splitProcs(total int, points []int) []int {
+	sum := 0
+	for _, p := range points {
+		sum += p
+	}
+
+	shares := make([]int, len(points))
+	largest, assigned := 0, 0
+	for idx, p := range points {
+		shares[idx] = total * p / sum
+		if shares[idx] < 1 {
+			shares[idx] = 1
+		}
+		assigned += shares[idx]
+		if p > points[largest] {
+			largest = idx
+		}
+	}
+	for ; assigned > total; assigned-- {
+		most := 0
+		for idx := range shares {
+			if shares[idx] > shares[most] {
+				most = idx
+			}
+		}
+		shares[most]--
+	}
+	shares[largest] += total - assigned
+	return shares
+}
@@ -0,0 +1,86 @@
+package runner
+
+import (
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/meteocima/virtual-server/vpath"
+	"github.com/meteocima/wrfda-runner/v2/conf"
+	"github.com/meteocima/wrfda-runner/v2/internal/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSuggestProcs(t *testing.T) {
+	assert.Equal(t, 9, suggestProcs([]DomainSize{{WE: 300, SN: 40}}, 1), "prime counts leave patches too thin")
+	assert.Equal(t, 1, suggestProcs([]DomainSize{{WE: 20, SN: 20}}, 36))
+
+	dir := testutil.CopyTestrun(t, nil)
+	wd := vpath.Local(dir)
+	cfgFile := wd.Join("wrfda-runner.cfg")
+	suggestion, err := SuggestProcs(cfgFile, wd, 36, io.Discard, io.Discard)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "namelist.run.wrf", suggestion.Source)
+	assert.Equal(t, DomainSize{Domain: 2, WE: 523, SN: 448, Vert: 50}, suggestion.Domains[1])
+	assert.Equal(t, "36", suggestion.Procs.WrfstepProcCount)
+	assert.Equal(t, "36", suggestion.Procs.WrfdaProcCount)
+	assert.Equal(t, []string{"36", "324", "288"}, suggestion.Procs.WrfdaDomainProcCount)
+
+	if !assert.NoError(t, suggestion.WriteProcs(cfgFile)) {
+		return
+	}
+	if !assert.NoError(t, initConfig(cfgFile, wd)) {
+		return
+	}
+	assert.Equal(t, "324", conf.Config.Procs.Wrfda(2))
+	assert.Equal(t, "36", conf.Config.Procs.GeogridProcCount)
+
+	// without namelist.run.wrf, domains are read
+	// from namelist.step.wrf.
+	assert.NoError(t, os.Remove(path.Join(dir, "NamelistsDir", "namelist.run.wrf")))
+	suggestion, err = SuggestProcs(cfgFile, wd, 0, io.Discard, io.Discard)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "namelist.step.wrf", suggestion.Source)
+		assert.Equal(t, 1, suggestion.CoresPerNode)
+	}
+}
+
+func TestSetProcsSection(t *testing.T) {
+	values := [][2]string{{"WrfdaProcCount", `"36"`}, {"RealProcCount", `"72"`}}
+
+	content := "[Procs]\n  wrfdaproccount = \"4\"\n  GeogridProcCount = \"8\"\n\n[Env]\n    A = \"1\"\n"
+	updated, err := setProcsSection(content, values)
+	assert.NoError(t, err)
+	assert.Equal(t,
+		"[Procs]\n  WrfdaProcCount = \"36\"\n  GeogridProcCount = \"8\"\n    RealProcCount = \"72\"\n\n[Env]\n    A = \"1\"\n",
+		updated)
+
+	updated, err = setProcsSection("[Env]\n    A = \"1\"", values)
+	assert.NoError(t, err)
+	assert.Equal(t,
+		"[Env]\n    A = \"1\"\n\n[Procs]\n    WrfdaProcCount = \"36\"\n    RealProcCount = \"72\"\n",
+		updated)
+
+	// multi-line arrays are replaced whole, or kept whole
+	values = [][2]string{{"WrfdaDomainProcCount", `["72", "36"]`}}
+	content = "[Procs]\n    WrfdaDomainProcCount = [\n        \"8\", # d01 ]\n        \"4\",\n    ]\n    WrfCycleProcCount = [\n        \"[48]\",\n    ]\n[Env]\n"
+	updated, err = setProcsSection(content, values)
+	assert.NoError(t, err)
+	assert.Equal(t,
+		"[Procs]\n    WrfdaDomainProcCount = [\"72\", \"36\"]\n    WrfCycleProcCount = [\n        \"[48]\",\n    ]\n[Env]\n",
+		updated)
+
+	_, err = setProcsSection("[Procs]\n    RealProcCount = \"\"\"\n4\"\"\"\n", values)
+	assert.EqualError(t, err, "multi-line strings are not supported, edit the [Procs] section by hand")
+}
+
+func TestSplitProcs(t *testing.T) {
+	assert.Equal(t, []int{8, 50, 42}, splitProcs(100, []int{8, 50, 42}))
+	assert.Equal(t, []int{1, 1, 2}, splitProcs(4, []int{1, 1, 98}))
+	// raising small domains to one process never exceeds the total
+	assert.Equal(t, []int{1, 1, 1}, splitProcs(3, []int{1, 1, 98}))
+	assert.Equal(t, []int{1, 1, 1, 2}, splitProcs(5, []int{1, 1, 1, 97}))
+}
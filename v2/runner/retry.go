@@ -0,0 +1,146 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/meteocima/wrfda-runner/v2/conf"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
+)
+
+// stepName returns the name of step `id`, without the cycle.
+func stepName(id string) string {
+	return strings.SplitN(id, "-", 2)[0]
+}
+
+// retryable returns whether `err`, the failure of an attempt
+// of a step that executed processes with status `exits`,
+// is retried by `policy`. Steps stopped because they timed
+// out or the run was interrupted are never retried.
+func retryable(policy conf.RetryPolicy, err error, exits []runctx.Exit) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if policy.Retries(conf.RetryAny) {
+		return true
+	}
+
+	var exitErr *runctx.ExitError
+	if errors.As(err, &exitErr) && policy.Retries(conf.RetryExit) {
+		return true
+	}
+	for _, exit := range exits {
+		if exit.Code != 0 && policy.Retries(conf.RetryExit) {
+			return true
+		}
+	}
+
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	var syscallErr *os.SyscallError
+	isIO := errors.As(err, &pathErr) || errors.As(err, &linkErr) || errors.As(err, &syscallErr)
+	return isIO && policy.Retries(conf.RetryIO)
+}
+
+// exitsDescription returns the exit status of `exits`, to be logged.
+func exitsDescription(exits []runctx.Exit) string {
+	if len(exits) == 0 {
+		return "no processes executed"
+	}
+	descs := make([]string, len(exits))
+	for idx, exit := range exits {
+		descs[idx] = exit.String()
+	}
+	return strings.Join(descs, ", ")
+}
+
+// runAttempt executes step `s` once, killing its
+// processes when they exceed `limit`, if it's set.
+func runAttempt(vs *runctx.Context, s *step, limit time.Duration) {
+	if limit > 0 {
+		stepCtx, cancel := context.WithTimeout(vs.Ctx(), limit)
+		defer cancel()
+		vs = vs.WithContext(stepCtx)
+	}
+	s.run(vs)
+}
+
+// prepareRetry prepares another attempt of step steps[idx]:
+// the directories created by the step are removed, and the
+// step that builds the directory it runs in is executed again.
+func prepareRetry(vs *runctx.Context, steps []*step, idx int) {
+	s := steps[idx]
+	removeDirs(vs, s)
+	if s.BuiltBy == "" {
+		return
+	}
+	for _, builder := range steps[:idx] {
+		if builder.ID == s.BuiltBy {
+			removeDirs(vs, builder)
+			vs.LogInfo("Executing step %s again before retrying step %s", builder.ID, s.ID)
+			builder.run(vs)
+			return
+		}
+	}
+}
+
+func removeDirs(vs *runctx.Context, s *step) {
+	for _, dir := range s.Dirs {
+		if vs.Exists(dir) {
+			vs.LogInfo("Removing `%s` left by step %s", dir.String(), s.ID)
+			vs.RmDir(dir)
+		}
+	}
+}
+
+// runWithRetries executes step steps[idx], retrying its failures
+// as configured by its retry policy, and logs the exit status of
+// the processes executed by every attempt. Each attempt is killed
+// when it exceeds the time limit of the step.
+func runWithRetries(vs *runctx.Context, steps []*step, idx int) {
+	s := steps[idx]
+	name := stepName(s.ID)
+	limit := conf.Config.Timeouts.StepLimit(name)
+	if vs.Plan != nil {
+		runAttempt(vs, s, limit)
+		return
+	}
+
+	policy := conf.Config.Retries.Policy(name)
+	for attempt := 1; ; attempt++ {
+		if wait := policy.BackoffBefore(attempt); wait > 0 {
+			vs.LogInfo("Waiting %s before retrying step %s", wait, s.ID)
+			select {
+			case <-time.After(wait):
+			case <-vs.Ctx().Done():
+				vs.Err = fmt.Errorf("retry of step %s: %w", s.ID, vs.Ctx().Err())
+				return
+			}
+		}
+
+		attemptVS := vs.Clone().TrackExits()
+		if attempt > 1 {
+			prepareRetry(attemptVS, steps, idx)
+		}
+		runAttempt(attemptVS, s, limit)
+		exits := exitsDescription(attemptVS.Exits())
+
+		if attemptVS.Err == nil {
+			if attempt > 1 || len(attemptVS.Exits()) > 0 {
+				vs.LogInfo("Step %s attempt %d of %d completed: %s", s.ID, attempt, policy.MaxAttempts, exits)
+			}
+			return
+		}
+		vs.LogInfo("Step %s attempt %d of %d failed: %s: %s", s.ID, attempt, policy.MaxAttempts, exits, attemptVS.Err)
+
+		if attempt >= policy.MaxAttempts || !retryable(policy, attemptVS.Err, attemptVS.Exits()) {
+			vs.Err = attemptVS.Err
+			return
+		}
+	}
+}
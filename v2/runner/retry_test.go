@@ -0,0 +1,83 @@
+package runner
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/meteocima/virtual-server/connection"
+	"github.com/meteocima/virtual-server/vpath"
+	"github.com/meteocima/wrfda-runner/v2/folders"
+	"github.com/meteocima/wrfda-runner/v2/internal/testutil"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunWithRetries(t *testing.T) {
+	dir := testutil.CopyTestrun(t, nil)
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", testutil.Fixture("testbin")+":"+oldPath)
+	t.Cleanup(func() { os.Setenv("PATH", oldPath) })
+
+	// commands run with the environment of the [Env] section only.
+	failures := path.Join(dir, "mpirun.failures")
+	testutil.AppendToFile(t, path.Join(dir, "wrfda-runner.cfg"), fmt.Sprintf("\n[Procs]\n    WrfstepProcCount = \"4\"\n"+
+		"\n[Env]\n    PATH = \"%s\"\n    FAKE_MPIRUN_FAILURES = \"%s\"\n"+
+		"\n[Retries]\n    Backoff = \"10ms\"\n[Retries.Steps.RunWRFStep]\n    MaxAttempts = 3\n",
+		os.Getenv("PATH"), failures))
+	readTestConfig(t, dir)
+
+	start := time.Date(2020, 12, 25, 0, 0, 0, 0, time.UTC)
+	wrfDir := folders.WRFWorkDir(start, 1)
+	builds := 0
+	steps := []*step{
+		{ID: "BuildWRFDir-1", Dirs: []vpath.VirtualPath{wrfDir}, run: func(vs *runctx.Context) {
+			builds++
+			vs.MkDir(wrfDir)
+			vs.WriteString(wrfDir.Join("wrf.exe"), "#!/bin/sh\necho wrf done > wrf.out\n")
+			vs.Exec(vpath.Local("/bin/chmod"), []string{"+x", "wrf.exe"}, &connection.RunOptions{Cwd: wrfDir})
+		}},
+		{ID: "RunWRFStep-1", BuiltBy: "BuildWRFDir-1", run: func(vs *runctx.Context) {
+			RunWRFStep(vs, start, 1)
+		}},
+	}
+
+	// mpirun fails to start twice, then succeeds.
+	assert.NoError(t, os.WriteFile(failures, []byte("2\n"), 0644))
+	log := &bytes.Buffer{}
+	vs := runctx.New(os.Stdin, log, log)
+	state := NewRunState(start)
+	runSteps(vs, state, steps, false)
+	assert.NoError(t, vs.Err)
+	assert.Equal(t, 3, builds)
+	assert.True(t, state.IsCompleted("RunWRFStep-1"))
+	assert.FileExists(t, wrfDir.Join("wrf.out").Path)
+	assert.Contains(t, log.String(), "Step RunWRFStep-1 attempt 1 of 3 failed: `simulation:mpirun` exited with code 1: `simulation:mpirun` exited with code 1")
+	assert.Contains(t, log.String(), "Step RunWRFStep-1 attempt 3 of 3 completed: `localhost:/bin/chmod` exited with code 0, `simulation:mpirun` exited with code 0")
+
+	// when all attempts fail, the failure of mpirun fails the step.
+	assert.NoError(t, os.WriteFile(failures, []byte("3\n"), 0644))
+	vs = runctx.New(os.Stdin, log, log)
+	state = NewRunState(start)
+	runSteps(vs, state, steps, false)
+	var exitErr *runctx.ExitError
+	if assert.True(t, errors.As(vs.Err, &exitErr)) {
+		assert.Equal(t, 1, exitErr.Code)
+	}
+	assert.False(t, state.IsCompleted("RunWRFStep-1"))
+
+	// failures without a retryable cause are not retried.
+	attempts := 0
+	steps[1] = &step{ID: "RunWRFStep-1", BuiltBy: "BuildWRFDir-1", run: func(vs *runctx.Context) {
+		attempts++
+		vs.Err = errors.New("namelist not valid")
+	}}
+	vs = runctx.New(os.Stdin, log, log)
+	runSteps(vs, NewRunState(start), steps, false)
+	assert.EqualError(t, vs.Err, "namelist not valid")
+	assert.Equal(t, 1, attempts)
+}
@@ -1,65 +1,70 @@
 package runner
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/meteocima/namelist-prepare/namelist"
 	vsConfig "github.com/meteocima/virtual-server/config"
-	"github.com/meteocima/virtual-server/ctx"
 	"github.com/meteocima/virtual-server/vpath"
 	"github.com/meteocima/wrfda-runner/v2/conf"
 	"github.com/meteocima/wrfda-runner/v2/folders"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
 	"github.com/parro-it/fileargs"
 )
 
-// ReadDomainCount ...
-func ReadDomainCount(vs *ctx.Context, phase conf.RunPhase) int {
+// domainCounts caches the values returned by ReadDomainCount,
+// keyed by namelist, until the configuration is read again.
+var domainCounts = map[string]int{}
+var domainCountsLock sync.Mutex
+
+// ReadDomainCount returns max_dom of the namelist used by `phase`.
+// The namelist is read only the first time after initConfig.
+func ReadDomainCount(vs *runctx.Context, phase conf.RunPhase) int {
 	if vs.Err != nil {
 		return 0
 	}
-	nmlDir := conf.Config.Folders.NamelistsDir
 	namelistToReadMaxDom := "namelist.step.wrf"
 	if phase == conf.WPSPhase || phase == conf.WPSThenDAPhase {
 		namelistToReadMaxDom = "namelist.wps"
 	}
 
-	fileName := nmlDir.Join(namelistToReadMaxDom)
-	content := vs.ReadString(fileName)
-
-	rows := strings.Split(string(content), "\n")
-	//fsutil.LogF(rows)
+	domainCountsLock.Lock()
+	defer domainCountsLock.Unlock()
+	if value, ok := domainCounts[namelistToReadMaxDom]; ok {
+		return value
+	}
 
-	for _, line := range rows {
-		trimdLine := strings.TrimLeft(line, " \t")
-		if strings.HasPrefix(trimdLine, "max_dom") {
-			fields := strings.Split(trimdLine, "=")
-			if len(fields) < 2 {
-				vs.Err = fmt.Errorf("malformed max_dom property in `%s`: %s", fileName.String(), trimdLine)
-				return 0
-			}
-			valueS := strings.Trim(fields[1], " \t,")
-			value, err := strconv.Atoi(valueS)
-			if err != nil {
-				vs.Err = fmt.Errorf("cannot convert max_dom `%s` to integer: %w", valueS, err)
-				return 0
-			}
-			return value
-		}
+	// max_dom doesn't depend on dates, so
+	// the template is rendered with zero args.
+	nl := conf.ReadNamelist(vs, namelistToReadMaxDom, namelist.Args{})
+	if vs.Err != nil {
+		return 0
 	}
 
-	vs.Err = fmt.Errorf("max_dom property not found in %s", fileName)
-	return 0
+	value, err := nl.Int("max_dom")
+	if err != nil {
+		vs.Err = fmt.Errorf("cannot read max_dom from `%s`: %w", conf.NamelistFile(namelistToReadMaxDom).String(), err)
+		return 0
+	}
+	domainCounts[namelistToReadMaxDom] = value
+	return value
 }
 
-// Init ...
-func Init(cfgFile, workdir vpath.VirtualPath) error {
+// initConfig reads the configuration from `cfgFile`
+// and sets the root work directory to `workdir`.
+func initConfig(cfgFile, workdir vpath.VirtualPath) error {
 	folders.Root = workdir
 
+	domainCountsLock.Lock()
+	domainCounts = map[string]int{}
+	domainCountsLock.Unlock()
+
 	err := vsConfig.Init(cfgFile.Path)
 	if err != nil {
 		return err
@@ -71,12 +76,40 @@ func Init(cfgFile, workdir vpath.VirtualPath) error {
 	}
 
 	folders.Cfg = conf.Config.Folders
+	folders.Cycles = conf.Config.Cycles
 	return nil
 }
 
+// Init reads the configuration from `cfgFile`, and checks
+// that namelist templates needed by `phase` are consistent.
+func Init(cfgFile, workdir vpath.VirtualPath, phase conf.RunPhase) error {
+	err := initConfig(cfgFile, workdir)
+	if err != nil {
+		return err
+	}
+
+	vs := runctx.New(os.Stdin, io.Discard, io.Discard)
+	problems := checkNamelists(vs, phase)
+	if len(problems) > 0 {
+		return fmt.Errorf("inconsistent namelists in `%s`:\n  - %s",
+			conf.Config.Folders.NamelistsDir.String(), strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
+
+// CheckNamelists reads the configuration from `cfgFile` and
+// checks that namelist templates needed by `phase` are
+// consistent. It returns the list of all problems found.
+func CheckNamelists(cfgFile, workdir vpath.VirtualPath, phase conf.RunPhase, logWriter io.Writer, detailLogWriter io.Writer) []string {
+	if err := initConfig(cfgFile, workdir); err != nil {
+		return []string{fmt.Sprintf("cannot read configuration `%s`: %s", cfgFile.String(), err)}
+	}
+	return checkNamelists(runctx.New(os.Stdin, logWriter, detailLogWriter), phase)
+}
+
 // RemoveRunFolder ...
 func RemoveRunFolder(startDate time.Time, workdir vpath.VirtualPath, logWriter io.Writer, detailLogWriter io.Writer) error {
-	vs := ctx.New(os.Stdin, logWriter, detailLogWriter)
+	vs := runctx.New(os.Stdin, logWriter, detailLogWriter)
 
 	dtWorkdir := folders.WorkdirForDate(startDate)
 
@@ -87,14 +120,34 @@ func RemoveRunFolder(startDate time.Time, workdir vpath.VirtualPath, logWriter i
 	return vs.Err
 }
 
-// Run ...
-func Run(periods []*fileargs.Period, workdir vpath.VirtualPath, phase conf.RunPhase, input conf.InputDataset,
+// Run executes the runs for all `periods`. When `ctx` is
+// cancelled, the running programs are killed, and the step
+// interrupted is recorded in the run state, so that the
+// run can be resumed from it.
+func Run(ctx context.Context, periods []*fileargs.Period, workdir vpath.VirtualPath, phase conf.RunPhase, input conf.InputDataset, resume bool,
 	logWriter io.Writer, detailLogWriter io.Writer,
 ) error {
-	vs := ctx.New(os.Stdin, logWriter, detailLogWriter)
+	vs := runctx.New(os.Stdin, logWriter, detailLogWriter).WithContext(ctx)
+	runPeriods(vs, periods, workdir, phase, input, resume)
+	return vs.Err
+}
 
+// Plan drives the same steps executed by Run, recording
+// the operations that would be performed without executing them.
+// It returns the recorded plan, and an error if any of the
+// files needed cannot be resolved.
+func Plan(periods []*fileargs.Period, workdir vpath.VirtualPath, phase conf.RunPhase, input conf.InputDataset, resume bool,
+	logWriter io.Writer, detailLogWriter io.Writer,
+) (*runctx.Plan, error) {
+	vs := runctx.NewPlanning(os.Stdin, logWriter, detailLogWriter)
+	runPeriods(vs, periods, workdir, phase, input, resume)
+	return vs.Plan, vs.Err
+}
+
+func runPeriods(vs *runctx.Context, periods []*fileargs.Period, workdir vpath.VirtualPath, phase conf.RunPhase, input conf.InputDataset, resume bool) {
 	if !vs.Exists(workdir) {
-		return fmt.Errorf("directory not found: %s", workdir.String())
+		vs.Err = fmt.Errorf("directory not found: %s", workdir.String())
+		return
 	}
 
 	domainCount := ReadDomainCount(vs, phase)
@@ -103,38 +156,38 @@ func Run(periods []*fileargs.Period, workdir vpath.VirtualPath, phase conf.RunPh
 		start := period.Start
 		duration := period.Duration
 		vs.LogInfo("STARTING RUN FOR DATE %s, with a duration of %d", start.Format("2006010215"), int(duration.Hours()))
-		dir := folders.WorkdirForDate(start)
-		BuildWorkdirForDate(vs, dir, phase, start, true)
-		runWRFDA(vs, phase, start, start.Add(duration), input, domainCount)
+
+		state := NewRunState(start)
+		if resume {
+			state = ReadRunState(vs, start)
+		}
+
+		runWRFDA(vs, state, phase, start, start.Add(duration), input, domainCount, resume)
 		if vs.Err == nil {
 			vs.LogInfo("RUN FOR DATE %s COMPLETED", start.Format("2006010215"))
 		}
 	}
-
-	return vs.Err
 }
 
-func runWRFDA(vs *ctx.Context, phase conf.RunPhase, startDate, endDate time.Time, ds conf.InputDataset, domainCount int) {
+func runWRFDA(vs *runctx.Context, state *RunState, phase conf.RunPhase, startDate, endDate time.Time, ds conf.InputDataset, domainCount int, resume bool) {
 	if vs.Err != nil {
 		return
 	}
 
-	if phase == conf.WPSPhase || phase == conf.WPSThenDAPhase {
-		BuildWPSDir(vs, startDate, endDate, ds)
-		RunWPS(vs, startDate, endDate)
-		for cycle := 1; cycle <= 3; cycle++ {
-			BuildNamelistForReal(vs, startDate, endDate, cycle)
-			RunReal(vs, startDate, cycle, phase)
-		}
+	if limit := conf.Config.Timeouts.DateLimit(); limit > 0 {
+		dateCtx, cancel := context.WithTimeout(vs.Ctx(), limit)
+		defer cancel()
+		vs = vs.WithContext(dateCtx)
 	}
 
-	if phase == conf.DAPhase || phase == conf.WPSThenDAPhase {
-		for cycle := 1; cycle <= 3; cycle++ {
-			BuildDAStepDir(vs, startDate, endDate, cycle, "simulation", true)
-			RunDAStep(vs, startDate, cycle)
+	steps := planSteps(state, phase, startDate, endDate, ds, domainCount)
+	runSteps(vs, state, steps, resume)
 
-			BuildWRFDir(vs, startDate, endDate, cycle, "simulation", true)
-			RunWRFStep(vs, startDate, cycle)
+	if vs.Err == nil {
+		for _, report := range state.Cycles {
+			if report.NoAssimilation {
+				vs.LogInfo("WARNING: forecast for %s produced with %s", startDate.Format("2006010215"), report)
+			}
 		}
 	}
 }
@@ -156,7 +209,7 @@ const (
 // RunSingleStep ...
 func RunSingleStep(startDate time.Time, ds conf.InputDataset, cycle int, stepType StepType, logWriter io.Writer, detailLogWriter io.Writer) {
 	endDate := startDate.Add(48 * time.Hour)
-	vs := ctx.New(os.Stdin, logWriter, detailLogWriter)
+	vs := runctx.New(os.Stdin, logWriter, detailLogWriter)
 	//domainCount := ReadDomainCount(vs, phase)
 
 	switch stepType {
@@ -176,35 +229,8 @@ func RunSingleStep(startDate time.Time, ds conf.InputDataset, cycle int, stepTyp
 	}
 }
 
-func cpObservations(vs *ctx.Context, cycle int, startDate time.Time, host string) {
-	vs.LogInfo("Copy radar for date %s", startDate.Format("200601021504"))
-
-	src := folders.RadarObsArchive(startDate, cycle)
-	dst := folders.RadarObsForDate(startDate, cycle, host)
-
-	vs.LogInfo("Copy radar for cycle %d to %s: %s -> %s", cycle, host, src, dst)
-	vs.Copy(src, dst)
-	if vs.Err == nil {
-		vs.LogInfo("Copy done")
-	} else {
-		vs.LogInfo("Radar not found. Try with alternative name")
-		vs.Err = nil
-		src = folders.AlternativeRadarObsArchive(startDate, cycle)
-		vs.LogInfo("Copy radar for cycle %d to %s: %s -> %s", cycle, host, src, dst)
-		vs.Copy(src, dst)
-	}
-
-	src = folders.StationsObsArchive(startDate, cycle)
-	if vs.Exists(src) {
-		dst = folders.StationsObsForDate(startDate, cycle, host)
-		vs.LogInfo("Copy observations for cycle %d to %s: %s -> %s", cycle, host, src, dst)
-		vs.Copy(src, dst)
-		vs.LogInfo("Copy done")
-	}
-}
-
 // BuildWorkdirForDate ...
-func BuildWorkdirForDate(vs *ctx.Context, workdir vpath.VirtualPath, phase conf.RunPhase, startDate time.Time, mainHost bool) {
+func BuildWorkdirForDate(vs *runctx.Context, workdir vpath.VirtualPath, phase conf.RunPhase, startDate time.Time, mainHost bool) {
 	if vs.Err != nil {
 		return
 	}
@@ -266,15 +292,28 @@ func BuildWorkdirForDate(vs *ctx.Context, workdir vpath.VirtualPath, phase conf.
 
 	// Observations - weather stations and radars
 	if mainHost && (phase == conf.DAPhase || phase == conf.WPSThenDAPhase) {
+		cycleCount := conf.Config.Cycles.Count
 		alldone = sync.WaitGroup{}
-		alldone.Add(3)
-
-		for i := 0; i < 3; i++ {
+		alldone.Add(cycleCount)
+
+		// each cycle uses its own context, so that
+		// a missing radar file in a cycle does not
+		// interfere with the copies of the others.
+		cycleCtxs := make([]*runctx.Context, cycleCount)
+		for i := 0; i < cycleCount; i++ {
+			cycleCtxs[i] = vs.Clone()
 			go func(i int) {
-				cpObservations(vs, i+1, startDate, h)
+				cpObservations(cycleCtxs[i], i+1, startDate, h)
 				alldone.Done()
 			}(i)
 		}
 		alldone.Wait()
+
+		for _, cycleCtx := range cycleCtxs {
+			if cycleCtx.Err != nil {
+				vs.Err = cycleCtx.Err
+				return
+			}
+		}
 	}
 }
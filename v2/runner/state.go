@@ -0,0 +1,216 @@
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/meteocima/wrfda-runner/v2/conf"
+	"github.com/meteocima/wrfda-runner/v2/folders"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
+)
+
+// StepStatus is the status of a
+// step recorded in the run state file.
+type StepStatus string
+
+const (
+	// StepCompleted - the step completed successfully
+	StepCompleted StepStatus = "completed"
+	// StepTimedOut - the step was killed because
+	// it exceeded its time limit
+	StepTimedOut StepStatus = "timed-out"
+	// StepInterrupted - the step was killed
+	// because the run was cancelled
+	StepInterrupted StepStatus = "interrupted"
+)
+
+// StepState contains the recorded
+// status of a single step.
+type StepState struct {
+	ID     string
+	Status StepStatus
+	Time   time.Time
+}
+
+// RunState is the persistent state of the
+// run for a date. It is saved to the file returned
+// by folders.StateFile after each step completes,
+// and it's used to resume interrupted runs.
+type RunState struct {
+	Start time.Time
+	Steps []*StepState
+
+	// GuidingRuns contains, for the prefix of each
+	// ungrib source, the reference time of the guiding
+	// run used as initial and boundary conditions.
+	GuidingRuns map[string]time.Time `json:",omitempty"`
+
+	// Cycles contains the report of each
+	// assimilation cycle already executed.
+	Cycles []*CycleReport `json:",omitempty"`
+
+	// Jobs contains the batch jobs submitted
+	// to run the steps of the date, in order.
+	Jobs []*BatchJob `json:",omitempty"`
+}
+
+// BatchJob records a batch job submitted
+// to run a group of steps.
+type BatchJob struct {
+	Name      string
+	ID        string
+	Submitted time.Time
+}
+
+// CycleReport records the observations
+// assimilated by a cycle.
+type CycleReport struct {
+	Cycle int
+
+	// MissingObservations are the types of
+	// observations not available for the cycle.
+	MissingObservations []conf.ObsType `json:",omitempty"`
+
+	// NoAssimilation is true when the cycle
+	// passed its first guess through unchanged,
+	// for the reason explained by Reason.
+	NoAssimilation bool   `json:",omitempty"`
+	Reason         string `json:",omitempty"`
+
+	// Domains, if set, are the only domains
+	// whose first guess was passed through.
+	Domains []int `json:",omitempty"`
+}
+
+// String returns a description of the
+// assimilation outcome of the cycle.
+func (report *CycleReport) String() string {
+	if report.NoAssimilation && len(report.Domains) > 0 {
+		domains := make([]string, len(report.Domains))
+		for idx, domain := range report.Domains {
+			domains[idx] = fmt.Sprintf("d%02d", domain)
+		}
+		return fmt.Sprintf("no assimilation in cycle %d for domains %s: %s", report.Cycle, strings.Join(domains, ", "), report.Reason)
+	}
+	if report.NoAssimilation {
+		return fmt.Sprintf("no assimilation in cycle %d: %s", report.Cycle, report.Reason)
+	}
+	if len(report.MissingObservations) > 0 {
+		missing := make([]string, len(report.MissingObservations))
+		for idx, obs := range report.MissingObservations {
+			missing[idx] = string(obs)
+		}
+		return fmt.Sprintf("cycle %d assimilated without %s observations", report.Cycle, strings.Join(missing, ", "))
+	}
+	return fmt.Sprintf("cycle %d assimilated all observations", report.Cycle)
+}
+
+// NewRunState returns an empty state
+// for a run starting at `start`.
+func NewRunState(start time.Time) *RunState {
+	return &RunState{
+		Start: start,
+		Steps: []*StepState{},
+	}
+}
+
+// ReadRunState reads the state of the run for date
+// `start`. If the state file does not exists, an empty
+// state is returned.
+func ReadRunState(vs *runctx.Context, start time.Time) *RunState {
+	if vs.Err != nil {
+		return nil
+	}
+
+	file := folders.StateFile(start)
+	if !vs.Exists(file) {
+		return NewRunState(start)
+	}
+
+	content := vs.ReadString(file)
+	if vs.Err != nil {
+		return nil
+	}
+
+	state := NewRunState(start)
+	err := json.Unmarshal([]byte(content), state)
+	if err != nil {
+		vs.Err = fmt.Errorf("cannot parse state file `%s`: %w", file.String(), err)
+		return nil
+	}
+
+	return state
+}
+
+// Save writes the state to the file
+// returned by folders.StateFile.
+// Nothing is saved while planning a run.
+func (state *RunState) Save(vs *runctx.Context) {
+	if vs.Err != nil || vs.Plan != nil {
+		return
+	}
+
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		vs.Err = fmt.Errorf("cannot serialize run state: %w", err)
+		return
+	}
+
+	file := folders.StateFile(state.Start)
+	vs.MkDir(file.Dir())
+	vs.WriteString(file, string(content))
+}
+
+// Step returns the recorded state of step `id`,
+// or nil if the step was never recorded.
+func (state *RunState) Step(id string) *StepState {
+	for _, step := range state.Steps {
+		if step.ID == id {
+			return step
+		}
+	}
+	return nil
+}
+
+// IsCompleted returns true if step `id`
+// was recorded as completed.
+func (state *RunState) IsCompleted(id string) bool {
+	step := state.Step(id)
+	return step != nil && step.Status == StepCompleted
+}
+
+// SetStatus records `status` for step `id`.
+func (state *RunState) SetStatus(id string, status StepStatus) {
+	step := state.Step(id)
+	if step == nil {
+		step = &StepState{ID: id}
+		state.Steps = append(state.Steps, step)
+	}
+	step.Status = status
+	step.Time = time.Now().UTC()
+}
+
+// Forget removes any recorded
+// status for step `id`.
+func (state *RunState) Forget(id string) {
+	for idx, step := range state.Steps {
+		if step.ID == id {
+			state.Steps = append(state.Steps[:idx], state.Steps[idx+1:]...)
+			return
+		}
+	}
+}
+
+// SetCycleReport records `report`, replacing
+// any previous report for the same cycle.
+func (state *RunState) SetCycleReport(report *CycleReport) {
+	for idx, existing := range state.Cycles {
+		if existing.Cycle == report.Cycle {
+			state.Cycles[idx] = report
+			return
+		}
+	}
+	state.Cycles = append(state.Cycles, report)
+}
@@ -0,0 +1,291 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/meteocima/virtual-server/vpath"
+	"github.com/meteocima/wrfda-runner/v2/conf"
+	"github.com/meteocima/wrfda-runner/v2/folders"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
+)
+
+// step is a unit of work of the run for a date,
+// whose completion is recorded in the run state.
+type step struct {
+	// ID identifies the step in the state file
+	ID string
+
+	// Dirs are the paths created by the step. They are
+	// removed before executing the step again on resume.
+	Dirs []vpath.VirtualPath
+
+	// BuiltBy is the ID of the step that prepares the
+	// directory this step runs in. When a run is resumed
+	// from this step, that one is executed again too.
+	BuiltBy string
+
+	run func(vs *runctx.Context)
+}
+
+// TimeoutError is the error of a step
+// interrupted because a time limit was exceeded.
+type TimeoutError struct {
+	Step string
+	// Limit is the time limit exceeded.
+	Limit time.Duration
+	// Date is true when Limit is the one of
+	// the whole run for the date, false when
+	// it's the one of the step.
+	Date bool
+	Err  error
+}
+
+func (err *TimeoutError) Error() string {
+	if err.Date {
+		return fmt.Sprintf("step %s timed out: run for the date exceeded its limit of %s", err.Step, err.Limit)
+	}
+	return fmt.Sprintf("step %s timed out after %s", err.Step, err.Limit)
+}
+
+func (err *TimeoutError) Unwrap() error {
+	return err.Err
+}
+
+// InterruptedError is the error of a step
+// interrupted because the run was cancelled.
+type InterruptedError struct {
+	Step string
+	Err  error
+}
+
+func (err *InterruptedError) Error() string {
+	return fmt.Sprintf("step %s interrupted", err.Step)
+}
+
+func (err *InterruptedError) Unwrap() error {
+	return err.Err
+}
+
+// stopError returns the error of step `id` when `err` was caused
+// by the context of `vs` being done, or nil otherwise. `limit`
+// is the time limit of the step.
+func stopError(vs *runctx.Context, id string, limit time.Duration, err error) error {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return &InterruptedError{Step: id, Err: err}
+	case !errors.Is(err, context.DeadlineExceeded):
+		return nil
+	case vs.Ctx().Err() != nil:
+		return &TimeoutError{Step: id, Limit: conf.Config.Timeouts.DateLimit(), Date: true, Err: err}
+	default:
+		return &TimeoutError{Step: id, Limit: limit, Err: err}
+	}
+}
+
+// stopSteps sets `err`, returned by stopError for step
+// `id`, as the error of `vs`, and records in `state` that
+// the step was interrupted or timed out.
+func stopSteps(vs *runctx.Context, state *RunState, id string, err error) {
+	status := StepTimedOut
+	if _, interrupted := err.(*InterruptedError); interrupted {
+		status = StepInterrupted
+	}
+	vs.Err = err
+	vs.LogInfo("%s", err)
+	state.SetStatus(id, status)
+	state.Save(vs.Clone())
+}
+
+func cycleStepID(name string, cycle int) string {
+	return fmt.Sprintf("%s-%d", name, cycle)
+}
+
+// planSteps returns the ordered list of steps
+// needed to execute `phase` for a date.
+func planSteps(state *RunState, phase conf.RunPhase, startDate, endDate time.Time, ds conf.InputDataset, domainCount int) []*step {
+	steps := []*step{}
+	dateDir := folders.WorkdirForDate(startDate)
+
+	steps = append(steps, &step{
+		ID: "BuildWorkdir",
+		Dirs: []vpath.VirtualPath{
+			dateDir.Join("geodata"),
+			dateDir.Join("wpsprg"),
+			dateDir.Join("wrfdaprg"),
+			dateDir.Join("wrfprgrun"),
+			dateDir.Join("wrfprgstep"),
+			dateDir.Join("observations"),
+			dateDir.Join("gfs"),
+		},
+		run: func(vs *runctx.Context) {
+			BuildWorkdirForDate(vs, dateDir, phase, startDate, true)
+		},
+	})
+
+	if phase == conf.WPSPhase || phase == conf.WPSThenDAPhase {
+		steps = append(steps, &step{
+			ID:   "BuildWPSDir",
+			Dirs: []vpath.VirtualPath{folders.WPSWorkDir(startDate)},
+			run: func(vs *runctx.Context) {
+				BuildWPSDir(vs, startDate, endDate, ds)
+			},
+		}, &step{
+			ID:      "RunWPS",
+			BuiltBy: "BuildWPSDir",
+			run: func(vs *runctx.Context) {
+				runs := RunWPS(vs, startDate, endDate, ds)
+				if vs.Err == nil {
+					state.GuidingRuns = runs
+				}
+			},
+		})
+
+		for cycle := 1; cycle <= conf.Config.Cycles.Count; cycle++ {
+			cycle := cycle
+			steps = append(steps, &step{
+				ID: cycleStepID("RunReal", cycle),
+				run: func(vs *runctx.Context) {
+					BuildNamelistForReal(vs, startDate, endDate, cycle)
+					RunReal(vs, startDate, cycle, phase)
+				},
+			})
+		}
+	}
+
+	if phase == conf.DAPhase || phase == conf.WPSThenDAPhase {
+		for cycle := 1; cycle <= conf.Config.Cycles.Count; cycle++ {
+			cycle := cycle
+
+			daDirs := make([]vpath.VirtualPath, domainCount)
+			for domain := 1; domain <= domainCount; domain++ {
+				daDirs[domain-1] = folders.DAWorkDir(startDate, domain, cycle)
+			}
+
+			buildDAID := cycleStepID("BuildDAStepDir", cycle)
+			buildWRFID := cycleStepID("BuildWRFDir", cycle)
+
+			steps = append(steps, &step{
+				ID:   buildDAID,
+				Dirs: daDirs,
+				run: func(vs *runctx.Context) {
+					BuildDAStepDir(vs, startDate, endDate, cycle, "simulation", true)
+				},
+			}, &step{
+				ID:      cycleStepID("RunDAStep", cycle),
+				BuiltBy: buildDAID,
+				run: func(vs *runctx.Context) {
+					report := RunDAStep(vs, startDate, cycle)
+					if vs.Err == nil {
+						vs.LogInfo("%s", report)
+						state.SetCycleReport(report)
+					}
+				},
+			}, &step{
+				ID:   buildWRFID,
+				Dirs: []vpath.VirtualPath{folders.WRFWorkDir(startDate, cycle)},
+				run: func(vs *runctx.Context) {
+					BuildWRFDir(vs, startDate, endDate, cycle, "simulation", true)
+				},
+			}, &step{
+				ID:      cycleStepID("RunWRFStep", cycle),
+				BuiltBy: buildWRFID,
+				run: func(vs *runctx.Context) {
+					RunWRFStep(vs, startDate, cycle)
+				},
+			})
+		}
+	}
+
+	return steps
+}
+
+// resumeFrom returns the index of the step from which
+// a run with recorded `state` should be resumed, or
+// len(steps) if all steps are already completed.
+func resumeFrom(steps []*step, state *RunState) int {
+	first := len(steps)
+	for idx, s := range steps {
+		if !state.IsCompleted(s.ID) {
+			first = idx
+			break
+		}
+	}
+
+	if first == len(steps) || steps[first].BuiltBy == "" {
+		return first
+	}
+
+	for idx := first - 1; idx >= 0; idx-- {
+		if steps[idx].ID == steps[first].BuiltBy {
+			return idx
+		}
+	}
+
+	return first
+}
+
+// runSteps executes `steps` in order, recording each
+// completed one in `state`. When `resume` is true, the
+// steps already completed are skipped, and the run
+// restarts from the first incomplete one.
+func runSteps(vs *runctx.Context, state *RunState, steps []*step, resume bool) {
+	if vs.Err != nil {
+		return
+	}
+
+	first := 0
+	if resume {
+		first = resumeFrom(steps, state)
+		if first == len(steps) {
+			vs.LogInfo("All steps already completed")
+			return
+		}
+		vs.LogInfo("Resuming run from step %s", steps[first].ID)
+	}
+
+	// steps after the restart point depend on the
+	// ones re-executed, so they are executed again too.
+	for _, s := range steps[first:] {
+		state.Forget(s.ID)
+	}
+
+	for idx, s := range steps {
+		if idx < first {
+			vs.LogInfo("Skipping step %s: already completed", s.ID)
+			continue
+		}
+
+		if resume {
+			for _, dir := range s.Dirs {
+				if vs.Exists(dir) {
+					vs.LogInfo("Removing `%s` left by an incomplete run", dir.String())
+					vs.RmDir(dir)
+				}
+			}
+		}
+
+		if vs.Plan != nil {
+			vs.Plan.Step = fmt.Sprintf("%s %s", state.Start.Format("2006010215"), s.ID)
+		}
+
+		if err := vs.Ctx().Err(); err != nil {
+			stopSteps(vs, state, s.ID, stopError(vs, s.ID, 0, err))
+			return
+		}
+
+		runWithRetries(vs, steps, idx)
+
+		if vs.Err != nil {
+			if err := stopError(vs, s.ID, conf.Config.Timeouts.StepLimit(stepName(s.ID)), vs.Err); err != nil {
+				stopSteps(vs, state, s.ID, err)
+			}
+			return
+		}
+
+		state.SetStatus(s.ID, StepCompleted)
+		state.Save(vs)
+	}
+}
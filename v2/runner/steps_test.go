@@ -0,0 +1,145 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/meteocima/virtual-server/connection"
+	"github.com/meteocima/virtual-server/vpath"
+	"github.com/meteocima/wrfda-runner/v2/conf"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResumeFrom(t *testing.T) {
+	steps := []*step{
+		{ID: "BuildWPSDir"},
+		{ID: "RunWPS", BuiltBy: "BuildWPSDir"},
+		{ID: "RunReal-1"},
+	}
+
+	state := NewRunState(time.Date(2020, 12, 25, 0, 0, 0, 0, time.UTC))
+	assert.Equal(t, 0, resumeFrom(steps, state))
+
+	state.SetStatus("BuildWPSDir", StepCompleted)
+	assert.Equal(t, 0, resumeFrom(steps, state))
+
+	state.SetStatus("RunWPS", StepCompleted)
+	assert.Equal(t, 2, resumeFrom(steps, state))
+
+	state.SetStatus("RunReal-1", StepCompleted)
+	assert.Equal(t, 3, resumeFrom(steps, state))
+
+	state.Forget("RunWPS")
+	assert.False(t, state.IsCompleted("RunWPS"))
+	assert.Equal(t, 0, resumeFrom(steps, state))
+}
+
+func TestStepNames(t *testing.T) {
+	initTestrun(t, "")
+
+	start := time.Date(2020, 12, 25, 0, 0, 0, 0, time.UTC)
+	steps := planSteps(NewRunState(start), conf.WPSThenDAPhase, start, start.Add(48*time.Hour), conf.GFS, 1)
+	for _, s := range steps {
+		assert.Contains(t, conf.StepNames, stepName(s.ID))
+	}
+}
+
+func TestRunStepsTimeout(t *testing.T) {
+	_, wd := initTestrun(t, "\n[Timeouts.Steps]\n    RunReal = \"300ms\"\n")
+
+	oldGrace := runctx.KillGrace
+	runctx.KillGrace = 100 * time.Millisecond
+	t.Cleanup(func() { runctx.KillGrace = oldGrace })
+
+	start := time.Date(2020, 12, 25, 0, 0, 0, 0, time.UTC)
+	sleep := func(vs *runctx.Context) {
+		vs.Exec(vpath.Local("/bin/sleep"), []string{"30"}, &connection.RunOptions{Cwd: wd})
+	}
+	var ran []string
+	steps := []*step{
+		{ID: "BuildWorkdir", run: func(vs *runctx.Context) { ran = append(ran, "BuildWorkdir") }},
+		{ID: "RunReal-1", run: sleep},
+		{ID: "RunDAStep-1", run: func(vs *runctx.Context) { ran = append(ran, "RunDAStep-1") }},
+	}
+
+	vs := runctx.New(os.Stdin, io.Discard, io.Discard)
+	state := NewRunState(start)
+	runSteps(vs, state, steps, false)
+
+	var timeout *TimeoutError
+	if assert.True(t, errors.As(vs.Err, &timeout)) {
+		assert.Equal(t, "RunReal-1", timeout.Step)
+		assert.False(t, timeout.Date)
+		assert.ErrorIs(t, vs.Err, context.DeadlineExceeded)
+		assert.EqualError(t, timeout, "step RunReal-1 timed out after 300ms")
+	}
+	assert.Equal(t, []string{"BuildWorkdir"}, ran)
+
+	state = ReadRunState(runctx.New(os.Stdin, io.Discard, io.Discard), start)
+	assert.Equal(t, StepTimedOut, state.Step("RunReal-1").Status)
+	assert.True(t, state.IsCompleted("BuildWorkdir"))
+}
+
+func TestRunStepsInterrupted(t *testing.T) {
+	_, wd := initTestrun(t, "")
+
+	oldGrace := runctx.KillGrace
+	runctx.KillGrace = 100 * time.Millisecond
+	t.Cleanup(func() { runctx.KillGrace = oldGrace })
+
+	start := time.Date(2020, 12, 25, 0, 0, 0, 0, time.UTC)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	steps := []*step{
+		{ID: "BuildWorkdir", run: func(vs *runctx.Context) { time.AfterFunc(200*time.Millisecond, cancel) }},
+		{ID: "RunReal-1", run: func(vs *runctx.Context) {
+			vs.Exec(vpath.Local("/bin/sleep"), []string{"30"}, &connection.RunOptions{Cwd: wd})
+		}},
+		{ID: "RunDAStep-1", run: func(vs *runctx.Context) {}},
+	}
+
+	vs := runctx.New(os.Stdin, io.Discard, io.Discard).WithContext(ctx)
+	state := NewRunState(start)
+	runSteps(vs, state, steps, false)
+
+	var interrupted *InterruptedError
+	if assert.True(t, errors.As(vs.Err, &interrupted)) {
+		assert.Equal(t, "RunReal-1", interrupted.Step)
+		assert.ErrorIs(t, vs.Err, context.Canceled)
+		assert.EqualError(t, interrupted, "step RunReal-1 interrupted")
+	}
+
+	state = ReadRunState(runctx.New(os.Stdin, io.Discard, io.Discard), start)
+	assert.Equal(t, StepInterrupted, state.Step("RunReal-1").Status)
+	assert.Equal(t, 1, resumeFrom(steps, state))
+}
+
+func TestRunStepsInterruptedBetweenSteps(t *testing.T) {
+	initTestrun(t, "")
+
+	start := time.Date(2020, 12, 25, 0, 0, 0, 0, time.UTC)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	realRun := false
+	steps := []*step{
+		{ID: "BuildWorkdir", run: func(vs *runctx.Context) { cancel() }},
+		{ID: "RunReal-1", run: func(vs *runctx.Context) { realRun = true }},
+	}
+
+	vs := runctx.New(os.Stdin, io.Discard, io.Discard).WithContext(ctx)
+	runSteps(vs, NewRunState(start), steps, false)
+	assert.False(t, realRun)
+	var interrupted *InterruptedError
+	if assert.True(t, errors.As(vs.Err, &interrupted)) {
+		assert.Equal(t, "RunReal-1", interrupted.Step)
+	}
+
+	state := ReadRunState(runctx.New(os.Stdin, io.Discard, io.Discard), start)
+	assert.Equal(t, StepCompleted, state.Step("BuildWorkdir").Status)
+	assert.Equal(t, StepInterrupted, state.Step("RunReal-1").Status)
+}
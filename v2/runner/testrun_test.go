@@ -0,0 +1,28 @@
+package runner
+
+import (
+	"path"
+	"testing"
+
+	"github.com/meteocima/virtual-server/vpath"
+	"github.com/meteocima/wrfda-runner/v2/internal/testutil"
+)
+
+// readTestConfig reads the configuration of the copy of
+// testrun fixture in `dir`, and returns `dir` as workdir.
+func readTestConfig(t *testing.T, dir string) vpath.VirtualPath {
+	wd := vpath.Local(dir)
+	if err := initConfig(wd.Join("wrfda-runner.cfg"), wd); err != nil {
+		t.Fatal(err)
+	}
+	return wd
+}
+
+// initTestrun copies testrun fixture in a temporary directory,
+// appends `cfg` to its configuration and reads it. It returns
+// the directory, and the same directory as workdir.
+func initTestrun(t *testing.T, cfg string) (string, vpath.VirtualPath) {
+	dir := testutil.CopyTestrun(t, nil)
+	testutil.AppendToFile(t, path.Join(dir, "wrfda-runner.cfg"), cfg)
+	return dir, readTestConfig(t, dir)
+}
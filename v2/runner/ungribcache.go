@@ -0,0 +1,233 @@
+package runner
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/meteocima/virtual-server/connection"
+	"github.com/meteocima/virtual-server/vpath"
+	"github.com/meteocima/wrfda-runner/v2/conf"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
+)
+
+// ungribCacheLockPoll is the interval between two
+// attempts to acquire the lock of an ungrib cache entry.
+var ungribCacheLockPoll = 10 * time.Second
+
+// ungribCacheLockTimeout is the maximum time waited for
+// another run to release the lock of an ungrib cache entry.
+var ungribCacheLockTimeout = 2 * time.Hour
+
+// ungribCache is an entry of the ungrib cache: a directory
+// containing the intermediate files written by ungrib for a
+// source of a dataset, from a guiding run, with a Vtable.
+//
+// Each file is copied in the entry with a hidden name and
+// then published by a symbolic link, that is created atomically,
+// so that files partially copied by a failed run are never used.
+// The entry is locked while ungrib runs, so that concurrent
+// runs don't ungrib the same files twice.
+type ungribCache struct {
+	dir    vpath.VirtualPath
+	prefix string
+	locked bool
+	// owner is the file linked by the lock, that
+	// contains the host and pid of the runner.
+	owner vpath.VirtualPath
+}
+
+// intermediateFile returns the name of the intermediate
+// file written by ungrib for fields valid at `dt`.
+func intermediateFile(prefix string, dt time.Time) string {
+	return fmt.Sprintf("%s:%s", prefix, dt.Format("2006-01-02_15"))
+}
+
+// ungribTimes returns the valid times of the fields
+// of `src` needed to cover the period from `from` to `to`.
+func ungribTimes(src *conf.UngribSource, from, to time.Time) []time.Time {
+	res := []time.Time{}
+	step := time.Duration(src.StepHours) * time.Hour
+	for dt := from; !dt.After(to); dt = dt.Add(step) {
+		res = append(res, dt)
+	}
+	return res
+}
+
+// ungribCacheEntry returns the entry of the ungrib cache for
+// `src` of `dataset`, ungribbed from guiding run `run` to files
+// named `prefix`. The entry is named after a hash of Vtable
+// content and StepHours. The time window is not part of the
+// key: each file of the entry is keyed by the valid time of its
+// fields, so runs of overlapping periods share the files in
+// common, and ungrib only the missing ones. It returns nil when
+// the cache is not configured.
+func ungribCacheEntry(vs *runctx.Context, host string, dataset *conf.DatasetConf, src *conf.UngribSource, prefix string, run time.Time) *ungribCache {
+	cacheDir := conf.Config.Folders.UngribCacheDir
+	if vs.Err != nil || cacheDir.Path == "" {
+		return nil
+	}
+
+	vtable := vs.ReadString(src.VtableFile())
+	if vs.Err != nil {
+		return nil
+	}
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s\nStepHours=%d", vtable, src.StepHours)))
+
+	dir := cacheDir.Join(
+		"%s/%s/%s-%x",
+		dataset.Name, prefix, run.Format("2006010215"), hash[:8],
+	)
+	return &ungribCache{dir: vpath.New(host, dir.Path), prefix: prefix}
+}
+
+func (cache *ungribCache) file(dt time.Time) vpath.VirtualPath {
+	return cache.dir.Join(intermediateFile(cache.prefix, dt))
+}
+
+func (cache *ungribCache) dataFile(dt time.Time) vpath.VirtualPath {
+	return cache.dir.Join(".%s", intermediateFile(cache.prefix, dt))
+}
+
+// lock acquires the lock of the entry, waiting for other
+// runs to release it, until the context of `vs` is done.
+// The lock is a symbolic link to a file containing the
+// host name and pid of the runner that owns it, and
+// the name of the file itself. Locks
+// owned by runners of this host that are no longer
+// running are broken.
+func (cache *ungribCache) lock(vs *runctx.Context) {
+	if vs.Err != nil || vs.Plan != nil {
+		return
+	}
+
+	vs.MkDir(cache.dir)
+	conn, err := connection.FindHost(cache.dir.Host)
+	if err != nil {
+		vs.Err = err
+		return
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		vs.Err = err
+		return
+	}
+
+	lockFile := cache.dir.Join(".lock")
+	ownerName := fmt.Sprintf(".lock-%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano())
+	cache.owner = cache.dir.Join(ownerName)
+	vs.WriteString(cache.owner, fmt.Sprintf("%s %d %s\n", hostname, os.Getpid(), ownerName))
+	if vs.Err != nil {
+		return
+	}
+
+	deadline := time.Now().Add(ungribCacheLockTimeout)
+	logged := false
+	for {
+		// the creation of a symbolic link
+		// fails if the file already exists
+		err := conn.Link(cache.owner, lockFile)
+		if err == nil {
+			cache.locked = true
+			return
+		}
+		if cache.breakStaleLock(vs, conn, hostname) {
+			continue
+		}
+		if time.Now().After(deadline) {
+			conn.RmFile(cache.owner)
+			vs.Err = fmt.Errorf(
+				"cannot lock ungrib cache `%s`: %s\nremove `%s` if no other run is using the cache",
+				cache.dir.String(), err, lockFile.String(),
+			)
+			return
+		}
+		if !logged {
+			vs.LogInfo("Waiting for another run to release ungrib cache `%s`", cache.dir.String())
+			logged = true
+		}
+		select {
+		case <-time.After(ungribCacheLockPoll):
+		case <-vs.Ctx().Done():
+			conn.RmFile(cache.owner)
+			vs.Err = fmt.Errorf("waiting for lock of ungrib cache `%s`: %w", cache.dir.String(), vs.Ctx().Err())
+			return
+		}
+	}
+}
+
+// breakStaleLock removes the lock of the entry when it's
+// owned by a process of host `hostname` that is no longer
+// running, and returns whether the lock was removed.
+func (cache *ungribCache) breakStaleLock(vs *runctx.Context, conn connection.Connection, hostname string) bool {
+	lockFile := cache.dir.Join(".lock")
+	rvs := vs.Clone()
+	owner := strings.Fields(rvs.ReadString(lockFile))
+	if rvs.Err != nil || len(owner) != 3 || owner[0] != hostname {
+		return false
+	}
+	pid, err := strconv.Atoi(owner[1])
+	if err != nil || pid == os.Getpid() || syscall.Kill(pid, 0) != syscall.ESRCH {
+		return false
+	}
+
+	vs.LogInfo("Breaking lock of ungrib cache `%s` left by process %d, that is no longer running", cache.dir.String(), pid)
+	if conn.RmFile(lockFile) != nil {
+		return false
+	}
+	conn.RmFile(cache.dir.Join(owner[2]))
+	return true
+}
+
+// unlock releases the lock of the entry. The lock
+// is released even if an error occurred.
+func (cache *ungribCache) unlock(vs *runctx.Context) {
+	if !cache.locked {
+		return
+	}
+	cache.locked = false
+
+	conn, err := connection.FindHost(cache.dir.Host)
+	if err == nil {
+		err = conn.RmFile(cache.dir.Join(".lock"))
+	}
+	if err == nil {
+		err = conn.RmFile(cache.owner)
+	}
+	if err != nil && vs.Err == nil {
+		vs.Err = fmt.Errorf("cannot unlock ungrib cache `%s`: %w", cache.dir.String(), err)
+	}
+}
+
+// missing returns the times in `times`
+// whose files are not in the entry.
+func (cache *ungribCache) missing(vs *runctx.Context, times []time.Time) []time.Time {
+	res := []time.Time{}
+	for _, dt := range times {
+		if !vs.Exists(cache.file(dt)) {
+			res = append(res, dt)
+		}
+	}
+	return res
+}
+
+// link links the files of the entry
+// for `times` into `wpsDir`.
+func (cache *ungribCache) link(vs *runctx.Context, wpsDir vpath.VirtualPath, times []time.Time) {
+	for _, dt := range times {
+		vs.Link(cache.file(dt), wpsDir.Join(intermediateFile(cache.prefix, dt)))
+	}
+}
+
+// store copies the files for `times`
+// written by ungrib in `wpsDir` to the entry.
+func (cache *ungribCache) store(vs *runctx.Context, wpsDir vpath.VirtualPath, times []time.Time) {
+	for _, dt := range times {
+		vs.Copy(wpsDir.Join(intermediateFile(cache.prefix, dt)), cache.dataFile(dt))
+		vs.Link(cache.dataFile(dt), cache.file(dt))
+	}
+}
@@ -0,0 +1,145 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meteocima/wrfda-runner/v2/conf"
+	"github.com/meteocima/wrfda-runner/v2/internal/testutil"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeFakeUngrib writes in `wpsDir` a link_grib.csh that does
+// nothing, and an ungrib.exe that saves the namelist it's run
+// with, if any, and writes the intermediate files `files`.
+func writeFakeUngrib(t *testing.T, wpsDir string, files ...string) {
+	script := "#!/bin/sh\ntouch ungrib.ran\n[ -f namelist.wps ] && cp namelist.wps namelist.ungribbed\n"
+	for _, file := range files {
+		script += "echo ungribbed > '" + file + "'\n"
+	}
+	assert.NoError(t, os.WriteFile(path.Join(wpsDir, "link_grib.csh"), []byte("#!/bin/sh\n"), 0755))
+	assert.NoError(t, os.WriteFile(path.Join(wpsDir, "ungrib.exe"), []byte(script), 0755))
+}
+
+func TestUngribCache(t *testing.T) {
+	dir := testutil.CopyTestrun(t, nil)
+	testutil.ReplaceInFile(t, dir, "wrfda-runner.cfg", "[Folders]\n", "[Folders]\n    UngribCacheDir=\"./UngribCache\"\n")
+	wd := readTestConfig(t, dir)
+
+	vtable := path.Join(dir, "Vtable.TEST")
+	assert.NoError(t, os.WriteFile(vtable, []byte("vtable"), 0644))
+	dataset := &conf.DatasetConf{
+		Name:         "TEST",
+		UngribSource: conf.UngribSource{Prefix: "FILE", Vtable: vtable, StepHours: 6},
+	}
+	src := &dataset.UngribSource
+
+	run := time.Date(2020, 12, 24, 18, 0, 0, 0, time.UTC)
+	from, to := run, run.Add(12*time.Hour)
+	vs := runctx.New(os.Stdin, io.Discard, io.Discard)
+
+	// first run ungribs everything
+	wps1 := wd.Join("wps1")
+	assert.NoError(t, os.Mkdir(wps1.Path, 0755))
+	writeFakeUngrib(t, wps1.Path, "FILE:2020-12-24_18", "FILE:2020-12-25_00", "FILE:2020-12-25_06")
+	ungrib(vs, wps1, dataset, src, wd, run, from, to)
+	if !assert.NoError(t, vs.Err) {
+		return
+	}
+	assert.FileExists(t, path.Join(wps1.Path, "ungrib.ran"))
+
+	// a run with the same guiding run and a longer
+	// period links cached files, and ungribs the others
+	wps2 := wd.Join("wps2")
+	assert.NoError(t, os.Mkdir(wps2.Path, 0755))
+	writeFakeUngrib(t, wps2.Path, "FILE:2020-12-25_12", "FILE:2020-12-25_18")
+	ungrib(vs, wps2, dataset, src, wd, run, from, to.Add(12*time.Hour))
+	if !assert.NoError(t, vs.Err) {
+		return
+	}
+	used, err := os.ReadFile(path.Join(wps2.Path, "namelist.ungribbed"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(used), "'2020-12-25_12:00:00'")
+	assert.NotContains(t, string(used), "'2020-12-24_18:00:00'")
+	for _, name := range []string{"FILE:2020-12-24_18", "FILE:2020-12-25_06", "FILE:2020-12-25_18"} {
+		content, err := os.ReadFile(path.Join(wps2.Path, name))
+		assert.NoError(t, err)
+		assert.Equal(t, "ungribbed\n", string(content))
+	}
+
+	// a run whose files are all cached doesn't run ungrib
+	wps3 := wd.Join("wps3")
+	assert.NoError(t, os.Mkdir(wps3.Path, 0755))
+	writeFakeUngrib(t, wps3.Path)
+	ungrib(vs, wps3, dataset, src, wd, run, from, to.Add(12*time.Hour))
+	assert.NoError(t, vs.Err)
+	assert.NoFileExists(t, path.Join(wps3.Path, "ungrib.ran"))
+	assert.FileExists(t, path.Join(wps3.Path, "FILE:2020-12-25_18"))
+
+	// all runs share the entry of the guiding run
+	entries, err := os.ReadDir(path.Join(dir, "UngribCache/TEST/FILE"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.True(t, strings.HasPrefix(entries[0].Name(), "2020122418-"))
+}
+
+func TestUngribCacheLock(t *testing.T) {
+	defer func(poll, timeout time.Duration) {
+		ungribCacheLockPoll, ungribCacheLockTimeout = poll, timeout
+	}(ungribCacheLockPoll, ungribCacheLockTimeout)
+	ungribCacheLockPoll = 10 * time.Millisecond
+	ungribCacheLockTimeout = 50 * time.Millisecond
+
+	dir, wd := initTestrun(t, "")
+
+	vs := runctx.New(os.Stdin, io.Discard, io.Discard)
+	first := &ungribCache{dir: wd.Join("cache"), prefix: "FILE"}
+	first.lock(vs)
+	assert.NoError(t, vs.Err)
+
+	second := &ungribCache{dir: wd.Join("cache"), prefix: "FILE"}
+	second.lock(vs)
+	assert.Error(t, vs.Err)
+	assert.Contains(t, vs.Err.Error(), "cannot lock ungrib cache `localhost:"+dir+"/cache`")
+	second.unlock(vs)
+
+	vs.Err = nil
+	first.unlock(vs)
+	assert.NoError(t, vs.Err)
+	second.lock(vs)
+	assert.NoError(t, vs.Err)
+	second.unlock(vs)
+	assert.NoError(t, vs.Err)
+
+	// a lock left by a process that is no longer running is broken.
+	dead := exec.Command("/bin/true")
+	assert.NoError(t, dead.Run())
+	hostname, err := os.Hostname()
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path.Join(dir, "cache", ".lock-dead"), []byte(fmt.Sprintf("%s %d .lock-dead\n", hostname, dead.Process.Pid)), 0644))
+	assert.NoError(t, os.Symlink(path.Join(dir, "cache", ".lock-dead"), path.Join(dir, "cache", ".lock")))
+	first.lock(vs)
+	assert.NoError(t, vs.Err)
+	assert.NoFileExists(t, path.Join(dir, "cache", ".lock-dead"))
+
+	// waiting for a lock stops when the run is interrupted.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ungribCacheLockTimeout = time.Hour
+	second.lock(vs.WithContext(ctx))
+	assert.ErrorIs(t, vs.Err, context.Canceled)
+	vs.Err = nil
+	first.unlock(vs)
+	assert.NoError(t, vs.Err)
+	entries, err := os.ReadDir(path.Join(dir, "cache"))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
@@ -1,21 +1,23 @@
 package runner
 
 import (
+	"path"
 	"time"
 
 	"github.com/meteocima/wrfda-runner/v2/conf"
 	"github.com/meteocima/wrfda-runner/v2/folders"
+	"github.com/meteocima/wrfda-runner/v2/nml"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
 
 	"github.com/meteocima/namelist-prepare/namelist"
-	"github.com/meteocima/virtual-server/ctx"
 	"github.com/meteocima/virtual-server/vpath"
 
 	"github.com/meteocima/virtual-server/connection"
 )
 
 // BuildNamelistForReal ...
-func BuildNamelistForReal(vs *ctx.Context, start, end time.Time, step int) {
-	assimStartDate := start.Add(3 * time.Duration(step-3) * time.Hour)
+func BuildNamelistForReal(vs *runctx.Context, start, end time.Time, step int) {
+	assimStartDate := conf.Config.Cycles.AssimDate(start, step)
 	wpsDir := folders.WPSWorkDir(start)
 
 	// build namelist for real
@@ -31,7 +33,7 @@ func BuildNamelistForReal(vs *ctx.Context, start, end time.Time, step int) {
 }
 
 // RunReal ...
-func RunReal(vs *ctx.Context, startDate time.Time, step int, phase conf.RunPhase) {
+func RunReal(vs *runctx.Context, startDate time.Time, step int, phase conf.RunPhase) {
 	domainCount := ReadDomainCount(vs, phase)
 	if vs.Err != nil {
 		return
@@ -41,15 +43,11 @@ func RunReal(vs *ctx.Context, startDate time.Time, step int, phase conf.RunPhase
 	vs.LogInfo("real for cycle %d", step)
 
 	logFile := wpsDir.Join("rsl.out.0000")
-	vs.Exec(
-		vpath.New("simulation", "mpirun"),
-		[]string{"-n", conf.Config.Procs.RealProcCount, "./real.exe"},
-		&connection.RunOptions{
-			OutFromLog: &logFile,
-			Cwd:        wpsDir,
-			//Env:        conf.Config.Env.ToSlice(),
-		},
-	)
+	runMPI(vs, conf.Config.Procs.RealProcCount, "./real.exe", &connection.RunOptions{
+		OutFromLog: &logFile,
+		Cwd:        wpsDir,
+		//Env:        conf.Config.Env.ToSlice(),
+	})
 
 	indir := folders.InputsDir(startDate)
 	vs.MkDir(indir)
@@ -76,11 +74,74 @@ func RunReal(vs *ctx.Context, startDate time.Time, step int, phase conf.RunPhase
 
 }
 
+// wpsPrgFiles are the files linked from WPSPrg
+// directory into the WPS work directory.
+var wpsPrgFiles = []string{
+	"link_grib.csh",
+	"ungrib.exe",
+	"metgrid.exe",
+	"util/avg_tsfc.exe",
+	"geogrid.exe",
+}
+
+// realPrgFile is the real executable linked from
+// WRFAssStepPrg directory into the WPS work directory.
+const realPrgFile = "run/real.exe"
+
+// sourceFiles returns the arguments for link_grib.csh:
+// the files in `dir` matching the glob of `src`, or
+// `dir` itself if the source has no glob configured.
+func sourceFiles(vs *runctx.Context, src *conf.UngribSource, dir vpath.VirtualPath) []string {
+	if src.Glob == "" {
+		return []string{dir.Path}
+	}
+
+	files := []string{}
+	for _, file := range archiveFiles(vs, src, dir) {
+		files = append(files, file.Path)
+	}
+	return files
+}
+
+// buildUngribNamelists writes in `wpsDir` a namelist and
+// a Vtable for each source of `dataset`, named after the source
+// prefix, and a namelist for metgrid that lists all prefixes
+// in fg_name, both as namelist.wps and namelist.wps.metgrid.
+// The prefix of the metgrid namelist is the one of the first
+// source, that contains the atmospheric fields averaged by
+// avg_tsfc.exe.
+func buildUngribNamelists(vs *runctx.Context, wpsDir vpath.VirtualPath, dataset *conf.DatasetConf, args namelist.Args) {
+	nl := conf.ReadNamelist(vs, "namelist.wps", args)
+	if vs.Err != nil {
+		return
+	}
+	tmpl := conf.NamelistFile("namelist.wps")
+
+	sources := dataset.UngribSources()
+	fgName := []nml.Value{}
+	for _, src := range sources {
+		nl.Set("ungrib", "prefix", nml.StringValue(src.Prefix))
+		vs.WriteRendered(tmpl, wpsDir.Join("namelist.wps.%s", src.Prefix), nl.String())
+		vs.Link(src.VtableFile(), wpsDir.Join("Vtable.%s", src.Prefix))
+		fgName = append(fgName, nml.StringValue(src.Prefix))
+	}
+
+	nl.Set("ungrib", "prefix", nml.StringValue(sources[0].Prefix))
+	nl.Set("metgrid", "fg_name", fgName...)
+	vs.WriteRendered(tmpl, wpsDir.Join("namelist.wps.metgrid"), nl.String())
+	vs.WriteRendered(tmpl, wpsDir.Join("namelist.wps"), nl.String())
+}
+
 // BuildWPSDir ..
-func BuildWPSDir(vs *ctx.Context, start, end time.Time, ds conf.InputDataset) {
+func BuildWPSDir(vs *runctx.Context, start, end time.Time, ds conf.InputDataset) {
 	if vs.Err != nil {
 		return
 	}
+	dataset, err := conf.Dataset(ds)
+	if err != nil {
+		vs.Err = err
+		return
+	}
 	wpsDir := folders.WPSWorkDir(start)
 	vs.LogInfo("Build WPS work directory on `%s`", wpsDir.String())
 	wpsPrg := folders.Cfg.WPSPrg
@@ -88,58 +149,98 @@ func BuildWPSDir(vs *ctx.Context, start, end time.Time, ds conf.InputDataset) {
 
 	vs.MkDir(wpsDir)
 
+	args := namelist.Args{
+		Start: conf.Config.Cycles.FirstAssimDate(start),
+		End:   end,
+	}
+
 	// build namelist for wrf
-	conf.RenderNameList(
-		vs,
-		"namelist.wps",
-		wpsDir.Join("namelist.wps"),
-		namelist.Args{
-			Start: start.Add(-6 * time.Hour),
-			End:   end,
-		},
-	)
+	if len(dataset.Sources) == 0 {
+		conf.RenderNameList(vs, "namelist.wps", wpsDir.Join("namelist.wps"), args)
+	} else {
+		buildUngribNamelists(vs, wpsDir, dataset, args)
+	}
 
-	vs.Link(wpsPrg.Join("link_grib.csh"), wpsDir.Join("link_grib.csh"))
-	vs.Link(wpsPrg.Join("ungrib.exe"), wpsDir.Join("ungrib.exe"))
-	vs.Link(wpsPrg.Join("metgrid.exe"), wpsDir.Join("metgrid.exe"))
-	vs.Link(wpsPrg.Join("util/avg_tsfc.exe"), wpsDir.Join("avg_tsfc.exe"))
-	vs.Link(wrfPrgStep.Join("run/real.exe"), wpsDir.Join("real.exe"))
-	vs.Link(wpsPrg.Join("geogrid.exe"), wpsDir.Join("geogrid.exe"))
+	for _, file := range wpsPrgFiles {
+		vs.Link(wpsPrg.Join(file), wpsDir.Join(path.Base(file)))
+	}
+	vs.Link(wrfPrgStep.Join(realPrgFile), wpsDir.Join(path.Base(realPrgFile)))
 
-	if ds == conf.GFS {
-		vs.Link(wpsPrg.Join("ungrib/Variable_Tables/Vtable.GFS"), wpsDir.Join("Vtable"))
-	} else if ds == conf.IFS {
-		vs.Link(wpsPrg.Join("ungrib/Variable_Tables/Vtable.ECMWF"), wpsDir.Join("Vtable"))
+	if len(dataset.Sources) == 0 {
+		vs.Link(dataset.VtableFile(), wpsDir.Join("Vtable"))
 	}
 }
 
-// RunWPS ...
-func RunWPS(vs *ctx.Context, start, end time.Time) {
+// ungrib runs link_grib.csh and ungrib.exe on the files of `src` in
+// `archiveDir`, written by guiding run `run`, for the period from
+// `from` to `to`. When the ungrib cache is configured, intermediate
+// files already in the cache are linked, and ungrib runs only for
+// the period of the missing ones, that are then added to the cache.
+func ungrib(vs *runctx.Context, wpsDir vpath.VirtualPath, dataset *conf.DatasetConf, src *conf.UngribSource, archiveDir vpath.VirtualPath, run, from, to time.Time) {
 	if vs.Err != nil {
 		return
 	}
 
-	vs.LogInfo("Start WPS pre-process for date %s", start.Format("2006020115"))
-
-	wpsDir := folders.WPSWorkDir(start)
-
-	logFile := wpsDir.Join("geogrid.log.0000")
-	vs.Exec(
-		vpath.New("simulation", "mpirun"),
-		[]string{"-n", conf.Config.Procs.GeogridProcCount, "./geogrid.exe"},
-		&connection.RunOptions{
-			OutFromLog: &logFile,
-			Cwd:        wpsDir,
-			//Env:        conf.Config.Env.ToSlice(),
-		},
-	)
-
-	gfsDirPattern := conf.Config.Folders.GFSArchive.Path
-	gfsDir := start.Add(-6 * time.Hour).Format(gfsDirPattern)
+	var cache *ungribCache
+	var missing, cached []time.Time
+	if conf.Config.Folders.UngribCacheDir.Path != "" {
+		nl := conf.ReadNamelist(vs, "namelist.wps", namelist.Args{Start: from, End: to})
+		if vs.Err != nil {
+			return
+		}
+		// single source datasets use the
+		// prefix configured in the template
+		prefix := src.Prefix
+		if len(dataset.Sources) == 0 {
+			if prefixes, err := nl.Strings("prefix"); err == nil && len(prefixes) > 0 {
+				prefix = prefixes[0]
+			}
+		}
+
+		cache = ungribCacheEntry(vs, wpsDir.Host, dataset, src, prefix, run)
+		if vs.Err != nil {
+			return
+		}
+		cache.lock(vs)
+		defer cache.unlock(vs)
+
+		times := ungribTimes(src, from, to)
+		missing = cache.missing(vs, times)
+		if vs.Err != nil {
+			return
+		}
+		if len(missing) == 0 {
+			vs.LogInfo("Using ungrib output of source %s cached in `%s`", src.Prefix, cache.dir.String())
+			cache.link(vs, wpsDir, times)
+			return
+		}
+
+		if len(missing) < len(times) {
+			// only the period of missing files is ungribbed, the
+			// others are linked after ungrib, so that it doesn't
+			// overwrite cached files through the links.
+			from, to = missing[0], missing[len(missing)-1]
+			for _, dt := range times {
+				if dt.Before(from) || dt.After(to) {
+					cached = append(cached, dt)
+				}
+			}
+			vs.LogInfo(
+				"Ungrib source %s from %s to %s, other times are cached in `%s`",
+				src.Prefix, from.Format("2006010215"), to.Format("2006010215"), cache.dir.String(),
+			)
+			nl = conf.ReadNamelist(vs, "namelist.wps", namelist.Args{Start: from, End: to})
+			if vs.Err != nil {
+				return
+			}
+			nl.Set("ungrib", "prefix", nml.StringValue(prefix))
+			vs.WriteRendered(conf.NamelistFile("namelist.wps"), wpsDir.Join("namelist.wps"), nl.String())
+		}
+	}
 
 	vs.Exec(
 		wpsDir.Join("./link_grib.csh"),
-		[]string{gfsDir},
+		sourceFiles(vs, src, archiveDir),
 		&connection.RunOptions{
 			Cwd: wpsDir,
 		},
@@ -149,7 +250,77 @@ func RunWPS(vs *ctx.Context, start, end time.Time) {
 		Cwd: wpsDir,
 	})
 
-	if end.Sub(start) > 24*time.Hour {
+	if cache != nil {
+		cache.store(vs, wpsDir, missing)
+		cache.link(vs, wpsDir, cached)
+	}
+}
+
+// RunWPS runs the WPS executables, and returns the
+// reference time of the guiding run used for each ungrib
+// source, indexed by its prefix.
+func RunWPS(vs *runctx.Context, start, end time.Time, ds conf.InputDataset) map[string]time.Time {
+	if vs.Err != nil {
+		return nil
+	}
+	dataset, err := conf.Dataset(ds)
+	if err != nil {
+		vs.Err = err
+		return nil
+	}
+
+	vs.LogInfo("Start WPS pre-process for date %s", start.Format("2006020115"))
+
+	wpsDir := folders.WPSWorkDir(start)
+
+	// check that guiding forecasts are complete before
+	// launching anything, since missing files would
+	// only make metgrid fail much later.
+	assimStartDate := conf.Config.Cycles.FirstAssimDate(start)
+	sources := dataset.UngribSources()
+	archiveDirs := make([]vpath.VirtualPath, len(sources))
+	runs := map[string]time.Time{}
+	for idx, src := range sources {
+		archiveDirs[idx], runs[src.Prefix] = selectGuidingRun(vs, src, assimStartDate, end)
+	}
+	if vs.Err != nil {
+		return nil
+	}
+
+	// geo_em files only depend on geogrid settings
+	// and static data, so they are reused when cached.
+	if !linkCachedGeogrid(vs, wpsDir, start, end) {
+		logFile := wpsDir.Join("geogrid.log.0000")
+		runMPI(vs, conf.Config.Procs.GeogridProcCount, "./geogrid.exe", &connection.RunOptions{
+			OutFromLog: &logFile,
+			Cwd:        wpsDir,
+			//Env:        conf.Config.Env.ToSlice(),
+		})
+		storeGeogridCache(vs, wpsDir, start, end)
+	}
+
+	for idx, src := range sources {
+		if len(dataset.Sources) > 0 {
+			vs.LogInfo("Ungrib source %s", src.Prefix)
+			vs.Copy(wpsDir.Join("namelist.wps.%s", src.Prefix), wpsDir.Join("namelist.wps"))
+			vs.Copy(wpsDir.Join("Vtable.%s", src.Prefix), wpsDir.Join("Vtable"))
+		}
+
+		ungrib(vs, wpsDir, dataset, src, archiveDirs[idx], runs[src.Prefix], assimStartDate, end)
+	}
+
+	if len(dataset.Sources) > 0 {
+		vs.Copy(wpsDir.Join("namelist.wps.metgrid"), wpsDir.Join("namelist.wps"))
+	} else if conf.Config.Folders.UngribCacheDir.Path != "" {
+		// the namelist may have been rendered
+		// for the period of missing files only
+		conf.RenderNameList(vs, "namelist.wps", wpsDir.Join("namelist.wps"), namelist.Args{
+			Start: assimStartDate,
+			End:   end,
+		})
+	}
+
+	if dataset.AvgTsfc && end.Sub(start) > 24*time.Hour {
 		vs.Exec(wpsDir.Join("./avg_tsfc.exe"), []string{}, &connection.RunOptions{
 
 			Cwd: wpsDir,
@@ -158,14 +329,11 @@ func RunWPS(vs *ctx.Context, start, end time.Time) {
 	}
 
 	logFile2 := wpsDir.Join("metgrid.log.0000")
-	vs.Exec(
-		vpath.New("simulation", "mpirun"),
-		[]string{"-n", conf.Config.Procs.MetgridProcCount, "./metgrid.exe"},
-		&connection.RunOptions{
-			OutFromLog: &logFile2,
-			Cwd:        wpsDir,
-			//Env:        conf.Config.Env.ToSlice(),
-		},
-	)
+	runMPI(vs, conf.Config.Procs.MetgridProcCount, "./metgrid.exe", &connection.RunOptions{
+		OutFromLog: &logFile2,
+		Cwd:        wpsDir,
+		//Env:        conf.Config.Env.ToSlice(),
+	})
 
+	return runs
 }
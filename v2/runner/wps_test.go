@@ -0,0 +1,69 @@
+package runner
+
+import (
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/meteocima/namelist-prepare/namelist"
+	"github.com/meteocima/wrfda-runner/v2/conf"
+	"github.com/meteocima/wrfda-runner/v2/nml"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildUngribNamelists(t *testing.T) {
+	dir, wd := initTestrun(t, "")
+
+	dataset := &conf.DatasetConf{
+		Sources: []*conf.UngribSource{
+			{Prefix: "IFS", Vtable: "ungrib/Variable_Tables/Vtable.ECMWF"},
+			{Prefix: "SST", Vtable: "/opt/Vtable.SST"},
+		},
+	}
+
+	wpsDir := wd.Join("wps")
+	vs := runctx.New(os.Stdin, io.Discard, io.Discard)
+	vs.MkDir(wpsDir)
+	start := time.Date(2020, 12, 24, 18, 0, 0, 0, time.UTC)
+	buildUngribNamelists(vs, wpsDir, dataset, namelist.Args{Start: start, End: start.Add(54 * time.Hour)})
+	if !assert.NoError(t, vs.Err) {
+		return
+	}
+
+	readNml := func(name string) *nml.Namelist {
+		content, err := os.ReadFile(path.Join(dir, "wps", name))
+		assert.NoError(t, err)
+		nl, err := nml.ParseString(string(content))
+		assert.NoError(t, err)
+		return nl
+	}
+
+	for _, prefix := range []string{"IFS", "SST"} {
+		prefixes, err := readNml("namelist.wps." + prefix).Strings("prefix")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{prefix}, prefixes)
+	}
+
+	for _, name := range []string{"namelist.wps", "namelist.wps.metgrid"} {
+		nl := readNml(name)
+		fgName, err := nl.Strings("fg_name")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"IFS", "SST"}, fgName)
+
+		// avg_tsfc.exe reads the files of the first source
+		prefix, err := nl.Strings("prefix")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"IFS"}, prefix)
+
+		maxDom, err := nl.Int("max_dom")
+		assert.NoError(t, err)
+		assert.Equal(t, 3, maxDom)
+	}
+
+	link, err := os.Readlink(path.Join(dir, "wps", "Vtable.SST"))
+	assert.NoError(t, err)
+	assert.Equal(t, "/opt/Vtable.SST", link)
+}
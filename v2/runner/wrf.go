@@ -1,20 +1,36 @@
 package runner
 
 import (
+	"fmt"
+	"path"
 	"sync"
 	"time"
 
 	"github.com/meteocima/namelist-prepare/namelist"
 	"github.com/meteocima/virtual-server/connection"
-	"github.com/meteocima/virtual-server/ctx"
-	"github.com/meteocima/virtual-server/vpath"
 
 	"github.com/meteocima/wrfda-runner/v2/conf"
 	"github.com/meteocima/wrfda-runner/v2/folders"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
 )
 
+// wrfPrgFiles are the files linked from WRFAssStepPrg
+// or WRFMainRunPrg directories into WRF work directories.
+var wrfPrgFiles = []string{
+	"main/wrf.exe",
+	"run/LANDUSE.TBL",
+	"run/ozone_plev.formatted",
+	"run/ozone_lat.formatted",
+	"run/ozone.formatted",
+	"run/RRTMG_LW_DATA",
+	"run/RRTMG_SW_DATA",
+	"run/VEGPARM.TBL",
+	"run/SOILPARM.TBL",
+	"run/GENPARM.TBL",
+}
+
 // RunWRFStep ...
-func RunWRFStep(vs *ctx.Context, start time.Time, step int) {
+func RunWRFStep(vs *runctx.Context, start time.Time, step int) {
 	if vs.Err != nil {
 		return
 	}
@@ -26,20 +42,16 @@ func RunWRFStep(vs *ctx.Context, start time.Time, step int) {
 	logFile := wrfDir.Join("rsl.out.0000")
 	vs.LogInfo("logging from file %s", logFile.String())
 
-	vs.Exec(
-		vpath.New(wrfDir.Host, "mpirun"),
-		[]string{"-n", conf.Config.Procs.WrfstepProcCount, "./wrf.exe"},
-		&connection.RunOptions{
-			OutFromLog: &logFile,
-			Cwd:        wrfDir,
-			Env:        conf.Config.Env.ToSlice(),
-		},
-	)
+	runMPI(vs, conf.Config.Procs.Wrf(step), "./wrf.exe", &connection.RunOptions{
+		OutFromLog: &logFile,
+		Cwd:        wrfDir,
+		Env:        conf.Config.Env.ToSlice(),
+	})
 
 }
 
 // BuildWRFDir ...
-func BuildWRFDir(vs *ctx.Context, start, end time.Time, step int, host string, mainHost bool) {
+func BuildWRFDir(vs *runctx.Context, start, end time.Time, step int, host string, mainHost bool) {
 	if vs.Err != nil {
 		return
 	}
@@ -51,10 +63,10 @@ func BuildWRFDir(vs *ctx.Context, start, end time.Time, step int, host string, m
 	wrfPrg.Host = host
 	nameListName := "namelist.step.wrf"
 
-	dtStart := start.Add(3 * time.Duration(step-3) * time.Hour)
-	dtEnd := dtStart.Add(3 * time.Hour)
+	dtStart := conf.Config.Cycles.AssimDate(start, step)
+	dtEnd := dtStart.Add(conf.Config.Cycles.IntervalDuration())
 
-	if step == 3 {
+	if conf.Config.Cycles.IsLast(step) {
 		dtEnd = end
 		wrfPrg = folders.Cfg.WRFMainRunPrg
 		nameListName = "namelist.run.wrf"
@@ -73,31 +85,14 @@ func BuildWRFDir(vs *ctx.Context, start, end time.Time, step int, host string, m
 		},
 	)
 
-	wrfvar := ""
-	switch step {
-	case 1:
-		wrfvar = "wrf_var.txt.wrf_01"
-	case 2:
-		wrfvar = "wrf_var.txt.wrf_02"
-	case 3:
-		wrfvar = "wrf_var.txt.wrf_03"
-	}
-
 	vs.Copy(
-		conf.NamelistFile(wrfvar),
+		conf.NamelistFile(fmt.Sprintf("wrf_var.txt.wrf_%02d", step)),
 		wrfDir.Join("wrf_var.txt"),
 	)
 
-	vs.Link(wrfPrg.Join("main/wrf.exe"), wrfDir.Join("wrf.exe"))
-	vs.Link(wrfPrg.Join("run/LANDUSE.TBL"), wrfDir.Join("LANDUSE.TBL"))
-	vs.Link(wrfPrg.Join("run/ozone_plev.formatted"), wrfDir.Join("ozone_plev.formatted"))
-	vs.Link(wrfPrg.Join("run/ozone_lat.formatted"), wrfDir.Join("ozone_lat.formatted"))
-	vs.Link(wrfPrg.Join("run/ozone.formatted"), wrfDir.Join("ozone.formatted"))
-	vs.Link(wrfPrg.Join("run/RRTMG_LW_DATA"), wrfDir.Join("RRTMG_LW_DATA"))
-	vs.Link(wrfPrg.Join("run/RRTMG_SW_DATA"), wrfDir.Join("RRTMG_SW_DATA"))
-	vs.Link(wrfPrg.Join("run/VEGPARM.TBL"), wrfDir.Join("VEGPARM.TBL"))
-	vs.Link(wrfPrg.Join("run/SOILPARM.TBL"), wrfDir.Join("SOILPARM.TBL"))
-	vs.Link(wrfPrg.Join("run/GENPARM.TBL"), wrfDir.Join("GENPARM.TBL"))
+	for _, file := range wrfPrgFiles {
+		vs.Link(wrfPrg.Join(file), wrfDir.Join(path.Base(file)))
+	}
 
 	if mainHost {
 		// boundary from same cycle da dir for domain 1
@@ -1,23 +1,69 @@
 package runner
 
 import (
+	"errors"
 	"fmt"
+	"path"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/meteocima/namelist-prepare/namelist"
 	"github.com/meteocima/virtual-server/connection"
-	"github.com/meteocima/virtual-server/ctx"
 	"github.com/meteocima/virtual-server/vpath"
 	"github.com/meteocima/wrfda-runner/v2/conf"
 	"github.com/meteocima/wrfda-runner/v2/folders"
+	"github.com/meteocima/wrfda-runner/v2/nml"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
 )
 
-func buildDADirInDomain(vs *ctx.Context, start, end time.Time, step, domain int, host string, mainHost bool) {
+// wrfdaPrgFiles are the files linked from WRFDAPrg
+// directory into WRFDA work directories.
+var wrfdaPrgFiles = []string{
+	"var/build/da_wrfvar.exe",
+	varbcFile,
+	"run/LANDUSE.TBL",
+	"var/build/da_update_bc.exe",
+}
+
+// varbcFile is the static VARBC.in of the WRFDA build,
+// used by cycles with no previous one to take it from.
+const varbcFile = "var/run/VARBC.in"
+
+// warmStartFile returns the wrfout of `domain` written by the
+// forecast of the previous run at the date of the first cycle.
+func warmStartFile(start time.Time, domain int) vpath.VirtualPath {
+	previousStart := start.Add(-conf.Config.Cycles.PreviousRunDuration())
+	firstAssimDate := conf.Config.Cycles.FirstAssimDate(start)
+	return folders.WRFWorkDir(previousStart, conf.Config.Cycles.Count).Join(
+		"wrfout_d%02d_%s", domain, firstAssimDate.Format("2006-01-02_15:04:05"),
+	)
+}
+
+// canWarmStart returns true if Cycles.WarmStart is set and
+// the forecast of the previous run wrote the first guess
+// of the first cycle for all domains. Otherwise, the first
+// cycle starts from the output of real.
+func canWarmStart(vs *runctx.Context, start time.Time, domainCount int) bool {
+	if vs.Err != nil || !conf.Config.Cycles.WarmStart {
+		return false
+	}
+	for domain := 1; domain <= domainCount; domain++ {
+		if file := warmStartFile(start, domain); !vs.Exists(file) {
+			vs.LogInfo("Previous forecast `%s` not found, cold start from real output", file.String())
+			return false
+		}
+	}
+	vs.LogInfo("Warm start from the forecast of the previous run")
+	return true
+}
+
+func buildDADirInDomain(vs *runctx.Context, start, end time.Time, step, domain int, host string, mainHost, warmStart bool) {
 	if vs.Err != nil {
 		return
 	}
-	assimDate := start.Add(3 * time.Duration(step-3) * time.Hour)
+	assimDate := conf.Config.Cycles.AssimDate(start, step)
 	// prepare da dir
 	daDir := folders.DAWorkDir(start, domain, step)
 	daDir.Host = host
@@ -35,7 +81,12 @@ func buildDADirInDomain(vs *ctx.Context, start, end time.Time, step, domain int,
 			vs.LogInfo("Copy done")
 		}
 
-		if step == 1 {
+		if step == 1 && warmStart {
+			// first step of assimilation continues the forecast of the previous run.
+			vs.LogInfo("Copy warm start first guess for domain %d to %s", domain, host)
+			vs.Copy(warmStartFile(start, domain), daDir.Join("fg"))
+			vs.LogInfo("Copy done")
+		} else if step == 1 {
 			vs.LogInfo("Copy wrfbdy_d01_da%02d to %s", domain, host)
 
 			// first step of assimilation receives fg input from WPS or from 'inputs' directory.
@@ -47,11 +98,6 @@ func buildDADirInDomain(vs *ctx.Context, start, end time.Time, step, domain int,
 		} else {
 			// the others steps receives input from the WRF run
 			// of previous step.
-			prevHour := assimDate.Hour() - 3
-			if prevHour < 0 {
-				prevHour += 24
-			}
-
 			previousStep := folders.WRFWorkDir(start, step-1)
 			vs.LogInfo("Copy wrfvar_input_d%02d to %s", domain, host)
 			vs.Copy(
@@ -62,16 +108,32 @@ func buildDADirInDomain(vs *ctx.Context, start, end time.Time, step, domain int,
 
 		}
 	}
+	// observations are copied only on the main host
+	missing := []conf.ObsType{}
+	if mainHost {
+		missing = missingObservations(vs, start, step, host)
+	}
+
 	// build namelist for wrfda
-	conf.RenderNameList(
-		vs,
-		fmt.Sprintf("namelist.d%02d.wrfda", domain),
-		daDir.Join("namelist.input"),
-		namelist.Args{
-			Start: assimDate,
-			End:   end,
-		},
-	)
+	daNamelist := fmt.Sprintf("namelist.d%02d.wrfda", domain)
+	daArgs := namelist.Args{
+		Start: assimDate,
+		End:   end,
+	}
+	if containsObs(missing, conf.Radar) {
+		// radar observations are disabled, so that
+		// the other ones are assimilated anyway.
+		nl := conf.ReadNamelist(vs, daNamelist, daArgs)
+		if vs.Err != nil {
+			return
+		}
+		if nl.Lookup("use_radarobs") != nil {
+			nl.Set("wrfvar4", "use_radarobs", nml.LogicalValue(false))
+		}
+		vs.WriteRendered(conf.NamelistFile(daNamelist), daDir.Join("namelist.input"), nl.String())
+	} else {
+		conf.RenderNameList(vs, daNamelist, daDir.Join("namelist.input"), daArgs)
+	}
 
 	conf.RenderNameList(
 		vs,
@@ -89,34 +151,86 @@ func buildDADirInDomain(vs *ctx.Context, start, end time.Time, step, domain int,
 	matrixDir.Host = host
 
 	// link files from WRFDA build directory
-	vs.Link(wrfdaPrg.Join("var/build/da_wrfvar.exe"), daDir.Join("da_wrfvar.exe"))
-	vs.Link(wrfdaPrg.Join("var/run/VARBC.in"), daDir.Join("VARBC.in"))
-	vs.Link(wrfdaPrg.Join("run/LANDUSE.TBL"), daDir.Join("LANDUSE.TBL"))
-	vs.Link(wrfdaPrg.Join("var/build/da_update_bc.exe"), daDir.Join("da_update_bc.exe"))
-
-	var season string
-	// we use an approximation
-	// to calculate season
-	switch start.Month() {
-	case 12, 1, 2:
-		season = "winter"
-	case 3, 4, 5:
-		season = "spring"
-	case 6, 7, 8:
-		season = "summer"
-	case 9, 10, 11:
-		season = "fall"
+	for _, file := range wrfdaPrgFiles {
+		if file == varbcFile && mainHost {
+			continue
+		}
+		vs.Link(wrfdaPrg.Join(file), daDir.Join(path.Base(file)))
+	}
+
+	// bias correction coefficients are
+	// carried over from the previous cycle
+	if mainHost {
+		if previous := previousVARBC(vs, start, step, domain); previous.Path != "" {
+			vs.LogInfo("Copy VARBC coefficients for cycle %d, domain %d from `%s`", step, domain, previous.String())
+			vs.Copy(previous, daDir.Join("VARBC.in"))
+		} else {
+			vs.Link(wrfdaPrg.Join(varbcFile), daDir.Join("VARBC.in"))
+		}
 	}
 
 	// link covariance matrixes
-	vs.Link(matrixDir.Join("%s/be_d%02d", season, domain), daDir.Join("be.dat"))
+	be, err := conf.Config.BackgroundError.BEFile(domain, start, assimDate)
+	if err != nil {
+		vs.Err = err
+		return
+	}
+	vs.Link(matrixDir.Join(be), daDir.Join("be.dat"))
+
+	// link observations available
+	for _, obs := range conf.ObsTypes {
+		if !containsObs(missing, obs) {
+			vs.Link(obsFile(obs, start, step, host), daDir.Join(obsLinkName(obs)))
+		}
+	}
+}
+
+func containsObs(list []conf.ObsType, obs conf.ObsType) bool {
+	for _, item := range list {
+		if item == obs {
+			return true
+		}
+	}
+	return false
+}
+
+// previousVARBC returns the VARBC.out written by the cycle
+// before `step` for `domain`, or its VARBC.in if it didn't write
+// one, e.g. because it passed its first guess through. For the
+// first cycle, the previous cycle is the last one of the previous
+// run, if Cycles.CarryVARBC is set. It returns an empty path when
+// there's no previous cycle: the static file should be used.
+func previousVARBC(vs *runctx.Context, start time.Time, step, domain int) vpath.VirtualPath {
+	if vs.Err != nil {
+		return vpath.VirtualPath{}
+	}
+
+	var previousDir vpath.VirtualPath
+	if step > 1 {
+		previousDir = folders.DAWorkDir(start, domain, step-1)
+	} else {
+		if !conf.Config.Cycles.CarryVARBC {
+			return vpath.VirtualPath{}
+		}
+		previousStart := start.Add(-conf.Config.Cycles.PreviousRunDuration())
+		previousDir = folders.DAWorkDir(previousStart, domain, conf.Config.Cycles.Count)
+		if !vs.Exists(previousDir) {
+			vs.LogInfo("Previous run directory `%s` not found, using static VARBC.in", previousDir.String())
+			return vpath.VirtualPath{}
+		}
+	}
+
+	for _, name := range []string{"VARBC.out", "VARBC.in"} {
+		if file := previousDir.Join(name); vs.Exists(file) {
+			return file
+		}
+	}
 
-	// link observations
-	vs.Link(folders.RadarObsForDate(start, step, host), daDir.Join("ob.radar"))
-	vs.Link(folders.StationsObsForDate(start, step, host), daDir.Join("ob.ascii"))
+	vs.Err = fmt.Errorf("cannot find VARBC coefficients of previous cycle in `%s`", previousDir.String())
+	return vpath.VirtualPath{}
 }
 
-func runDAStepInDomain(vs *ctx.Context, start time.Time, step, domain int) {
+func runDAStepInDomain(vs *runctx.Context, start time.Time, step, domain int, procs string) {
 	if vs.Err != nil {
 		return
 	}
@@ -126,53 +240,220 @@ func runDAStepInDomain(vs *ctx.Context, start time.Time, step, domain int) {
 
 	logFile := daDir.Join("rsl.out.0000")
 	vs.LogInfo("logging from file %s", logFile.String())
-	vs.Exec(
-		vpath.New("simulation", "mpirun"),
-		[]string{"-n", conf.Config.Procs.WrfdaProcCount, "./da_wrfvar.exe"},
-		&connection.RunOptions{
-			OutFromLog: &logFile,
-			Cwd:        daDir,
-			Env:        conf.Config.Env.ToSlice(),
-		},
-	)
+	runMPI(vs, procs, "./da_wrfvar.exe", &connection.RunOptions{
+		OutFromLog: &logFile,
+		Cwd:        daDir,
+		Env:        conf.Config.Env.ToSlice(),
+	})
+
+	// da_wrfvar.exe can exit successfully without writing
+	// its output, so failures are detected from it too.
+	if vs.Err == nil && !vs.Exists(daDir.Join("wrfvar_output")) {
+		vs.Err = fmt.Errorf("da_wrfvar.exe failed for cycle %d, domain %d: `%s` not produced", step, domain, daDir.Join("wrfvar_output").String())
+		return
+	}
 
 	if domain == 1 {
-		vs.Exec(daDir.Join("./da_update_bc.exe"), []string{}, &connection.RunOptions{
-			Cwd: daDir,
-		})
+		updateBC(vs, daDir)
+	}
+}
+
+// updateBC runs da_update_bc.exe in `daDir`. A non-zero
+// exit code is reported in vs.Err as an *runctx.ExitError.
+func updateBC(vs *runctx.Context, daDir vpath.VirtualPath) {
+	if vs.Err != nil {
+		return
+	}
+	bc := vs.TrackExits()
+	bc.Exec(daDir.Join("./da_update_bc.exe"), []string{}, &connection.RunOptions{
+		Cwd: daDir,
+	})
+	for _, exit := range bc.Exits() {
+		if vs.Err == nil && exit.Code != 0 {
+			vs.Err = &runctx.ExitError{Exit: exit}
+		}
 	}
 }
 
-// RunDAStep ...
-func RunDAStep(vs *ctx.Context, start time.Time, step int) {
+// passThroughDA uses the first guess of `domain` as the
+// output of the assimilation of `step`, without running WRFDA.
+// On domain 1, da_update_bc.exe still runs if possible: if it
+// fails, the boundaries produced by real are restored.
+func passThroughDA(vs *runctx.Context, start time.Time, step, domain int) {
 	if vs.Err != nil {
 		return
 	}
+	daDir := folders.DAWorkDir(start, domain, step)
+	vs.Copy(daDir.Join("fg"), daDir.Join("wrfvar_output"))
+	if domain != 1 || vs.Err != nil {
+		return
+	}
+
+	bdy := folders.InputsDir(start).Join("wrfbdy_d01_da%02d", step)
+	vs.Copy(bdy, daDir.Join("wrfbdy_d01"))
+
+	bcCtx := vs.Clone()
+	updateBC(bcCtx, daDir)
+	if bcCtx.Err != nil {
+		vs.LogInfo("da_update_bc.exe failed for cycle %d: %s, using boundaries from real", step, bcCtx.Err)
+		vs.Copy(bdy, daDir.Join("wrfbdy_d01"))
+	}
+}
+
+// DomainErrors collects the errors of all
+// domains where the assimilation of a cycle failed.
+type DomainErrors struct {
+	Cycle int
+	// Errs contains the error of each
+	// failed domain, by domain number.
+	Errs map[int]error
+}
+
+func (errs *DomainErrors) Error() string {
+	domains := make([]int, 0, len(errs.Errs))
+	for domain := range errs.Errs {
+		domains = append(domains, domain)
+	}
+	sort.Ints(domains)
+
+	msgs := make([]string, len(domains))
+	for idx, domain := range domains {
+		msgs[idx] = errs.Errs[domain].Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Is reports whether the error of
+// any domain matches `target`.
+func (errs *DomainErrors) Is(target error) bool {
+	for _, err := range errs.Errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds an error of the failed
+// domains that matches `target`.
+func (errs *DomainErrors) As(target interface{}) bool {
+	for _, err := range errs.Errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// RunDAStep runs the assimilation of `step` in every domain,
+// and returns a report of the observations assimilated.
+//
+// When observations missing have the skip-da policy, the first
+// guess is passed through unchanged. When Cycles.PassThrough is
+// set, the same happens if no observations are available, and for
+// the domains where WRFDA fails, so that the forecast is produced.
+// Otherwise, the errors of failed domains are set in vs.Err as
+// a *DomainErrors. When Procs.ParallelDA is set, WRFDA runs on
+// all domains concurrently.
+func RunDAStep(vs *runctx.Context, start time.Time, step int) *CycleReport {
+	if vs.Err != nil {
+		return nil
+	}
 	domainCount := ReadDomainCount(vs, conf.DAPhase)
-	allSteps := sync.WaitGroup{}
-	allSteps.Add(domainCount)
-	for domain := 1; domain <= domainCount; domain++ {
-		//go func(domain int) {
-		runDAStepInDomain(vs, start, step, domain)
-		allSteps.Done()
-		//}(domain)
+	report := cycleReport(vs, start, step, folders.DAWorkDir(start, 1, step).Host)
+	passThrough := conf.Config.Cycles.PassThrough
+	if passThrough && !report.NoAssimilation && len(report.MissingObservations) == len(conf.ObsTypes) {
+		report.NoAssimilation = true
+		report.Reason = "no observations available"
+	}
+
+	if report.NoAssimilation {
+		vs.LogInfo("No assimilation in cycle %d: %s, first guess passed through unchanged", step, report.Reason)
+		for domain := 1; domain <= domainCount; domain++ {
+			passThroughDA(vs, start, step, domain)
+		}
+		return report
+	}
+
+	procs := daProcCounts(vs, domainCount)
+	if vs.Err != nil {
+		return nil
+	}
+
+	errs := make([]error, domainCount)
+	if conf.Config.Procs.ParallelDA {
+		allSteps := sync.WaitGroup{}
+		allSteps.Add(domainCount)
+		for domain := 1; domain <= domainCount; domain++ {
+			go func(domain int) {
+				domainCtx := vs.Clone()
+				runDAStepInDomain(domainCtx, start, step, domain, procs[domain-1])
+				errs[domain-1] = domainCtx.Err
+				allSteps.Done()
+			}(domain)
+		}
+		allSteps.Wait()
+	} else {
+		for domain := 1; domain <= domainCount; domain++ {
+			domainCtx := vs.Clone()
+			runDAStepInDomain(domainCtx, start, step, domain, procs[domain-1])
+			errs[domain-1] = domainCtx.Err
+			if domainCtx.Err != nil && !passThrough {
+				break
+			}
+		}
+	}
+
+	// domains stopped because the run was interrupted
+	// or timed out are never passed through.
+	if vs.Ctx().Err() != nil {
+		passThrough = false
+	}
+
+	domainErrs := &DomainErrors{Cycle: step, Errs: map[int]error{}}
+	failures := []string{}
+	for idx, err := range errs {
+		if err == nil {
+			continue
+		}
+		domain := idx + 1
+		domainErrs.Errs[domain] = err
+		if passThrough {
+			vs.LogInfo("WRFDA failed for cycle %d, domain %d: %s, first guess passed through unchanged", step, domain, err)
+			passThroughDA(vs, start, step, domain)
+			report.Domains = append(report.Domains, domain)
+			failures = append(failures, fmt.Sprintf("domain %d: %s", domain, err))
+		}
+	}
+	if !passThrough && len(domainErrs.Errs) > 0 {
+		vs.Err = domainErrs
+		return nil
+	}
+
+	if len(failures) > 0 {
+		report.NoAssimilation = true
+		report.Reason = "WRFDA failed for " + strings.Join(failures, "; ")
+		if len(report.Domains) == domainCount {
+			report.Domains = nil
+		}
 	}
-	allSteps.Wait()
+	return report
 }
 
 // BuildDAStepDir ...
-func BuildDAStepDir(vs *ctx.Context, start, end time.Time, step int, host string, mainHost bool) {
+func BuildDAStepDir(vs *runctx.Context, start, end time.Time, step int, host string, mainHost bool) {
 	if vs.Err != nil {
 		return
 	}
 	domainCount := ReadDomainCount(vs, conf.DAPhase)
+	warmStart := step == 1 && mainHost && canWarmStart(vs, start, domainCount)
 
 	alldone := sync.WaitGroup{}
 	alldone.Add(domainCount)
 
 	for domain := 1; domain <= domainCount; domain++ {
 		go func(domain int) {
-			buildDADirInDomain(vs, start, end, step, domain, host, mainHost)
+			buildDADirInDomain(vs, start, end, step, domain, host, mainHost, warmStart)
 			alldone.Done()
 		}(domain)
 	}
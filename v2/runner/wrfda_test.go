@@ -0,0 +1,200 @@
+package runner
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meteocima/wrfda-runner/v2/conf"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
+	"github.com/stretchr/testify/assert"
+)
+
+// prepareDAStep creates the directories of the first DA cycle
+// for 2020122500, with a first guess for each of 3 domains, and
+// an mpirun in PATH that fails, so that WRFDA always fails.
+func prepareDAStep(t *testing.T, cfgAppend string) string {
+	dir, _ := initTestrun(t, cfgAppend)
+
+	for domain := 1; domain <= 3; domain++ {
+		daDir := path.Join(dir, "20201225", "da18_d0"+string(rune('0'+domain)))
+		assert.NoError(t, os.MkdirAll(daDir, 0755))
+		assert.NoError(t, os.WriteFile(path.Join(daDir, "fg"), []byte("fg"), 0644))
+		assert.NoError(t, os.WriteFile(path.Join(daDir, "wrfbdy_d01"), []byte("bdy"), 0644))
+	}
+	updateBC := "#!/bin/sh\necho updated > wrfbdy_d01\n"
+	assert.NoError(t, os.WriteFile(path.Join(dir, "20201225/da18_d01/da_update_bc.exe"), []byte(updateBC), 0755))
+
+	inputs := path.Join(dir, "inputs", "20201225")
+	assert.NoError(t, os.MkdirAll(inputs, 0755))
+	assert.NoError(t, os.WriteFile(path.Join(inputs, "wrfbdy_d01_da01"), []byte("bdy"), 0644))
+
+	bin := path.Join(dir, "bin")
+	assert.NoError(t, os.Mkdir(bin, 0755))
+	assert.NoError(t, os.WriteFile(path.Join(bin, "mpirun"), []byte("#!/bin/sh\nexit 1\n"), 0755))
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", bin+":"+oldPath)
+	t.Cleanup(func() { os.Setenv("PATH", oldPath) })
+
+	return dir
+}
+
+func TestRunDAStepPassThrough(t *testing.T) {
+	dir := prepareDAStep(t, "\n[Cycles]\n    PassThrough = true\n")
+	obsDir := path.Join(dir, "20201225", "observations")
+	assert.NoError(t, os.MkdirAll(obsDir, 0755))
+	assert.NoError(t, os.WriteFile(path.Join(obsDir, "ob.radar.2020122418"), []byte("obs"), 0644))
+
+	start := time.Date(2020, 12, 25, 0, 0, 0, 0, time.UTC)
+	vs := runctx.New(os.Stdin, io.Discard, io.Discard)
+	report := RunDAStep(vs, start, 1)
+	if !assert.NoError(t, vs.Err) {
+		return
+	}
+	assert.True(t, report.NoAssimilation)
+	assert.Nil(t, report.Domains)
+	assert.True(t, strings.HasPrefix(report.Reason, "WRFDA failed for domain 1: "), report.Reason)
+	assert.True(t, strings.HasPrefix(report.String(), "no assimilation in cycle 1: WRFDA failed"))
+
+	for _, domain := range []string{"d01", "d02", "d03"} {
+		content, err := os.ReadFile(path.Join(dir, "20201225", "da18_"+domain, "wrfvar_output"))
+		assert.NoError(t, err)
+		assert.Equal(t, "fg", string(content))
+	}
+	bdy, err := os.ReadFile(path.Join(dir, "20201225/da18_d01/wrfbdy_d01"))
+	assert.NoError(t, err)
+	assert.Equal(t, "updated\n", string(bdy))
+}
+
+func TestRunDAStepPassThroughUpdateBCFailure(t *testing.T) {
+	dir := prepareDAStep(t, "\n[Cycles]\n    PassThrough = true\n")
+	updateBC := "#!/bin/sh\necho partial > wrfbdy_d01\nexit 1\n"
+	assert.NoError(t, os.WriteFile(path.Join(dir, "20201225/da18_d01/da_update_bc.exe"), []byte(updateBC), 0755))
+	obsDir := path.Join(dir, "20201225", "observations")
+	assert.NoError(t, os.MkdirAll(obsDir, 0755))
+	assert.NoError(t, os.WriteFile(path.Join(obsDir, "ob.radar.2020122418"), []byte("obs"), 0644))
+
+	start := time.Date(2020, 12, 25, 0, 0, 0, 0, time.UTC)
+	vs := runctx.New(os.Stdin, io.Discard, io.Discard)
+	report := RunDAStep(vs, start, 1)
+	if !assert.NoError(t, vs.Err) {
+		return
+	}
+	assert.True(t, report.NoAssimilation)
+
+	// the boundaries produced by real are restored
+	bdy, err := os.ReadFile(path.Join(dir, "20201225/da18_d01/wrfbdy_d01"))
+	assert.NoError(t, err)
+	assert.Equal(t, "bdy", string(bdy))
+}
+
+func TestRunDAStepNoObservations(t *testing.T) {
+	prepareDAStep(t, "\n[Cycles]\n    PassThrough = true\n\n[Observations]\n    Radar = \"optional\"\n")
+
+	start := time.Date(2020, 12, 25, 0, 0, 0, 0, time.UTC)
+	vs := runctx.New(os.Stdin, io.Discard, io.Discard)
+	report := RunDAStep(vs, start, 1)
+	assert.NoError(t, vs.Err)
+	assert.Equal(t, "no assimilation in cycle 1: no observations available", report.String())
+}
+
+func TestRunDAStepFailure(t *testing.T) {
+	prepareDAStep(t, "")
+
+	start := time.Date(2020, 12, 25, 0, 0, 0, 0, time.UTC)
+	vs := runctx.New(os.Stdin, io.Discard, io.Discard)
+	RunDAStep(vs, start, 1)
+	assert.Error(t, vs.Err)
+}
+
+func TestRunDAStepParallel(t *testing.T) {
+	dir := prepareDAStep(t, "\n[Procs]\n    ParallelDA = true\n    WrfdaProcCount = \"100\"\n")
+	obsDir := path.Join(dir, "20201225", "observations")
+	assert.NoError(t, os.MkdirAll(obsDir, 0755))
+	assert.NoError(t, os.WriteFile(path.Join(obsDir, "ob.radar.2020122418"), []byte("obs"), 0644))
+
+	// WRFDA fails on domain 2 only
+	mpirun := "#!/bin/sh\necho $2 > procs\ncase `pwd` in *_d02) exit 1;; esac\necho out > wrfvar_output\n"
+	assert.NoError(t, os.WriteFile(path.Join(dir, "bin", "mpirun"), []byte(mpirun), 0755))
+
+	start := time.Date(2020, 12, 25, 0, 0, 0, 0, time.UTC)
+	vs := runctx.New(os.Stdin, io.Discard, io.Discard)
+	RunDAStep(vs, start, 1)
+	var errs *DomainErrors
+	if !assert.True(t, errors.As(vs.Err, &errs), "%v", vs.Err) {
+		return
+	}
+	assert.Equal(t, 1, errs.Cycle)
+	assert.Len(t, errs.Errs, 1)
+	assert.Error(t, errs.Errs[2])
+
+	// all domains run, sharing WrfdaProcCount processes
+	for domain, procs := range map[string]string{"d01": "8\n", "d02": "50\n", "d03": "42\n"} {
+		content, err := os.ReadFile(path.Join(dir, "20201225", "da18_"+domain, "procs"))
+		assert.NoError(t, err)
+		assert.Equal(t, procs, string(content))
+	}
+	_, err := os.Stat(path.Join(dir, "20201225", "da18_d03", "wrfvar_output"))
+	assert.NoError(t, err)
+
+	conf.Config.Procs.WrfdaDomainProcCount = []string{"", "", "10"}
+	vs.Err = nil
+	assert.Equal(t, []string{"14", "86", "10"}, daProcCounts(vs, 3))
+
+	conf.Config.Procs.WrfdaDomainProcCount = nil
+	conf.Config.Procs.WrfdaProcCount = "2"
+	daProcCounts(vs, 3)
+	assert.EqualError(t, vs.Err, "cannot split WrfdaProcCount `2` among 3 domains")
+}
+
+func TestPreviousVARBC(t *testing.T) {
+	dir := prepareDAStep(t, "\n[Cycles]\n    CarryVARBC = true\n")
+	start := time.Date(2020, 12, 25, 0, 0, 0, 0, time.UTC)
+	vs := runctx.New(os.Stdin, io.Discard, io.Discard)
+
+	// there's no previous run
+	assert.Equal(t, "", previousVARBC(vs, start, 1, 1).Path)
+	assert.NoError(t, vs.Err)
+
+	// cycle 1 passed its first guess through, so
+	// it didn't write VARBC.out
+	cycle1 := path.Join(dir, "20201225", "da18_d01")
+	assert.NoError(t, os.WriteFile(path.Join(cycle1, "VARBC.in"), []byte("varbc"), 0644))
+	assert.Equal(t, path.Join(cycle1, "VARBC.in"), previousVARBC(vs, start, 2, 1).Path)
+
+	assert.NoError(t, os.WriteFile(path.Join(cycle1, "VARBC.out"), []byte("varbc"), 0644))
+	assert.Equal(t, path.Join(cycle1, "VARBC.out"), previousVARBC(vs, start, 2, 1).Path)
+
+	// the first cycle continues the last one of previous run
+	previous := path.Join(dir, "20201224", "da00_d01")
+	assert.NoError(t, os.MkdirAll(previous, 0755))
+	assert.NoError(t, os.WriteFile(path.Join(previous, "VARBC.out"), []byte("varbc"), 0644))
+	assert.Equal(t, path.Join(previous, "VARBC.out"), previousVARBC(vs, start, 1, 1).Path)
+	assert.NoError(t, vs.Err)
+
+	previousVARBC(vs, start, 3, 1)
+	assert.EqualError(t, vs.Err, "cannot find VARBC coefficients of previous cycle in `simulation:"+dir+"/20201225/da21_d01`")
+}
+
+func TestWarmStart(t *testing.T) {
+	dir := prepareDAStep(t, "\n[Cycles]\n    WarmStart = true\n")
+	start := time.Date(2020, 12, 25, 0, 0, 0, 0, time.UTC)
+	vs := runctx.New(os.Stdin, io.Discard, io.Discard)
+
+	assert.Equal(t, dir+"/20201224/wrf00/wrfout_d02_2020-12-24_18:00:00", warmStartFile(start, 2).Path)
+	assert.False(t, canWarmStart(vs, start, 3))
+
+	previous := path.Join(dir, "20201224", "wrf00")
+	assert.NoError(t, os.MkdirAll(previous, 0755))
+	for _, domain := range []string{"d01", "d02"} {
+		assert.NoError(t, os.WriteFile(path.Join(previous, "wrfout_"+domain+"_2020-12-24_18:00:00"), []byte("wrfout"), 0644))
+	}
+	// all domains must be available
+	assert.False(t, canWarmStart(vs, start, 3))
+	assert.True(t, canWarmStart(vs, start, 2))
+	assert.NoError(t, vs.Err)
+}
@@ -9,10 +9,11 @@ import (
 	"github.com/meteocima/virtual-server/tasks"
 	"github.com/meteocima/wrfda-runner/v2/conf"
 	"github.com/meteocima/wrfda-runner/v2/folders"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
 	"github.com/meteocima/wrfda-runner/v2/runner"
 )
 
-func checkDirExists(vs *ctx.Context, startDate time.Time, cycle int) error {
+func checkDirExists(vs *runctx.Context, startDate time.Time, cycle int) error {
 	domainCount := runner.ReadDomainCount(vs, conf.DAPhase)
 
 	for domain := 1; domain <= domainCount; domain++ {
@@ -23,7 +24,7 @@ func checkDirExists(vs *ctx.Context, startDate time.Time, cycle int) error {
 		}
 	}
 
-	if cycle < 3 {
+	if !conf.Config.Cycles.IsLast(cycle) {
 		return nil
 	}
 
@@ -42,7 +43,8 @@ func NewDACycleTask(startDate time.Time, cycle int) *tasks.Task {
 	endDate := startDate.Add(48 * time.Hour)
 
 	tskID := fmt.Sprintf("WRFDA-%s-CYCLE-%d", dtPart, cycle)
-	tsk := tasks.New(tskID, func(vs *ctx.Context) error {
+	tsk := tasks.New(tskID, func(tvs *ctx.Context) error {
+		vs := runctx.Wrap(tvs)
 
 		if err := checkDirExists(vs, startDate, cycle); err != nil {
 			return err
@@ -62,7 +64,7 @@ func NewDACycleTask(startDate time.Time, cycle int) *tasks.Task {
 
 		runner.RunDAStep(vs, startDate, cycle)
 
-		if cycle >= 3 {
+		if conf.Config.Cycles.IsLast(cycle) {
 			return nil
 		}
 
@@ -13,6 +13,7 @@ import (
 	"github.com/meteocima/virtual-server/tasks"
 	"github.com/meteocima/virtual-server/vpath"
 	"github.com/meteocima/wrfda-runner/v2/folders"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
 )
 
 // NewWPSTask ...
@@ -20,7 +21,8 @@ func NewWPSTask(startDate time.Time) *tasks.Task {
 	dtPart := startDate.Format("2006010215")
 
 	tskID := fmt.Sprintf("WPS-%s", dtPart)
-	tsk := tasks.New(tskID, func(vs *ctx.Context) error {
+	tsk := tasks.New(tskID, func(tvs *ctx.Context) error {
+		vs := runctx.Wrap(tvs)
 		//wpsDir := folders.WPSWorkDir(startDate)
 		//if vs.Exists(wpsDir) {
 		//	return fmt.Errorf("WPS working directory `%s` already exists", wpsDir)
@@ -55,8 +57,8 @@ func NewWPSTask(startDate time.Time) *tasks.Task {
 		alldone.Wait()
 
 		runner.BuildWPSDir(vs, startDate, endDate, conf.GFS)
-		runner.RunWPS(vs, startDate, endDate)
-		for step := 1; step <= 3; step++ {
+		runner.RunWPS(vs, startDate, endDate, conf.GFS)
+		for step := 1; step <= conf.Config.Cycles.Count; step++ {
 			runner.BuildNamelistForReal(vs, startDate, endDate, step)
 			runner.RunReal(vs, startDate, step, conf.WPSPhase)
 		}
@@ -9,6 +9,7 @@ import (
 	"github.com/meteocima/virtual-server/tasks"
 	"github.com/meteocima/wrfda-runner/v2/conf"
 	"github.com/meteocima/wrfda-runner/v2/folders"
+	"github.com/meteocima/wrfda-runner/v2/runctx"
 	"github.com/meteocima/wrfda-runner/v2/runner"
 )
 
@@ -18,8 +19,10 @@ func NewWRFTask(startDate time.Time) *tasks.Task {
 	endDate := startDate.Add(48 * time.Hour)
 
 	tskID := fmt.Sprintf("WRF-%s", dtPart)
-	tsk := tasks.New(tskID, func(vs *ctx.Context) error {
-		wrfDir := folders.WRFWorkDir(startDate, 3)
+	tsk := tasks.New(tskID, func(tvs *ctx.Context) error {
+		vs := runctx.Wrap(tvs)
+		lastCycle := conf.Config.Cycles.Count
+		wrfDir := folders.WRFWorkDir(startDate, lastCycle)
 
 		if vs.Exists(wrfDir) {
 			return fmt.Errorf("working directory `%s` already exists for WRF main run for date %s", wrfDir, dtPart)
@@ -34,9 +37,9 @@ func NewWRFTask(startDate time.Time) *tasks.Task {
 		}
 
 		for idx, host := range hosts {
-			runner.BuildWRFDir(vs, startDate, endDate, 3, host, idx == 0)
+			runner.BuildWRFDir(vs, startDate, endDate, lastCycle, host, idx == 0)
 		}
-		runner.RunWRFStep(vs, startDate, 3)
+		runner.RunWRFStep(vs, startDate, lastCycle)
 
 		return nil
 	})